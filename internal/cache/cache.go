@@ -0,0 +1,126 @@
+// Package cache provides a bounded in-memory cache whose entries expire.
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache maps keys to values for up to a fixed time. Only the most recently
+// used keys are kept; the least recently used entry is evicted when there are
+// too many.
+//
+// A nil *Cache caches nothing.
+type Cache[V any] struct {
+	ttl     time.Duration
+	maxKeys int
+	now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type entry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+// New creates a *Cache that keeps up to maxKeys entries for ttl each. It
+// returns nil, which caches nothing, if ttl or maxKeys is not positive.
+func New[V any](maxKeys int, ttl time.Duration) *Cache[V] {
+	if ttl <= 0 || maxKeys <= 0 {
+		return nil
+	}
+	return &Cache[V]{
+		ttl:     ttl,
+		maxKeys: maxKeys,
+		now:     time.Now,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// Get returns the value for key, if there is one that hasn't expired.
+func (c *Cache[V]) Get(key string) (V, bool) {
+	var zero V
+	if c == nil {
+		return zero, false
+	}
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return zero, false
+	}
+	ent := e.Value.(*entry[V])
+	if !now.Before(ent.expires) {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		return zero, false
+	}
+	c.lru.MoveToFront(e)
+	return ent.value, true
+}
+
+// Add sets the value for key.
+func (c *Cache[V]) Add(key string, value V) {
+	if c == nil {
+		return
+	}
+	expires := c.now().Add(c.ttl)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		ent := e.Value.(*entry[V])
+		ent.value, ent.expires = value, expires
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&entry[V]{key: key, value: value, expires: expires})
+	for c.lru.Len() > c.maxKeys {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry[V]).key)
+	}
+}
+
+// Remove forgets the values for keys.
+func (c *Cache[V]) Remove(keys ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if e, ok := c.entries[key]; ok {
+			c.lru.Remove(e)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Clear forgets every value.
+func (c *Cache[V]) Clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+	c.lru.Init()
+}
+
+// Len returns the number of entries, including expired ones that haven't
+// been evicted yet.
+func (c *Cache[V]) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	c := New[int](10, time.Minute)
+	now := time.Unix(0, 0)
+	c.now = func() time.Time { return now }
+	c.Add("a", 1)
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Fatalf("Get(%q)=%v, %v, want 1, true", "a", v, ok)
+	}
+	now = now.Add(time.Minute)
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("Get(%q) after the ttl returned true, want false", "a")
+	}
+	if got := c.Len(); got != 0 {
+		t.Errorf("Len() after an expired Get()=%v, want 0", got)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	c := New[string](10, time.Minute)
+	c.Add("a", "1")
+	c.Add("b", "2")
+	c.Add("c", "3")
+	c.Remove("a", "b", "missing")
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("Get(%q) after Remove() returned true, want false", "a")
+	}
+	if v, ok := c.Get("c"); !ok || v != "3" {
+		t.Errorf("Get(%q)=%q, %v, want %q, true", "c", v, ok, "3")
+	}
+	c.Clear()
+	if got := c.Len(); got != 0 {
+		t.Errorf("Len() after Clear()=%v, want 0", got)
+	}
+}
+
+func TestBoundedKeys(t *testing.T) {
+	c := New[int](3, time.Minute)
+	for i := 0; i < 100; i++ {
+		c.Add(fmt.Sprint(i), i)
+		// Keep 0 in use so that it isn't evicted.
+		c.Get("0")
+	}
+	if got, want := c.Len(), 3; got != want {
+		t.Errorf("Len()=%v, want %v", got, want)
+	}
+	for _, key := range []string{"0", "99", "98"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("Get(%q) returned false, want true", key)
+		}
+	}
+}
+
+func TestNilCachesNothing(t *testing.T) {
+	c := New[int](0, time.Minute)
+	c.Add("a", 1)
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("Get() on a disabled cache returned true, want false")
+	}
+	c.Remove("a")
+	c.Clear()
+}
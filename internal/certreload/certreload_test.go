@@ -0,0 +1,102 @@
+package certreload
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate with the given serial number to
+// certFile and keyFile, and sets their modification time to mtime.
+func writeCert(t *testing.T, certFile, keyFile string, serial int64, mtime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "golinkservice.com"},
+		DNSNames:     []string{"golinkservice.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func serial(t *testing.T, r *Reloader) int64 {
+	t.Helper()
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("GetCertificate() failed: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber.Int64()
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Minute)
+	writeCert(t, certFile, keyFile, 1, start)
+	r, err := New(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	if got, want := serial(t, r), int64(1); got != want {
+		t.Errorf("serial=%v, want %v", got, want)
+	}
+	changed, err := r.Reload()
+	if err != nil || changed {
+		t.Errorf("Reload() of unmodified files returned changed=%v, err=%v, want false, nil", changed, err)
+	}
+
+	writeCert(t, certFile, keyFile, 2, start.Add(time.Second))
+	changed, err = r.Reload()
+	if err != nil || !changed {
+		t.Errorf("Reload() of new files returned changed=%v, err=%v, want true, nil", changed, err)
+	}
+	if got, want := serial(t, r), int64(2); got != want {
+		t.Errorf("serial=%v, want %v", got, want)
+	}
+
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reload(); err == nil {
+		t.Errorf("Reload() of an invalid key returned err=nil, want an error")
+	}
+	if got, want := serial(t, r), int64(2); got != want {
+		t.Errorf("serial after a failed reload=%v, want %v", got, want)
+	}
+}
@@ -0,0 +1,170 @@
+// Package config loads the settings of the server. Every setting is a flag,
+// and a flag that isn't given on the command line can be set by an
+// environment variable or by an optional JSON config file instead, in that
+// order of precedence.
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// FileFlag is the name of the flag that holds the path to the config file.
+const FileFlag = "config"
+
+// envPrefix is prepended to the upper-cased flag name to get the name of its
+// environment variable, like GOLINK_DB_PATH for -db_path.
+const envPrefix = "GOLINK_"
+
+// EnvName returns the name of the environment variable for the flag name.
+func EnvName(name string) string {
+	return envPrefix + strings.ToUpper(name)
+}
+
+// Load parses args into fs and then sets the flags that weren't on the
+// command line from the environment, using getenv, and then from the config
+// file named by the FileFlag flag, if fs has one and it's set.
+//
+// The config file is a JSON object keyed by flag name. Values may be strings,
+// numbers, booleans or lists, which are joined with commas.
+func Load(fs *flag.FlagSet, args []string, getenv func(string) string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var errs []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] {
+			return
+		}
+		v := getenv(EnvName(f.Name))
+		if v == "" {
+			return
+		}
+		if err := fs.Set(f.Name, v); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid value %q for %s: %v", v, EnvName(f.Name), err))
+			return
+		}
+		set[f.Name] = true
+	})
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid environment: %s", strings.Join(errs, "; "))
+	}
+	path := ""
+	if f := fs.Lookup(FileFlag); f != nil {
+		path = f.Value.String()
+	}
+	if path == "" {
+		return nil
+	}
+	values, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if fs.Lookup(name) == nil || name == FileFlag {
+			return fmt.Errorf("config file %q: unknown setting %q", path, name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, values[name]); err != nil {
+			return fmt.Errorf("config file %q: invalid value %q for %q: %w", path, values[name], name, err)
+		}
+	}
+	return nil
+}
+
+// readFile reads a JSON config file into flag values.
+func readFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %q: %w", path, err)
+	}
+	values := make(map[string]string, len(raw))
+	for name, v := range raw {
+		s, err := flagValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("config file %q: setting %q: %w", path, name, err)
+		}
+		values[name] = s
+	}
+	return values, nil
+}
+
+func flagValue(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool, float64:
+		return fmt.Sprint(v), nil
+	case []any:
+		var parts []string
+		for _, e := range v {
+			s, err := flagValue(e)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// List splits a comma-separated flag value, dropping empty entries.
+func List(s string) []string {
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// BaseURL parses and validates the public base URL of the service, like
+// https://go.example.com.
+func BaseURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL %q: %w", s, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid base URL %q: the scheme must be http or https", s)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid base URL %q: missing host", s)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid base URL %q: must not have a path, query or fragment", s)
+	}
+	u.Path = ""
+	return u, nil
+}
+
+// CheckShortHosts validates host names like "go" that users type in place of
+// the base URL.
+func CheckShortHosts(hosts []string) error {
+	for _, h := range hosts {
+		if strings.ContainsAny(h, ":/ ") {
+			return fmt.Errorf("invalid short host %q: must be a bare host name", h)
+		}
+	}
+	return nil
+}
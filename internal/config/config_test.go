@@ -0,0 +1,87 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "golink.json")
+	const file = `{
+	"base_url": "https://file.example.com",
+	"short_hosts": ["go", "go.corp"],
+	"enforce_https": true,
+	"db_path": "/file/golink.db",
+	"port": 8080
+}`
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String(FileFlag, "", "")
+	baseURL := fs.String("base_url", "", "")
+	shortHosts := fs.String("short_hosts", "go", "")
+	enforceHTTPS := fs.Bool("enforce_https", false, "")
+	dbPath := fs.String("db_path", "/tmp/golink.db", "")
+	port := fs.Int("port", 10123, "")
+	env := map[string]string{
+		"GOLINK_CONFIG":  path,
+		"GOLINK_DB_PATH": "/env/golink.db",
+		"GOLINK_PORT":    "9000",
+	}
+	args := []string{"-port=7000"}
+	if err := Load(fs, args, func(k string) string { return env[k] }); err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	if got, want := *baseURL, "https://file.example.com"; got != want {
+		t.Errorf("base_url=%q, want %q from the file", got, want)
+	}
+	if got, want := *shortHosts, "go,go.corp"; got != want {
+		t.Errorf("short_hosts=%q, want %q from the file", got, want)
+	}
+	if got, want := *enforceHTTPS, true; got != want {
+		t.Errorf("enforce_https=%v, want %v from the file", got, want)
+	}
+	if got, want := *dbPath, "/env/golink.db"; got != want {
+		t.Errorf("db_path=%q, want %q from the environment", got, want)
+	}
+	if got, want := *port, 7000; got != want {
+		t.Errorf("port=%v, want %v from the command line", got, want)
+	}
+}
+
+func TestLoadUnknownSetting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "golink.json")
+	if err := os.WriteFile(path, []byte(`{"no_such_flag": 1}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String(FileFlag, "", "")
+	if err := Load(fs, []string{"-config", path}, func(string) string { return "" }); err == nil {
+		t.Errorf("Load() with an unknown setting returned err=nil, want an error")
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	type testCase struct {
+		url     string
+		wantErr bool
+	}
+	testCases := []testCase{
+		{url: "https://go.example.com"},
+		{url: "http://localhost:10123/"},
+		{url: "go.example.com", wantErr: true},
+		{url: "ftp://go.example.com", wantErr: true},
+		{url: "https://go.example.com/links", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.url, func(t *testing.T) {
+			_, err := BaseURL(tc.url)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("BaseURL(%q) returned err=%v, want error: %v", tc.url, err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	snapshotPrefix = "golink-"
+	snapshotSuffix = ".db"
+	// snapshotTime is the layout of the time in the names of snapshots.
+	snapshotTime = "20060102T150405Z"
+)
+
+// Backup writes a consistent copy of db to path with VACUUM INTO, which reads
+// db in a single transaction and so doesn't stop others from using it. The
+// copy is written next to path and renamed into place, so that path is never
+// a partial backup.
+func Backup(ctx context.Context, db *sql.DB, path string) error {
+	tmp := path + ".tmp"
+	// VACUUM INTO refuses to overwrite a file that isn't empty.
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove the old partial backup: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, "vacuum into ?;", tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to back up the database: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to move the backup into place: %w", err)
+	}
+	return nil
+}
+
+// Snapshot backs db up to a new file in dir, named after now, and returns its
+// path. It creates dir if it doesn't exist.
+func Snapshot(ctx context.Context, db *sql.DB, dir string, now time.Time) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create the snapshot directory: %w", err)
+	}
+	path := filepath.Join(dir, snapshotPrefix+now.UTC().Format(snapshotTime)+snapshotSuffix)
+	if err := Backup(ctx, db, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// PruneSnapshots deletes the snapshots in dir that were taken before before,
+// except for the latest one, and returns how many it deleted. Other files in
+// dir are left alone.
+func PruneSnapshots(dir string, before time.Time) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	type snapshot struct {
+		name  string
+		taken time.Time
+	}
+	var snapshots []snapshot
+	for _, e := range entries {
+		name := e.Name()
+		s, ok := strings.CutPrefix(name, snapshotPrefix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		if s, ok = strings.CutSuffix(s, snapshotSuffix); !ok {
+			continue
+		}
+		taken, err := time.Parse(snapshotTime, s)
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, snapshot{name: name, taken: taken})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].taken.Before(snapshots[j].taken) })
+	n := 0
+	for i, s := range snapshots {
+		if i == len(snapshots)-1 || !s.taken.Before(before) {
+			break
+		}
+		if err := os.Remove(filepath.Join(dir, s.name)); err != nil {
+			return n, fmt.Errorf("failed to delete snapshot: %w", err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// CheckBackup checks that the file at path is an intact database that this
+// binary can use, and returns its schema version. Backups from older versions
+// are fine, since they're migrated when opened.
+func CheckBackup(ctx context.Context, path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, fmt.Errorf("cannot read backup: %w", err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer db.Close()
+	var integrity string
+	if err := db.QueryRowContext(ctx, "pragma integrity_check;").Scan(&integrity); err != nil {
+		return 0, fmt.Errorf("backup is not a database: %w", err)
+	}
+	if integrity != "ok" {
+		return 0, fmt.Errorf("backup is corrupt: %s", integrity)
+	}
+	var tables int
+	if err := db.QueryRowContext(ctx, "select count(*) from sqlite_master where type = 'table' and name = 'links';").Scan(&tables); err != nil {
+		return 0, fmt.Errorf("failed to read backup: %w", err)
+	}
+	if tables == 0 {
+		return 0, errors.New("backup has no links table")
+	}
+	v, err := Version(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	if v > SchemaVersion() {
+		return 0, fmt.Errorf("backup is at schema version %d, which is newer than the supported version %d", v, SchemaVersion())
+	}
+	return v, nil
+}
+
+// ErrInUse means that a database can't be restored because something, like a
+// running server, has it open.
+var ErrInUse = errors.New("the database is in use; stop the server before restoring")
+
+// Restore replaces the database at dbPath with the backup at backupPath,
+// after checking the backup with CheckBackup. It returns the backup's schema
+// version and the path that the database it replaced was moved to, which is
+// dbPath with a ".pre-restore-" suffix and now, or "" if there was no
+// database. If Restore fails, the database is left where it was.
+//
+// Nothing may have the database open while it's restored. Restore fails with
+// ErrInUse if something does and the database is in wal mode, the default;
+// in other journal modes it can't tell.
+func Restore(ctx context.Context, backupPath, dbPath string, now time.Time) (int, string, error) {
+	v, err := CheckBackup(ctx, backupPath)
+	if err != nil {
+		return 0, "", err
+	}
+	if err := checkNotInUse(ctx, dbPath); err != nil {
+		return 0, "", err
+	}
+	kept := dbPath + ".pre-restore-" + now.UTC().Format(snapshotTime)
+	if _, err := os.Lstat(kept); err == nil {
+		return 0, "", fmt.Errorf("%s already exists", kept)
+	}
+	tmp := dbPath + ".restoring"
+	if err := copyFile(backupPath, tmp); err != nil {
+		os.Remove(tmp)
+		return 0, "", fmt.Errorf("failed to copy backup: %w", err)
+	}
+	// Move the journal files along with the database, since they'd be
+	// applied to the backup otherwise.
+	var moved []string
+	rollback := func() error {
+		errs := []error{os.Remove(tmp)}
+		for i := len(moved) - 1; i >= 0; i-- {
+			errs = append(errs, os.Rename(kept+moved[i], dbPath+moved[i]))
+		}
+		if err := errors.Join(errs...); err != nil {
+			return fmt.Errorf("failed to put the database back, it's at %s: %w", kept, err)
+		}
+		return nil
+	}
+	for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+		err := os.Rename(dbPath+suffix, kept+suffix)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, "", errors.Join(fmt.Errorf("failed to move the database aside: %w", err), rollback())
+		}
+		moved = append(moved, suffix)
+	}
+	if err := os.Rename(tmp, dbPath); err != nil {
+		return 0, "", errors.Join(fmt.Errorf("failed to move the backup into place: %w", err), rollback())
+	}
+	if len(moved) == 0 {
+		kept = ""
+	}
+	return v, kept, nil
+}
+
+// checkNotInUse returns ErrInUse if something has the database at path open
+// in wal mode, in which connections keep a lock on the database for as long
+// as they're open. Other errors are ignored, since a database that can't be
+// opened, like a corrupt one, can still be replaced.
+func checkNotInUse(ctx context.Context, path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=rw&_locking_mode=EXCLUSIVE&_busy_timeout=0")
+	if err != nil {
+		return nil
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, "begin exclusive; commit;")
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked) {
+		return ErrInUse
+	}
+	return nil
+}
+
+// copyFile copies the file at src to dst and syncs it.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
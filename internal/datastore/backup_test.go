@@ -0,0 +1,183 @@
+package datastore_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spwg/golink/internal/datastore"
+	"github.com/spwg/golink/internal/golinktest"
+	"github.com/spwg/golink/internal/link"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	if err := link.Create(ctx, db, "foo", "http://example.com"); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	backup := filepath.Join(dir, "backup.db")
+	if err := datastore.Backup(ctx, db, backup); err != nil {
+		t.Fatalf("Backup() failed: %v", err)
+	}
+	// Changes after the backup aren't in it.
+	if err := link.Create(ctx, db, "bar", "http://example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := datastore.CheckBackup(ctx, backup); err != nil || v != datastore.SchemaVersion() {
+		t.Errorf("CheckBackup() = %v, %v, want %v, nil", v, err, datastore.SchemaVersion())
+	}
+
+	dbPath := filepath.Join(dir, "golink.db")
+	if err := os.WriteFile(dbPath, []byte("the old database"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, kept, err := datastore.Restore(ctx, backup, dbPath, now)
+	if err != nil {
+		t.Fatalf("Restore() failed: %v", err)
+	}
+	if b, err := os.ReadFile(kept); err != nil || string(b) != "the old database" {
+		t.Errorf("Restore() kept %q, %v as the previous database, want %q", b, err, "the old database")
+	}
+	// Restoring again keeps the previous copy.
+	if _, kept2, err := datastore.Restore(ctx, backup, dbPath, now.Add(time.Hour)); err != nil || kept2 == kept {
+		t.Errorf("Restore() again = %q, %v, want the database kept somewhere other than %q", kept2, err, kept)
+	}
+	if b, err := os.ReadFile(kept); err != nil || string(b) != "the old database" {
+		t.Errorf("Restore() again left %q, %v as the first previous database, want %q", b, err, "the old database")
+	}
+	restored, err := datastore.SQLite(ctx, dbPath, "", datastore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if _, err := link.Read(ctx, restored, "foo"); err != nil {
+		t.Errorf("Read(%q) from the restored database failed: %v", "foo", err)
+	}
+	if _, err := link.Read(ctx, restored, "bar"); err != link.ErrNotFound {
+		t.Errorf("Read(%q) from the restored database returned err=%v, want %v", "bar", err, link.ErrNotFound)
+	}
+}
+
+func TestCheckBackup(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	garbage := filepath.Join(dir, "garbage.db")
+	if err := os.WriteFile(garbage, []byte("not a database, but long enough to look like one at first glance"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db := golinktest.NewDatabase(ctx, t)
+	newer := filepath.Join(dir, "newer.db")
+	if err := datastore.Backup(ctx, db, newer); err != nil {
+		t.Fatal(err)
+	}
+	newerDB, err := datastore.SQLite(ctx, newer, "", datastore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newerDB.ExecContext(ctx, "pragma user_version = 1000;"); err != nil {
+		t.Fatal(err)
+	}
+	newerDB.Close()
+	for _, path := range []string{filepath.Join(dir, "missing.db"), garbage, newer} {
+		if _, err := datastore.CheckBackup(ctx, path); err == nil {
+			t.Errorf("CheckBackup(%q) succeeded, want an error", filepath.Base(path))
+		}
+		dbPath := filepath.Join(dir, "golink.db")
+		if _, _, err := datastore.Restore(ctx, path, dbPath, time.Now()); err == nil {
+			t.Errorf("Restore(%q) succeeded, want an error", filepath.Base(path))
+		}
+		if _, err := os.Stat(dbPath); !os.IsNotExist(err) {
+			t.Errorf("Restore(%q) left a database behind after failing", filepath.Base(path))
+		}
+	}
+}
+
+func TestRestoreRollback(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	dir := t.TempDir()
+	backup := filepath.Join(dir, "backup.db")
+	if err := datastore.Backup(ctx, db, backup); err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(dir, "golink.db")
+	for _, f := range []string{dbPath, dbPath + "-shm"} {
+		if err := os.WriteFile(f, []byte(filepath.Base(f)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The -shm file can't be moved aside after the database has been.
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.MkdirAll(filepath.Join(dbPath+".pre-restore-20200101T000000Z-shm", "full"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := datastore.Restore(ctx, backup, dbPath, now); err == nil {
+		t.Fatalf("Restore() succeeded, want an error")
+	}
+	for _, f := range []string{dbPath, dbPath + "-shm"} {
+		if b, err := os.ReadFile(f); err != nil || string(b) != filepath.Base(f) {
+			t.Errorf("Restore() left %q, %v at %s after failing, want it as it was", b, err, filepath.Base(f))
+		}
+	}
+	if _, err := os.Stat(dbPath + ".restoring"); !os.IsNotExist(err) {
+		t.Errorf("Restore() left the copy of the backup behind after failing")
+	}
+}
+
+func TestRestoreInUse(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "golink.db")
+	db, err := datastore.SQLite(ctx, dbPath, "create table if not exists links (id integer primary key, name text not null unique, url text not null);", datastore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup := filepath.Join(dir, "backup.db")
+	if err := datastore.Backup(ctx, db, backup); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := datastore.Restore(ctx, backup, dbPath, time.Now()); err != datastore.ErrInUse {
+		t.Errorf("Restore() of an open database returned err=%v, want %v", err, datastore.ErrInUse)
+	}
+	db.Close()
+	if _, _, err := datastore.Restore(ctx, backup, dbPath, time.Now()); err != nil {
+		t.Errorf("Restore() after the database was closed failed: %v", err)
+	}
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	dir := t.TempDir()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		if _, err := datastore.Snapshot(ctx, db, dir, start.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatalf("Snapshot() failed: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	count := func() int {
+		matches, err := filepath.Glob(filepath.Join(dir, "golink-*.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(matches)
+	}
+	if n, err := datastore.PruneSnapshots(dir, start.Add(90*time.Minute)); err != nil || n != 2 || count() != 1 {
+		t.Errorf("PruneSnapshots() = %v, %v and left %d snapshots, want 2, nil and 1", n, err, count())
+	}
+	// The latest snapshot is kept, however old.
+	if n, err := datastore.PruneSnapshots(dir, start.Add(24*time.Hour)); err != nil || n != 0 || count() != 1 {
+		t.Errorf("PruneSnapshots() = %v, %v and left %d snapshots, want 0, nil and 1", n, err, count())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("PruneSnapshots() deleted a file that isn't a snapshot: %v", err)
+	}
+}
@@ -4,32 +4,144 @@ package datastore
 import (
 	"context"
 	"database/sql"
-	"errors"
 	"fmt"
-	"os"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// SQLite opens a *sql.DB backed by a sqlite3 database at path.
-func SQLite(ctx context.Context, path, schema string) (*sql.DB, error) {
-	_, err := os.Stat(path)
+const (
+	defaultJournalMode = "wal"
+	defaultSynchronous = "normal"
+	defaultBusyTimeout = 5 * time.Second
+)
+
+// Options configures the connections to a database. The zero value of each
+// field means its default.
+type Options struct {
+	// JournalMode is SQLite's journal_mode: delete, truncate, persist,
+	// memory, wal or off. Defaults to wal, in which readers don't block the
+	// writer and the writer doesn't block readers.
+	JournalMode string
+	// Synchronous is SQLite's synchronous level: off, normal, full or extra.
+	// Defaults to normal, which can't corrupt a database in wal mode but may
+	// lose the last changes if the machine loses power.
+	Synchronous string
+	// BusyTimeout is how long a connection waits for another one to finish
+	// writing before it fails with "database is locked". Defaults to 5
+	// seconds; negative fails at once.
+	BusyTimeout time.Duration
+	// NoForeignKeys turns off the enforcement of foreign key constraints.
+	NoForeignKeys bool
+	// MaxOpenConns is the most connections that are open at once, which
+	// bounds how many queries run in parallel. Defaults to twice the number
+	// of CPUs.
+	MaxOpenConns int
+	// MaxIdleConns is the most idle connections that are kept open. Defaults
+	// to MaxOpenConns, since opening a connection is slow compared to most
+	// queries.
+	MaxIdleConns int
+	// ConnMaxLifetime is how long a connection is reused for. Zero means
+	// forever.
+	ConnMaxLifetime time.Duration
+}
+
+func (opts Options) journalMode() string {
+	if opts.JournalMode == "" {
+		return defaultJournalMode
+	}
+	return strings.ToLower(opts.JournalMode)
+}
+
+// dsn returns the data source name that opens path with opts, or an error if
+// opts are invalid. Pragmas go in the data source name rather than being
+// executed once so that every connection in the pool gets them.
+func (opts Options) dsn(path string) (string, error) {
+	journalMode := opts.journalMode()
+	switch journalMode {
+	case "delete", "truncate", "persist", "memory", "wal", "off":
+	default:
+		return "", fmt.Errorf("invalid journal mode %q", opts.JournalMode)
+	}
+	synchronous := strings.ToLower(opts.Synchronous)
+	if synchronous == "" {
+		synchronous = defaultSynchronous
+	}
+	switch synchronous {
+	case "off", "normal", "full", "extra":
+	default:
+		return "", fmt.Errorf("invalid synchronous level %q", opts.Synchronous)
+	}
+	busyTimeout := opts.BusyTimeout
+	if busyTimeout == 0 {
+		busyTimeout = defaultBusyTimeout
+	}
+	foreignKeys := "1"
+	if opts.NoForeignKeys {
+		foreignKeys = "0"
+	}
+	q := url.Values{}
+	q.Set("_journal_mode", journalMode)
+	q.Set("_synchronous", synchronous)
+	q.Set("_busy_timeout", strconv.FormatInt(max(busyTimeout.Milliseconds(), 0), 10))
+	q.Set("_foreign_keys", foreignKeys)
+	// Transactions take the write lock when they begin rather than at their
+	// first write, which waits for BusyTimeout if another connection has it.
+	// Upgrading a read lock can't wait and fails at once instead.
+	q.Set("_txlock", "immediate")
+	return path + "?" + q.Encode(), nil
+}
+
+// SQLite opens a *sql.DB backed by a sqlite3 database at path, creating the
+// database if it doesn't exist, and brings its schema up to date.
+func SQLite(ctx context.Context, path, schema string, opts Options) (*sql.DB, error) {
+	dsn, err := opts.dsn(path)
 	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			return nil, fmt.Errorf("cannot create database handle: %w", err)
-		}
-		f, err := os.Create(path)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create database: %w", err)
-		}
-		if err := f.Close(); err != nil {
-			return nil, fmt.Errorf("failed to close the new database: %w", err)
-		}
-	}
-	db, err := sql.Open("sqlite3", path)
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
+	maxOpen := opts.MaxOpenConns
+	if maxOpen == 0 {
+		maxOpen = 2 * runtime.NumCPU()
+	}
+	maxIdle := opts.MaxIdleConns
+	if maxIdle == 0 {
+		maxIdle = maxOpen
+	}
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	if err := checkJournalMode(ctx, db, opts); err != nil {
+		db.Close()
+		return nil, err
+	}
 	if _, err := db.ExecContext(ctx, schema); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to execute schema statements: %w", err)
 	}
+	if err := migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
 	return db, nil
 }
+
+// checkJournalMode fails if the database didn't switch to the journal mode in
+// opts, which SQLite doesn't report as an error. Some file systems, like
+// network ones, don't support wal.
+func checkJournalMode(ctx context.Context, db *sql.DB, opts Options) error {
+	want := opts.journalMode()
+	var got string
+	if err := db.QueryRowContext(ctx, "pragma journal_mode;").Scan(&got); err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	if !strings.EqualFold(got, want) {
+		return fmt.Errorf("database is in journal mode %q rather than %q, which its file system may not support", got, want)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// schema is the base schema of internal/schema/golink.sql.
+const schema = "create table if not exists links (id integer primary key, name text not null unique, url text not null);"
+
+func TestOptions(t *testing.T) {
+	ctx := context.Background()
+	opts := Options{BusyTimeout: 3 * time.Second, Synchronous: "full", MaxOpenConns: 3}
+	db, err := SQLite(ctx, filepath.Join(t.TempDir(), "golink.db"), schema, opts)
+	if err != nil {
+		t.Fatalf("SQLite() failed: %v", err)
+	}
+	defer db.Close()
+	// Every connection in the pool gets the pragmas, not just the first.
+	for i := 0; i < opts.MaxOpenConns; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		var journalMode string
+		var busyTimeout, synchronous, foreignKeys int
+		if err := conn.QueryRowContext(ctx, "select * from pragma_journal_mode, pragma_busy_timeout, pragma_synchronous, pragma_foreign_keys;").
+			Scan(&journalMode, &busyTimeout, &synchronous, &foreignKeys); err != nil {
+			t.Fatal(err)
+		}
+		// synchronous is 2 for full.
+		if journalMode != "wal" || busyTimeout != 3000 || synchronous != 2 || foreignKeys != 1 {
+			t.Errorf("Connection %d has journal_mode=%s busy_timeout=%d synchronous=%d foreign_keys=%d, want wal, 3000, 2 and 1",
+				i, journalMode, busyTimeout, synchronous, foreignKeys)
+		}
+	}
+	if got := db.Stats().MaxOpenConnections; got != opts.MaxOpenConns {
+		t.Errorf("MaxOpenConnections = %d, want %d", got, opts.MaxOpenConns)
+	}
+
+	for _, opts := range []Options{{JournalMode: "bogus"}, {Synchronous: "sometimes"}} {
+		if _, err := SQLite(ctx, filepath.Join(t.TempDir(), "golink.db"), schema, opts); err == nil {
+			t.Errorf("SQLite() with %+v succeeded, want an error", opts)
+		}
+	}
+}
+
+func TestUnescapeMigration(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "golink.db")
+	db, err := SQLite(ctx, path, schema, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Links as the forms stored them before version 9.
+	if _, err := db.ExecContext(ctx, `pragma user_version = 8;
+		insert into links (name, url, allowed_group) values
+			('a&amp;b', 'http://example.com/?a=1&amp;b=2', 'r&amp;d'),
+			('c&amp;d', 'http://example.com/escaped', ''),
+			('c&d', 'http://example.com/raw', ''),
+			('&#39;&lt;&amp;lt;&gt;&#34;', 'http://example.com', '');`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if db, err = SQLite(ctx, path, schema, Options{}); err != nil {
+		t.Fatalf("SQLite() failed to migrate: %v", err)
+	}
+	defer db.Close()
+	rows, err := db.QueryContext(ctx, "select name, url, allowed_group from links order by id;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got [][3]string
+	for rows.Next() {
+		var r [3]string
+		if err := rows.Scan(&r[0], &r[1], &r[2]); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, r)
+	}
+	want := [][3]string{
+		{"a&b", "http://example.com/?a=1&b=2", "r&d"},
+		// The unescaped name is taken.
+		{"c&amp;d", "http://example.com/escaped", ""},
+		{"c&d", "http://example.com/raw", ""},
+		{`'<&lt;>"`, "http://example.com", ""},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Links after the migration = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,193 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// baseSchemaVersion is the version of a database that was created from the
+// schema file alone. The schema file only ever creates the base tables; any
+// later change to them is a migration below, so that existing databases get
+// the same tables as new ones.
+const baseSchemaVersion = 1
+
+// migrations upgrade the database one version at a time: migrations[i] takes
+// it from version baseSchemaVersion+i to baseSchemaVersion+i+1.
+var migrations = []string{
+	// 2: record who created each link so that it can be counted per user.
+	`alter table links add column created_by text not null default '';
+	create index links_created_by on links (created_by);`,
+	// 3: let links be hidden from the index or only resolve for some users.
+	`alter table links add column visibility text not null default 'public';
+	alter table links add column allowed_group text not null default '';`,
+	// 4: let links start and stop working at set times, in unix seconds, and
+	// keep expired links out of the way in an archive.
+	`alter table links add column not_before integer;
+	alter table links add column expires_at integer;
+	create index links_expires_at on links (expires_at);
+	create table archived_links (
+		id integer primary key,
+		name text not null,
+		url text not null,
+		created_by text not null,
+		visibility text not null,
+		allowed_group text not null,
+		not_before integer,
+		expires_at integer,
+		archived_at integer not null
+	);
+	create index archived_links_name on archived_links (name);`,
+	// 5: keep deleted links in a trash from which they can be restored until
+	// they're purged.
+	`create table deleted_links (
+		id integer primary key,
+		name text not null,
+		url text not null,
+		created_by text not null,
+		visibility text not null,
+		allowed_group text not null,
+		not_before integer,
+		expires_at integer,
+		deleted_at integer not null,
+		deleted_by text not null
+	);
+	create index deleted_links_deleted_at on deleted_links (deleted_at);`,
+	// 6: describe and tag links, and record when and by whom they changed.
+	// The copies of links in the archive and the trash get the same columns.
+	`alter table links add column description text not null default '';
+	alter table links add column tags text not null default '[]';
+	alter table links add column created_at integer;
+	alter table links add column updated_at integer;
+	alter table links add column updated_by text not null default '';
+	alter table archived_links add column description text not null default '';
+	alter table archived_links add column tags text not null default '[]';
+	alter table archived_links add column created_at integer;
+	alter table archived_links add column updated_at integer;
+	alter table archived_links add column updated_by text not null default '';
+	alter table deleted_links add column description text not null default '';
+	alter table deleted_links add column tags text not null default '[]';
+	alter table deleted_links add column created_at integer;
+	alter table deleted_links add column updated_at integer;
+	alter table deleted_links add column updated_by text not null default '';`,
+	// 7: log every change to links, whichever process makes it, so that
+	// replicas can follow the changes of each other. Each link records the
+	// revision of its last change. Triggers fill the log, and the update of
+	// revision doesn't trigger a change itself because of the when clause.
+	`alter table links add column revision integer not null default 0;
+	create table changes (
+		revision integer primary key autoincrement,
+		name text not null,
+		op text not null,
+		created_by text not null,
+		visibility text not null,
+		allowed_group text not null,
+		changed_at integer not null
+	);
+	create index changes_changed_at on changes (changed_at);
+	create trigger links_insert_change after insert on links begin
+		insert into changes (name, op, created_by, visibility, allowed_group, changed_at)
+			values (new.name, 'create', new.created_by, new.visibility, new.allowed_group, strftime('%s', 'now'));
+		update links set revision = last_insert_rowid() where rowid = new.rowid;
+	end;
+	create trigger links_update_change after update on links when old.revision = new.revision begin
+		insert into changes (name, op, created_by, visibility, allowed_group, changed_at)
+			select old.name, 'delete', old.created_by, old.visibility, old.allowed_group, strftime('%s', 'now')
+			where old.name <> new.name;
+		insert into changes (name, op, created_by, visibility, allowed_group, changed_at)
+			values (new.name, 'update', new.created_by, new.visibility, new.allowed_group, strftime('%s', 'now'));
+		update links set revision = last_insert_rowid() where rowid = new.rowid;
+	end;
+	create trigger links_delete_change after delete on links begin
+		insert into changes (name, op, created_by, visibility, allowed_group, changed_at)
+			values (old.name, 'delete', old.created_by, old.visibility, old.allowed_group, strftime('%s', 'now'));
+	end;`,
+	// 8: let links choose the status code of their redirects and how long, in
+	// seconds, clients may cache them. 0 means the defaults.
+	`alter table links add column redirect_code integer not null default 0;
+	alter table links add column cache_max_age integer not null default 0;
+	alter table archived_links add column redirect_code integer not null default 0;
+	alter table archived_links add column cache_max_age integer not null default 0;
+	alter table deleted_links add column redirect_code integer not null default 0;
+	alter table deleted_links add column cache_max_age integer not null default 0;`,
+	// 9: store the names, addresses and groups that came from forms as they
+	// were typed, like those from the API, rather than escaped for html. A
+	// link whose unescaped name is taken keeps its escaped one.
+	unescapeHTML("links", "update or ignore") + unescapeHTML("archived_links", "update") + unescapeHTML("deleted_links", "update"),
+}
+
+// unescapeHTML returns a statement that reverses html.EscapeString on the
+// name, url and allowed_group columns of table, run with update, which is
+// "update" or a variant of it like "update or ignore".
+func unescapeHTML(table, update string) string {
+	unescape := func(column string) string {
+		// &amp; goes last so that "&amp;lt;" becomes "&lt;" rather than "<".
+		return "replace(replace(replace(replace(replace(" + column +
+			", '&lt;', '<'), '&gt;', '>'), '&#34;', '\"'), '&#39;', ''''), '&amp;', '&')"
+	}
+	return update + " " + table + " set name = " + unescape("name") + ", url = " + unescape("url") +
+		", allowed_group = " + unescape("allowed_group") +
+		" where name like '%&%' or url like '%&%' or allowed_group like '%&%';\n"
+}
+
+// SchemaVersion returns the schema version that this binary expects.
+func SchemaVersion() int {
+	return baseSchemaVersion + len(migrations)
+}
+
+// Version returns the schema version that db is at.
+func Version(ctx context.Context, db *sql.DB) (int, error) {
+	var v int
+	if err := db.QueryRowContext(ctx, "pragma user_version;").Scan(&v); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return v, nil
+}
+
+// migrate brings db up to SchemaVersion. The version is kept in SQLite's
+// user_version, which is 0 for databases that predate versioning.
+func migrate(ctx context.Context, db *sql.DB) error {
+	v, err := Version(ctx, db)
+	if err != nil {
+		return err
+	}
+	if v == 0 {
+		v = baseSchemaVersion
+	}
+	if v > SchemaVersion() {
+		return fmt.Errorf("database is at schema version %d, which is newer than the supported version %d", v, SchemaVersion())
+	}
+	for ; v < SchemaVersion(); v++ {
+		if err := migrateOne(ctx, db, migrations[v-baseSchemaVersion], v+1); err != nil {
+			return fmt.Errorf("failed to migrate to schema version %d: %w", v+1, err)
+		}
+	}
+	return setVersion(ctx, db, v)
+}
+
+func migrateOne(ctx context.Context, db *sql.DB, stmts string, version int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, stmts); err != nil {
+		return err
+	}
+	if err := setVersion(ctx, tx, version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func setVersion(ctx context.Context, e execer, version int) error {
+	// Pragmas don't accept placeholders.
+	if _, err := e.ExecContext(ctx, fmt.Sprintf("pragma user_version = %d;", version)); err != nil {
+		return fmt.Errorf("failed to set schema version: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+// Package dnsserver provides a small DNS server that resolves the short go
+// link host names, such as "go", to the address of the service. That lets a
+// team point a resolver or a split-DNS zone at it instead of editing
+// /etc/hosts on every machine.
+//
+// The server only speaks DNS over UDP. Queries for other names are forwarded
+// to an upstream resolver if one is configured and the client is allowed to
+// use it, and refused otherwise.
+package dnsserver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	headerLen = 12
+
+	typeA    = 1
+	typeAAAA = 28
+	classIN  = 1
+
+	rcodeSuccess  = 0
+	rcodeFormErr  = 1
+	rcodeServFail = 2
+	rcodeNotImp   = 4
+	rcodeRefused  = 5
+
+	// maxMessageLen is the largest UDP message the server reads or writes.
+	maxMessageLen = 4096
+
+	defaultTTL            = 5 * time.Minute
+	defaultForwardTimeout = 5 * time.Second
+	defaultMaxForwards    = 64
+)
+
+// errFormat means that a query couldn't be parsed.
+var errFormat = errors.New("malformed dns message")
+
+// Server answers A and AAAA queries for a set of names.
+type Server struct {
+	// Names are the host names to answer for, like "go" or "go.corp".
+	// Matching ignores case and a trailing dot.
+	Names []string
+	// Addrs are the answers. IPv4 addresses answer A queries and IPv6
+	// addresses answer AAAA queries.
+	Addrs []netip.Addr
+	// TTL is the time to live of answers. Defaults to 5 minutes.
+	TTL time.Duration
+	// Upstream is the host:port of a resolver that queries for other names
+	// are forwarded to. If it's empty those queries are refused.
+	Upstream string
+	// ForwardTimeout bounds how long to wait for Upstream. Defaults to 5
+	// seconds.
+	ForwardTimeout time.Duration
+	// ForwardFrom are the networks of the clients whose queries for other
+	// names are forwarded to Upstream. Other clients get those queries
+	// refused, so that the server isn't an open resolver. Defaults to
+	// loopback and private addresses.
+	ForwardFrom []netip.Prefix
+	// MaxForwards bounds how many queries are forwarded at a time. Queries
+	// over the limit are dropped, and clients retry them. Defaults to 64.
+	MaxForwards int
+}
+
+// ListenAndServe listens on the UDP address addr and calls Serve.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for dns on %q: %w", addr, err)
+	}
+	return s.Serve(ctx, conn)
+}
+
+// Serve answers queries that arrive on conn until ctx is done, then closes
+// conn.
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	log.Printf("DNS server listening on %s for %q", conn.LocalAddr(), s.Names)
+	names := make(map[string]bool, len(s.Names))
+	for _, n := range s.Names {
+		names[normalize(n)] = true
+	}
+	maxForwards := s.MaxForwards
+	if maxForwards == 0 {
+		maxForwards = defaultMaxForwards
+	}
+	forwarding := make(chan struct{}, maxForwards)
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	for {
+		buf := make([]byte, maxMessageLen)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return fmt.Errorf("failed to read dns query: %w", err)
+		}
+		query := buf[:n]
+		resp, forward := s.answer(query, names, s.mayForward(addr))
+		if forward {
+			select {
+			case forwarding <- struct{}{}:
+				go func() {
+					defer func() { <-forwarding }()
+					s.forward(ctx, conn, addr, query)
+				}()
+			default:
+				// Too many queries are already waiting for Upstream.
+			}
+			continue
+		}
+		if resp == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(resp, addr); err != nil {
+			log.Printf("Failed to write dns response to %v: %v", addr, err)
+		}
+	}
+}
+
+// answer builds the response to query. It returns forward=true if the query
+// should go to the upstream resolver instead, which it only does if
+// mayForward is set, and a nil response if the query should be dropped.
+func (s *Server) answer(query []byte, names map[string]bool, mayForward bool) (resp []byte, forward bool) {
+	if len(query) < headerLen {
+		return nil, false
+	}
+	flags := binary.BigEndian.Uint16(query[2:4])
+	if flags&0x8000 != 0 {
+		// Not a query.
+		return nil, false
+	}
+	if opcode := (flags >> 11) & 0xf; opcode != 0 {
+		return reply(query, nil, rcodeNotImp, false, nil), false
+	}
+	if qdcount := binary.BigEndian.Uint16(query[4:6]); qdcount != 1 {
+		return reply(query, nil, rcodeFormErr, false, nil), false
+	}
+	name, qtype, qclass, end, err := parseQuestion(query)
+	if err != nil {
+		return reply(query, nil, rcodeFormErr, false, nil), false
+	}
+	question := query[headerLen:end]
+	if !names[name] {
+		if s.Upstream != "" && mayForward {
+			return nil, true
+		}
+		return reply(query, question, rcodeRefused, false, nil), false
+	}
+	var answers [][]byte
+	if qclass == classIN {
+		for _, a := range s.Addrs {
+			switch {
+			case qtype == typeA && a.Is4():
+				answers = append(answers, s.record(typeA, a.AsSlice()))
+			case qtype == typeAAAA && a.Is6() && !a.Is4In6():
+				answers = append(answers, s.record(typeAAAA, a.AsSlice()))
+			}
+		}
+	}
+	// A name we own with no records of the requested type gets an empty
+	// successful answer, which tells the client that the name exists.
+	return reply(query, question, rcodeSuccess, true, answers), false
+}
+
+// record encodes a resource record for the name in the question.
+func (s *Server) record(typ uint16, data []byte) []byte {
+	ttl := s.TTL
+	if ttl == 0 {
+		ttl = defaultTTL
+	}
+	b := make([]byte, 0, 12+len(data))
+	// A pointer to the name in the question, which always starts right after
+	// the header.
+	b = binary.BigEndian.AppendUint16(b, 0xc000|headerLen)
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, classIN)
+	b = binary.BigEndian.AppendUint32(b, uint32(ttl.Seconds()))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+// mayForward reports whether queries from addr may be forwarded to Upstream.
+func (s *Server) mayForward(addr net.Addr) bool {
+	udp, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	ip := udp.AddrPort().Addr().Unmap()
+	if len(s.ForwardFrom) == 0 {
+		return ip.IsLoopback() || ip.IsPrivate()
+	}
+	for _, p := range s.ForwardFrom {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forward relays query to the upstream resolver and its response back to
+// addr.
+func (s *Server) forward(ctx context.Context, conn net.PacketConn, addr net.Addr, query []byte) {
+	timeout := s.ForwardTimeout
+	if timeout == 0 {
+		timeout = defaultForwardTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	resp, err := exchange(ctx, s.Upstream, query)
+	if err != nil {
+		log.Printf("Failed to forward dns query to %q: %v", s.Upstream, err)
+		resp = reply(query, nil, rcodeServFail, false, nil)
+	}
+	if _, err := conn.WriteTo(resp, addr); err != nil {
+		log.Printf("Failed to write dns response to %v: %v", addr, err)
+	}
+}
+
+func exchange(ctx context.Context, upstream string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp", upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageLen)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray responses to other queries.
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// parseQuestion parses the first question in msg. It returns the normalized
+// name and the offset of the end of the question.
+func parseQuestion(msg []byte) (name string, qtype, qclass uint16, end int, err error) {
+	var labels []string
+	off := headerLen
+	for {
+		if off >= len(msg) {
+			return "", 0, 0, 0, errFormat
+		}
+		l := int(msg[off])
+		off++
+		if l == 0 {
+			break
+		}
+		// Compression pointers and extended label types don't belong in a
+		// question.
+		if l&0xc0 != 0 || off+l > len(msg) {
+			return "", 0, 0, 0, errFormat
+		}
+		labels = append(labels, string(msg[off:off+l]))
+		off += l
+	}
+	if off+4 > len(msg) {
+		return "", 0, 0, 0, errFormat
+	}
+	qtype = binary.BigEndian.Uint16(msg[off : off+2])
+	qclass = binary.BigEndian.Uint16(msg[off+2 : off+4])
+	return normalize(strings.Join(labels, ".")), qtype, qclass, off + 4, nil
+}
+
+// reply builds a response to query with the given question section, rcode and
+// answers.
+func reply(query, question []byte, rcode uint16, authoritative bool, answers [][]byte) []byte {
+	b := make([]byte, headerLen, maxMessageLen)
+	copy(b[0:2], query[0:2])
+	flags := binary.BigEndian.Uint16(query[2:4])
+	// Keep the opcode and the recursion desired bit of the query.
+	flags = 0x8000 | flags&0x7900 | rcode
+	if authoritative {
+		flags |= 0x0400
+	}
+	binary.BigEndian.PutUint16(b[2:4], flags)
+	if question != nil {
+		binary.BigEndian.PutUint16(b[4:6], 1)
+	}
+	binary.BigEndian.PutUint16(b[6:8], uint16(len(answers)))
+	b = append(b, question...)
+	for _, a := range answers {
+		b = append(b, a...)
+	}
+	return b
+}
+
+func normalize(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
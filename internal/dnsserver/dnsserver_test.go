@@ -0,0 +1,236 @@
+package dnsserver
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve starts s on a loopback port and returns its address.
+func serve(ctx context.Context, t *testing.T, s *Server) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() failed: %v", err)
+	}
+	go func() {
+		if err := s.Serve(ctx, conn); err != nil {
+			t.Errorf("Serve() failed: %v", err)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// resolver returns a *net.Resolver that sends every query to addr.
+func resolver(addr string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", addr)
+		},
+	}
+}
+
+func TestLookup(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	addr := serve(ctx, t, &Server{
+		Names: []string{"go", "go.corp."},
+		Addrs: []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("2001:db8::1")},
+	})
+	r := resolver(addr)
+	type testCase struct {
+		name    string
+		host    string
+		network string
+		want    []string
+	}
+	testCases := []testCase{
+		{
+			name:    "both families",
+			host:    "go.",
+			network: "ip",
+			want:    []string{"10.0.0.1", "2001:db8::1"},
+		},
+		{
+			name:    "A only",
+			host:    "go.",
+			network: "ip4",
+			want:    []string{"10.0.0.1"},
+		},
+		{
+			name:    "AAAA only",
+			host:    "go.",
+			network: "ip6",
+			want:    []string{"2001:db8::1"},
+		},
+		{
+			name:    "search domain variant ignores case",
+			host:    "GO.Corp.",
+			network: "ip4",
+			want:    []string{"10.0.0.1"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addrs, err := r.LookupNetIP(ctx, tc.network, tc.host)
+			if err != nil {
+				t.Fatalf("LookupNetIP(%q, %q) failed: %v", tc.network, tc.host, err)
+			}
+			var got []string
+			for _, a := range addrs {
+				got = append(got, a.String())
+			}
+			sort.Strings(got)
+			if len(got) != len(tc.want) {
+				t.Fatalf("LookupNetIP(%q, %q) returned %v, want %v", tc.network, tc.host, got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("LookupNetIP(%q, %q) returned %v, want %v", tc.network, tc.host, got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRefuse(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	addr := serve(ctx, t, &Server{
+		Names: []string{"go"},
+		Addrs: []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+	})
+	if addrs, err := resolver(addr).LookupNetIP(ctx, "ip4", "example.com."); err == nil {
+		t.Errorf("LookupNetIP(%q) returned %v, want an error", "example.com.", addrs)
+	}
+}
+
+func TestForward(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	upstream := serve(ctx, t, &Server{
+		Names: []string{"wiki.corp"},
+		Addrs: []netip.Addr{netip.MustParseAddr("10.0.0.2")},
+	})
+	addr := serve(ctx, t, &Server{
+		Names:    []string{"go"},
+		Addrs:    []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+		Upstream: upstream,
+	})
+	addrs, err := resolver(addr).LookupNetIP(ctx, "ip4", "wiki.corp.")
+	if err != nil {
+		t.Fatalf("LookupNetIP(%q) failed: %v", "wiki.corp.", err)
+	}
+	if len(addrs) != 1 || addrs[0].String() != "10.0.0.2" {
+		t.Errorf("LookupNetIP(%q) returned %v, want [10.0.0.2]", "wiki.corp.", addrs)
+	}
+}
+
+func TestForwardFrom(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	upstream := serve(ctx, t, &Server{
+		Names: []string{"wiki.corp"},
+		Addrs: []netip.Addr{netip.MustParseAddr("10.0.0.2")},
+	})
+	addr := serve(ctx, t, &Server{
+		Names:       []string{"go"},
+		Addrs:       []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+		Upstream:    upstream,
+		ForwardFrom: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	if addrs, err := resolver(addr).LookupNetIP(ctx, "ip4", "wiki.corp."); err == nil {
+		t.Errorf("LookupNetIP(%q) from outside -dns_forward_from returned %v, want an error", "wiki.corp.", addrs)
+	}
+}
+
+// question returns a query for the A records of name with the given id.
+func question(id uint16, name string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	b = append(b, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0)
+	for _, l := range strings.Split(name, ".") {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, typeA)
+	return binary.BigEndian.AppendUint16(b, classIN)
+}
+
+func TestMaxForwards(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	// The upstream never answers, so each forward holds its slot until it
+	// times out.
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() failed: %v", err)
+	}
+	defer upstream.Close()
+	received := make(chan uint16, 10)
+	go func() {
+		buf := make([]byte, maxMessageLen)
+		for {
+			n, _, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n >= 2 {
+				received <- binary.BigEndian.Uint16(buf)
+			}
+		}
+	}()
+	addr := serve(ctx, t, &Server{
+		Names:          []string{"go"},
+		Addrs:          []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+		Upstream:       upstream.LocalAddr().String(),
+		ForwardTimeout: time.Second,
+		MaxForwards:    1,
+	})
+	client, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Dial(%q) failed: %v", addr, err)
+	}
+	defer client.Close()
+	send := func(id uint16) {
+		t.Helper()
+		if _, err := client.Write(question(id, "wiki.corp")); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+	}
+	expect := func(want uint16) {
+		t.Helper()
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("Upstream received query %d, want %d", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Upstream didn't receive query %d", want)
+		}
+	}
+
+	send(1)
+	expect(1)
+	send(2)
+	select {
+	case got := <-received:
+		t.Fatalf("Upstream received query %d while query 1 was in flight, want it dropped", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+	// Query 1 times out and frees its slot.
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, maxMessageLen)
+	if n, err := client.Read(buf); err != nil || n < headerLen || binary.BigEndian.Uint16(buf) != 1 {
+		t.Fatalf("Read() returned %x, %v, want the response to query 1", buf[:n], err)
+	}
+	send(3)
+	expect(3)
+}
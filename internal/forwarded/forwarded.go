@@ -0,0 +1,204 @@
+// Package forwarded works out the real client address and protocol of a
+// request that may have passed through proxies. The Forwarded and
+// X-Forwarded-* headers are only believed when they were added by a trusted
+// proxy, since any client can send them.
+package forwarded
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Origin describes where a request came from.
+type Origin struct {
+	// ClientIP is the address of the client. It's the zero netip.Addr if it
+	// can't be determined.
+	ClientIP netip.Addr
+	// Proto is the protocol that the client used, "http" or "https".
+	Proto string
+	// Trusted reports whether the peer that connected to the service is a
+	// trusted proxy, whose other headers, like identity headers, can be
+	// believed too.
+	Trusted bool
+}
+
+// Resolver determines the Origin of requests.
+type Resolver struct {
+	trusted []netip.Prefix
+}
+
+// NewResolver creates a *Resolver that trusts proxies in the given networks.
+func NewResolver(trusted []netip.Prefix) *Resolver {
+	return &Resolver{trusted}
+}
+
+// ParsePrefixes parses CIDRs like 10.0.0.0/8. A single address is taken to
+// be a network of its own.
+func ParsePrefixes(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		if strings.Contains(s, "/") {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q: %w", s, err)
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", s, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(a, a.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// hop is one entry in the chain of proxies that a request went through. addr
+// is invalid if the proxy hid or didn't know the address.
+type hop struct {
+	addr  netip.Addr
+	proto string
+}
+
+// Resolve returns the origin of req. Starting at the peer that connected to
+// the service, it follows the forwarding headers towards the client for as
+// long as the hops are trusted proxies.
+func (r *Resolver) Resolve(req *http.Request) Origin {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	peer := remoteAddr(req.RemoteAddr)
+	o := Origin{ClientIP: peer, Proto: proto}
+	if !r.isTrusted(peer) {
+		return o
+	}
+	o.Trusted = true
+	hops := forwardedHops(req.Header)
+	if hops == nil {
+		hops = xForwardedHops(req.Header)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		h := hops[i]
+		if h.proto != "" {
+			o.Proto = h.proto
+		}
+		if !h.addr.IsValid() {
+			// The client is behind a proxy that hides it, so the last
+			// trusted hop is as close as we can get.
+			return o
+		}
+		o.ClientIP = h.addr
+		if !r.isTrusted(h.addr) {
+			return o
+		}
+	}
+	return o
+}
+
+func (r *Resolver) isTrusted(a netip.Addr) bool {
+	if !a.IsValid() {
+		return false
+	}
+	a = a.Unmap()
+	for _, p := range r.trusted {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHops parses the standard Forwarded header of RFC 7239. It returns
+// nil if there isn't one.
+func forwardedHops(h http.Header) []hop {
+	values := h.Values("Forwarded")
+	if len(values) == 0 {
+		return nil
+	}
+	var hops []hop
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			var hp hop
+			for _, pair := range strings.Split(elem, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				v = strings.Trim(v, `"`)
+				switch strings.ToLower(k) {
+				case "for":
+					hp.addr = nodeAddr(v)
+				case "proto":
+					hp.proto = normalizeProto(v)
+				}
+			}
+			hops = append(hops, hp)
+		}
+	}
+	return hops
+}
+
+// xForwardedHops parses X-Forwarded-For and X-Forwarded-Proto. A proto is
+// attached to the hop in the same position, or to the last hop if the lists
+// don't line up.
+func xForwardedHops(h http.Header) []hop {
+	var hops []hop
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, s := range strings.Split(v, ",") {
+			hops = append(hops, hop{addr: nodeAddr(strings.TrimSpace(s))})
+		}
+	}
+	var protos []string
+	for _, v := range h.Values("X-Forwarded-Proto") {
+		for _, s := range strings.Split(v, ",") {
+			protos = append(protos, normalizeProto(strings.TrimSpace(s)))
+		}
+	}
+	switch {
+	case len(protos) == 0:
+	case len(protos) == len(hops):
+		for i := range hops {
+			hops[i].proto = protos[i]
+		}
+	case len(hops) == 0:
+		// A proxy that only reports the protocol.
+		hops = []hop{{proto: protos[len(protos)-1]}}
+	default:
+		hops[len(hops)-1].proto = protos[len(protos)-1]
+	}
+	return hops
+}
+
+// nodeAddr parses addresses like 192.0.2.1, 192.0.2.1:80, 2001:db8::1 and
+// [2001:db8::1]:80. It returns the zero netip.Addr for anything else, like
+// "unknown" or an obfuscated identifier.
+func nodeAddr(s string) netip.Addr {
+	if a, err := netip.ParseAddr(strings.Trim(s, "[]")); err == nil {
+		return a.Unmap()
+	}
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap()
+	}
+	return netip.Addr{}
+}
+
+func remoteAddr(s string) netip.Addr {
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		host = s
+	}
+	return nodeAddr(host)
+}
+
+func normalizeProto(s string) string {
+	switch p := strings.ToLower(s); p {
+	case "http", "https":
+		return p
+	}
+	return ""
+}
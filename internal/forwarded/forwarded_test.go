@@ -0,0 +1,119 @@
+package forwarded
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	trusted, err := ParsePrefixes([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewResolver(trusted)
+	type testCase struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		header     http.Header
+		wantIP     string
+		wantProto  string
+		// wantTrusted is whether the peer is a trusted proxy.
+		wantTrusted bool
+	}
+	testCases := []testCase{
+		{
+			name:       "direct",
+			remoteAddr: "192.0.2.1:1234",
+			wantIP:     "192.0.2.1",
+			wantProto:  "http",
+		},
+		{
+			name:       "direct tls",
+			remoteAddr: "192.0.2.1:1234",
+			tls:        true,
+			wantIP:     "192.0.2.1",
+			wantProto:  "https",
+		},
+		{
+			name:       "untrusted peer spoofing headers",
+			remoteAddr: "192.0.2.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.7"}, "X-Forwarded-Proto": {"https"}},
+			wantIP:     "192.0.2.1",
+			wantProto:  "http",
+		},
+		{
+			name:        "trusted proxy",
+			remoteAddr:  "10.1.2.3:1234",
+			wantTrusted: true,
+			header:      http.Header{"X-Forwarded-For": {"198.51.100.7"}, "X-Forwarded-Proto": {"https"}},
+			wantIP:      "198.51.100.7",
+			wantProto:   "https",
+		},
+		{
+			name:        "client spoofing through a trusted proxy",
+			remoteAddr:  "10.1.2.3:1234",
+			wantTrusted: true,
+			header:      http.Header{"X-Forwarded-For": {"203.0.113.9, 198.51.100.7"}},
+			wantIP:      "198.51.100.7",
+			wantProto:   "http",
+		},
+		{
+			name:        "chain of trusted proxies",
+			remoteAddr:  "[2001:db8::1]:1234",
+			wantTrusted: true,
+			header:      http.Header{"X-Forwarded-For": {"198.51.100.7", "10.9.9.9"}},
+			wantIP:      "198.51.100.7",
+			wantProto:   "http",
+		},
+		{
+			name:        "forwarded header",
+			remoteAddr:  "10.1.2.3:1234",
+			wantTrusted: true,
+			header:      http.Header{"Forwarded": {`for="[2001:db8:cafe::17]:4711";proto=https, for=10.9.9.9;proto=http`}},
+			wantIP:      "2001:db8:cafe::17",
+			wantProto:   "https",
+		},
+		{
+			name:        "forwarded header takes precedence",
+			remoteAddr:  "10.1.2.3:1234",
+			wantTrusted: true,
+			header: http.Header{
+				"Forwarded":       {"for=198.51.100.7;proto=https"},
+				"X-Forwarded-For": {"203.0.113.9"},
+			},
+			wantIP:    "198.51.100.7",
+			wantProto: "https",
+		},
+		{
+			name:        "hidden client",
+			remoteAddr:  "10.1.2.3:1234",
+			wantTrusted: true,
+			header:      http.Header{"Forwarded": {"for=unknown;proto=https"}},
+			wantIP:      "10.1.2.3",
+			wantProto:   "https",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &http.Request{RemoteAddr: tc.remoteAddr, Header: tc.header}
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+			if tc.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			o := r.Resolve(req)
+			if got := o.ClientIP.String(); got != tc.wantIP {
+				t.Errorf("Resolve() returned ClientIP=%v, want %v", got, tc.wantIP)
+			}
+			if got := o.Proto; got != tc.wantProto {
+				t.Errorf("Resolve() returned Proto=%q, want %q", got, tc.wantProto)
+			}
+			if got := o.Trusted; got != tc.wantTrusted {
+				t.Errorf("Resolve() returned Trusted=%v, want %v", got, tc.wantTrusted)
+			}
+		})
+	}
+}
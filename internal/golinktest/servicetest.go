@@ -19,11 +19,11 @@ import (
 var schema string
 
 // NewDatabase creates a database.
-func NewDatabase(ctx context.Context, t *testing.T) *sql.DB {
+func NewDatabase(ctx context.Context, t testing.TB) *sql.DB {
 	t.Helper()
 	dbPath := path.Join(t.TempDir(), "db.sql")
 	log.Printf("Using db path %q", dbPath)
-	db, err := datastore.SQLite(ctx, dbPath, schema)
+	db, err := datastore.SQLite(ctx, dbPath, schema, datastore.Options{})
 	if err != nil {
 		t.Fatalf("SQLite(%q) failed: %v", dbPath, err)
 	}
@@ -0,0 +1,117 @@
+package link
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Op is the kind of a change to a link.
+type Op string
+
+const (
+	// OpCreate means that a link was created or restored.
+	OpCreate Op = "create"
+	// OpUpdate means that a link was updated. A link that's renamed gets an
+	// OpDelete for its old name and an OpUpdate for its new one.
+	OpUpdate Op = "update"
+	// OpDelete means that a link was deleted, archived or renamed away.
+	OpDelete Op = "delete"
+)
+
+// Change is an entry in the log of changes to links. The database logs every
+// change, whichever process makes it.
+type Change struct {
+	// Revision orders the changes. It increases with every change.
+	Revision int64
+	// Name is the name of the link that changed.
+	Name string
+	// Op is what happened to the link.
+	Op Op
+	// ChangedAt is when the change happened, to the second.
+	ChangedAt time.Time
+	// CreatedBy, Visibility and Group are those of the link after the
+	// change, or before it for an OpDelete, so that changes to private links
+	// can be kept from other users.
+	CreatedBy  string
+	Visibility Visibility
+	Group      string
+}
+
+// VisibleTo reports whether user, who belongs to groups, can see c. See
+// Record.VisibleTo.
+func (c *Change) VisibleTo(user string, groups []string) bool {
+	r := Record{CreatedBy: c.CreatedBy, Visibility: c.Visibility, Group: c.Group}
+	return r.VisibleTo(user, groups)
+}
+
+// ErrChangesPruned means that some of the changes that were asked for have
+// been pruned from the log, so the caller has to start over from the current
+// state of the links.
+var ErrChangesPruned = errors.New("changes have been pruned")
+
+// LatestRevision returns the revision of the latest change, or 0 if there
+// hasn't been one.
+func LatestRevision(ctx context.Context, db *sql.DB) (int64, error) {
+	var revision int64
+	if err := db.QueryRowContext(ctx, "select coalesce(max(revision), 0) from changes;").Scan(&revision); err != nil {
+		return 0, fmt.Errorf("failed to read the latest revision: %w", err)
+	}
+	return revision, nil
+}
+
+// Changes returns up to limit changes after revision since, oldest first. It
+// returns ErrChangesPruned if changes after since are no longer in the log.
+func Changes(ctx context.Context, db *sql.DB, since int64, limit int) ([]*Change, error) {
+	// One statement reads a consistent snapshot without an explicit
+	// transaction, which would take the write lock with _txlock=immediate.
+	// The oldest revision comes along with each row: if changes after since
+	// were pruned, the oldest change is after since, so there is a row.
+	const query = "select revision, name, op, changed_at, created_by, visibility, allowed_group, " +
+		"(select min(revision) from changes) from changes where revision > ? order by revision limit ?;"
+	rows, err := db.QueryContext(ctx, query, since, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read changes: %w", err)
+	}
+	defer rows.Close()
+	changes := []*Change{}
+	for rows.Next() {
+		var c Change
+		var op, visibility string
+		var changedAt, oldest int64
+		if err := rows.Scan(&c.Revision, &c.Name, &op, &changedAt, &c.CreatedBy, &visibility, &c.Group, &oldest); err != nil {
+			return nil, fmt.Errorf("failed to read changes: %w", err)
+		}
+		// PruneChanges always keeps the latest change, so a gap between
+		// since and the oldest change means that changes in between were
+		// pruned.
+		if since < oldest-1 {
+			return nil, ErrChangesPruned
+		}
+		c.Op = Op(op)
+		c.ChangedAt = time.Unix(changedAt, 0).UTC()
+		c.Visibility = Visibility(visibility)
+		changes = append(changes, &c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read changes: %w", err)
+	}
+	return changes, nil
+}
+
+// PruneChanges removes changes made before before from the log, except for
+// the latest change. It returns how many it removed.
+func PruneChanges(ctx context.Context, db *sql.DB, before time.Time) (int, error) {
+	const query = "delete from changes where changed_at < ? and revision < (select max(revision) from changes);"
+	res, err := db.ExecContext(ctx, query, before.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune changes: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
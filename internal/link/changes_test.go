@@ -0,0 +1,86 @@
+package link
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spwg/golink/internal/golinktest"
+)
+
+func TestChanges(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	if got, err := LatestRevision(ctx, db); err != nil || got != 0 {
+		t.Fatalf("LatestRevision() of a new database = %v, %v, want 0, nil", got, err)
+	}
+	if err := Create(ctx, db, "foo", "http://example.com", CreatedBy("alice"), WithVisibility(Private, "")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Read(ctx, db, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Revision != 1 {
+		t.Errorf("Revision of a new link = %v, want 1", r.Revision)
+	}
+	if err := Update(ctx, db, "foo", "bar", "http://example.com/2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Delete(ctx, db, "bar", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := Changes(ctx, db, 0, 100)
+	if err != nil {
+		t.Fatalf("Changes() failed: %v", err)
+	}
+	type change struct {
+		name string
+		op   Op
+	}
+	want := []change{{"foo", OpCreate}, {"foo", OpDelete}, {"bar", OpUpdate}, {"bar", OpDelete}}
+	if len(changes) != len(want) {
+		t.Fatalf("Changes() returned %d changes, want %d", len(changes), len(want))
+	}
+	for i, c := range changes {
+		if got := (change{c.Name, c.Op}); got != want[i] || c.Revision != int64(i+1) {
+			t.Errorf("Changes()[%d] = %v at revision %v, want %v at revision %v", i, got, c.Revision, want[i], i+1)
+		}
+		if c.VisibleTo("", nil) || !c.VisibleTo("alice", nil) {
+			t.Errorf("Changes()[%d] of a private link is visible to the wrong users", i)
+		}
+	}
+	if got, err := LatestRevision(ctx, db); err != nil || got != 4 {
+		t.Errorf("LatestRevision() = %v, %v, want 4, nil", got, err)
+	}
+	if changes, err := Changes(ctx, db, 2, 1); err != nil || len(changes) != 1 || changes[0].Revision != 3 {
+		t.Errorf("Changes(since=2, limit=1) = %v, %v, want revision 3", changes, err)
+	}
+
+	// Reading changes doesn't wait for a writer.
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readCtx, cancel := context.WithTimeout(ctx, time.Second)
+	if changes, err := Changes(readCtx, db, 3, 100); err != nil || len(changes) != 1 {
+		t.Errorf("Changes() during a write transaction = %v, %v, want the latest change", changes, err)
+	}
+	cancel()
+	tx.Rollback()
+
+	n, err := PruneChanges(ctx, db, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("PruneChanges() failed: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("PruneChanges() removed %d changes, want 3 since the latest is kept", n)
+	}
+	if _, err := Changes(ctx, db, 1, 100); err != ErrChangesPruned {
+		t.Errorf("Changes() after pruning returned err=%v, want %v", err, ErrChangesPruned)
+	}
+	if changes, err := Changes(ctx, db, 3, 100); err != nil || len(changes) != 1 {
+		t.Errorf("Changes() since the last pruned revision = %v, %v, want the latest change", changes, err)
+	}
+}
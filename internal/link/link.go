@@ -4,21 +4,29 @@ package link
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
+	"strings"
+	"time"
 	"unicode"
+
+	"github.com/mattn/go-sqlite3"
 )
 
 var (
 	// ErrAlreadyExists means that a link name already exists in the database.
 	ErrAlreadyExists = errors.New("already exists")
 	// ErrInvalidLinkName means that a link name is not valid.
-	ErrInvalidLinkName = errors.New(`invalid name: must not be "" or contain only whitespace characters`)
+	ErrInvalidLinkName = errors.New(`invalid name: must not be "" or contain whitespace, control characters, '/', '?' or '#'`)
 	// ErrNotFound means that the name was not found.
 	ErrNotFound = errors.New("not found")
 	// ErrInvalidAddress means that the address was not a parseable URL.
 	ErrUnparseableAddress = errors.New("unparsable")
+	// ErrConflict means that a link was changed since the revision that an
+	// update or a delete expected. See IfRevision.
+	ErrConflict = errors.New("changed since it was read")
 )
 
 // Record is an entry in the database for a name and an address to redirect to.
@@ -27,29 +35,151 @@ type Record struct {
 	Name string
 	// Link is the address to redirect to.
 	Link *url.URL
+	// CreatedBy is the user who created the link, or "" if it's not known.
+	CreatedBy string
+	// Visibility is who can see the link.
+	Visibility Visibility
+	// Group is the group whose members can resolve a Private link.
+	Group string
+	// NotBefore is when the link starts to resolve. The zero time means it
+	// always has.
+	NotBefore time.Time
+	// ExpiresAt is when the link stops resolving and gets archived. The zero
+	// time means never.
+	ExpiresAt time.Time
+	// Description says what the link is for.
+	Description string
+	// Tags group related links, like "oncall". See NormalizeTags.
+	Tags []string
+	// CreatedAt is when the link was created. It's the zero time for links
+	// that predate it being recorded.
+	CreatedAt time.Time
+	// UpdatedAt is when the link was last created or updated.
+	UpdatedAt time.Time
+	// UpdatedBy is the user who last updated the link, or "" if it's not
+	// known.
+	UpdatedBy string
+	// RedirectCode is the status code of redirects to the link, or 0 for
+	// DefaultRedirectCode. See RedirectStatus.
+	RedirectCode int
+	// CacheMaxAge is how long clients may cache redirects to the link. Zero
+	// means they may not.
+	CacheMaxAge time.Duration
+	// Revision is the revision of the last change to the link in the log of
+	// changes. It's 0 for links that haven't changed since before the log.
+	// Only Read and List set it.
+	Revision int64
+
+	// ifRevision, if checkRevision is set, is the revision that an update or
+	// a delete expects the link to be at.
+	ifRevision    int64
+	checkRevision bool
+}
+
+// An Option sets an optional field of a record that's being created or
+// updated.
+type Option func(*Record)
+
+// CreatedBy records user as the creator of a new link.
+func CreatedBy(user string) Option {
+	return func(r *Record) {
+		r.CreatedBy = user
+	}
+}
+
+// IfRevision makes an update or a delete fail with ErrConflict unless the link
+// is still at revision, as it was when the user read it, so that users don't
+// overwrite each other's changes without seeing them.
+func IfRevision(revision int64) Option {
+	return func(r *Record) {
+		r.ifRevision = revision
+		r.checkRevision = true
+	}
+}
+
+// conflicts reports whether r isn't at the revision that an IfRevision option
+// applied to it expects.
+func (r *Record) conflicts() bool {
+	return r.checkRevision && r.ifRevision != r.Revision
+}
+
+// ArgsPlaceholder is replaced by the arguments that follow a link name in a
+// search, like "golink" in "gh golink", when the link is resolved.
+const ArgsPlaceholder = "{args}"
+
+// Expand returns the address to redirect to when r is resolved with args. The
+// path and the fragment get args as is and the query gets it escaped. r.Link is
+// returned unchanged if it has no ArgsPlaceholder.
+func (r *Record) Expand(args string) *url.URL {
+	u := *r.Link
+	if strings.Contains(u.Path, ArgsPlaceholder) {
+		u.Path = strings.ReplaceAll(u.Path, ArgsPlaceholder, args)
+		u.RawPath = ""
+	}
+	if strings.Contains(u.RawQuery, ArgsPlaceholder) {
+		u.RawQuery = strings.ReplaceAll(u.RawQuery, ArgsPlaceholder, url.QueryEscape(args))
+	}
+	if strings.Contains(u.Fragment, ArgsPlaceholder) {
+		u.Fragment = strings.ReplaceAll(u.Fragment, ArgsPlaceholder, args)
+		u.RawFragment = ""
+	}
+	return &u
+}
+
+// validate checks the fields that options can set.
+func (r *Record) validate() error {
+	if _, err := ParseVisibility(string(r.Visibility)); err != nil {
+		return err
+	}
+	if !r.NotBefore.IsZero() && !r.ExpiresAt.IsZero() && !r.ExpiresAt.After(r.NotBefore) {
+		return ErrInvalidSchedule
+	}
+	for _, t := range r.Tags {
+		if !validTag(t) {
+			return ErrInvalidTag
+		}
+	}
+	if !validRedirect(r.RedirectCode, r.CacheMaxAge) {
+		return ErrInvalidRedirect
+	}
+	return nil
 }
 
 // Create inserts a new record into the database for name and address.
-func Create(ctx context.Context, db *sql.DB, name, address string) error {
-	if !validLinkName(name) {
-		return ErrInvalidLinkName
+func Create(ctx context.Context, db *sql.DB, name, address string, opts ...Option) error {
+	name, err := ParseName(name)
+	if err != nil {
+		return err
 	}
 	u, err := url.Parse(address)
 	if err != nil {
 		return ErrUnparseableAddress
 	}
-	_, ok, err := linkByName(ctx, db, name)
-	if err != nil {
-		return err
+	now := time.Now().UTC().Truncate(time.Second)
+	r := &Record{Name: name, Link: u, Visibility: Public, CreatedAt: now, UpdatedAt: now}
+	for _, opt := range opts {
+		opt(r)
 	}
-	if ok {
-		return ErrAlreadyExists
+	if r.UpdatedBy == "" {
+		r.UpdatedBy = r.CreatedBy
 	}
-	query := "insert into links (name, url) values (?, ?);"
-	if _, err := db.ExecContext(ctx, query, name, u.String()); err != nil {
-		return fmt.Errorf("failed to create new record in the database: %w", err)
+	if err := r.validate(); err != nil {
+		return err
 	}
-	return nil
+	query := "insert into links (" + recordColumns + ") values (" + recordPlaceholders + ");"
+	values, err := r.values()
+	if err != nil {
+		return err
+	}
+	return inTx(ctx, db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, query, values...); err != nil {
+			if isUniqueViolation(err) {
+				return ErrAlreadyExists
+			}
+			return fmt.Errorf("failed to create new record in the database: %w", err)
+		}
+		return nil
+	})
 }
 
 // Read returns a *Record for the link with the given name.
@@ -66,81 +196,228 @@ func Read(ctx context.Context, db *sql.DB, name string) (*Record, error) {
 }
 
 // Update changes the record for oldName so that it's name is newName and the
-// url it redirects to is address.
-func Update(ctx context.Context, db *sql.DB, oldName, newName, address string) error {
-	if !validLinkName(newName) {
-		return fmt.Errorf("link name %v is invalid: %w", newName, ErrInvalidLinkName)
+// url it redirects to is address. opts change other fields, which are
+// otherwise kept. Returns ErrNotFound if there's no link called oldName,
+// ErrAlreadyExists if newName is taken by another link and ErrConflict if the
+// link isn't at the revision of an IfRevision option.
+func Update(ctx context.Context, db *sql.DB, oldName, newName, address string, opts ...Option) error {
+	name, err := ParseName(newName)
+	if err != nil {
+		return fmt.Errorf("link name %q is invalid: %w", newName, err)
 	}
-	if !validLinkName(oldName) {
-		return fmt.Errorf("link name %v is invalid: %w", oldName, ErrInvalidLinkName)
+	newName = name
+	// Links named before names were checked as strictly can still be renamed.
+	if oldName == "" {
+		return fmt.Errorf("link name %q is invalid: %w", oldName, ErrInvalidLinkName)
 	}
-	_, err := url.Parse(address)
+	u, err := url.Parse(address)
 	if err != nil {
 		return ErrUnparseableAddress
 	}
-	_, found, err := linkByName(ctx, db, oldName)
-	if err != nil {
-		return fmt.Errorf("failed to query the database for the old name: %w", err)
+	return inTx(ctx, db, func(tx *sql.Tx) error {
+		// Options apply to the link as it is in the transaction, so that a
+		// concurrent update of fields they don't set isn't undone.
+		r, found, err := linkByName(ctx, tx, oldName)
+		if err != nil {
+			return fmt.Errorf("failed to query the database for the old name: %w", err)
+		}
+		if !found {
+			return ErrNotFound
+		}
+		r.Name = newName
+		r.Link = u
+		r.UpdatedAt = time.Now().UTC().Truncate(time.Second)
+		r.UpdatedBy = ""
+		for _, opt := range opts {
+			opt(r)
+		}
+		if r.conflicts() {
+			return ErrConflict
+		}
+		if err := r.validate(); err != nil {
+			return err
+		}
+		tags, err := json.Marshal(r.Tags)
+		if err != nil {
+			return err
+		}
+		const query = "update links set name = ?, url = ?, visibility = ?, allowed_group = ?, not_before = ?, expires_at = ?, " +
+			"description = ?, tags = ?, updated_at = ?, updated_by = ?, redirect_code = ?, cache_max_age = ? where name = ?;"
+		res, err := tx.ExecContext(ctx, query, newName, r.Link.String(), r.Visibility, r.Group, unixOrNull(r.NotBefore), unixOrNull(r.ExpiresAt),
+			r.Description, string(tags), unixOrNull(r.UpdatedAt), r.UpdatedBy, r.RedirectCode, int64(r.CacheMaxAge/time.Second), oldName)
+		if err != nil {
+			if isUniqueViolation(err) {
+				return ErrAlreadyExists
+			}
+			return fmt.Errorf("failed to update database: %w", err)
+		}
+		return requireRows(res)
+	})
+}
+
+// CountCreatedBy returns the number of links that user created.
+func CountCreatedBy(ctx context.Context, db *sql.DB, user string) (int, error) {
+	const query = "select count(*) from links where created_by=?;"
+	var n int
+	if err := db.QueryRowContext(ctx, query, user).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count the links of %q: %w", user, err)
 	}
-	if !found {
-		return ErrNotFound
+	return n, nil
+}
+
+// List returns every link with tag, or every link if tag is "", ordered by
+// name. Callers decide which of them to show with Record.ListedFor.
+func List(ctx context.Context, db *sql.DB, tag string) ([]*Record, error) {
+	query := "select " + recordColumns + ", revision from links order by name;"
+	var args []any
+	if tag != "" {
+		query = "select " + recordColumns + ", revision from links where exists (select 1 from json_each(links.tags) where json_each.value = ?) order by name;"
+		args = append(args, tag)
 	}
-	// There is a race here between checking that the new name doesn't exist the
-	// update, but the checks are really just for writing nicer messages for the
-	// user. The database will enforce that names are unique as a constraint.
-	_, found, err = linkByName(ctx, db, newName)
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return fmt.Errorf("failed to query the database for the new name: %w", err)
+		return nil, fmt.Errorf("failed to list links: %w", err)
 	}
-	if found {
-		return ErrAlreadyExists
+	defer rows.Close()
+	var records []*Record
+	for rows.Next() {
+		var revision int64
+		r, err := scanRecord(rows, &revision)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list links: %w", err)
+		}
+		r.Revision = revision
+		records = append(records, r)
 	}
-	const query = "update links set name = ?, url = ? where name = ?;"
-	if _, err := db.ExecContext(ctx, query, newName, address, oldName); err != nil {
-		return fmt.Errorf("failed to update database: %w", err)
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list links: %w", err)
 	}
-	return nil
+	return records, nil
 }
 
-// Delete removes an entry from the database.
-func Delete(ctx context.Context, db *sql.DB, name string) error {
-	_, found, err := linkByName(ctx, db, name)
+// recordColumns are the columns of a link. They're what scanRecord reads,
+// what values returns, and what archiving, deleting and restoring copy
+// between tables.
+const recordColumns = "name, url, created_by, visibility, allowed_group, not_before, expires_at, " +
+	"description, tags, created_at, updated_at, updated_by, redirect_code, cache_max_age"
+
+// recordPlaceholders has a placeholder for each of recordColumns.
+var recordPlaceholders = strings.TrimSuffix(strings.Repeat("?, ", strings.Count(recordColumns, ",")+1), ", ")
+
+// values returns the values of r for recordColumns.
+func (r *Record) values() ([]any, error) {
+	tags, err := json.Marshal(r.Tags)
 	if err != nil {
-		return fmt.Errorf("failed to delete %q: %w", name, err)
+		return nil, err
 	}
-	if !found {
-		return ErrNotFound
+	return []any{r.Name, r.Link.String(), r.CreatedBy, r.Visibility, r.Group, unixOrNull(r.NotBefore), unixOrNull(r.ExpiresAt),
+		r.Description, string(tags), unixOrNull(r.CreatedAt), unixOrNull(r.UpdatedAt), r.UpdatedBy,
+		r.RedirectCode, int64(r.CacheMaxAge / time.Second)}, nil
+}
+
+// scanRecord reads a row of recordColumns, followed by columns for extra.
+func scanRecord(row interface{ Scan(...any) error }, extra ...any) (*Record, error) {
+	var r Record
+	var link, visibility, tags string
+	var notBefore, expiresAt, createdAt, updatedAt sql.NullInt64
+	var cacheMaxAge int64
+	dest := []any{&r.Name, &link, &r.CreatedBy, &visibility, &r.Group, &notBefore, &expiresAt,
+		&r.Description, &tags, &createdAt, &updatedAt, &r.UpdatedBy, &r.RedirectCode, &cacheMaxAge}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
 	}
-	const query = "delete from links where name=?;"
-	if _, err := db.ExecContext(ctx, query, name); err != nil {
-		return fmt.Errorf("failed to execute delete statement: %w", err)
+	if err := json.Unmarshal([]byte(tags), &r.Tags); err != nil {
+		return nil, fmt.Errorf("failed to parse the tags of %q: %w", r.Name, err)
 	}
-	return nil
+	r.NotBefore = timeOrZero(notBefore)
+	r.ExpiresAt = timeOrZero(expiresAt)
+	r.CreatedAt = timeOrZero(createdAt)
+	r.UpdatedAt = timeOrZero(updatedAt)
+	r.CacheMaxAge = time.Duration(cacheMaxAge) * time.Second
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the url of %q: %w", r.Name, err)
+	}
+	r.Link = u
+	r.Visibility = Visibility(visibility)
+	return &r, nil
+}
+
+// queryer is a *sql.DB or a *sql.Tx.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
 }
 
-func linkByName(ctx context.Context, db *sql.DB, name string) (*Record, bool, error) {
-	const query = "select (url) from links where name=?;"
-	row := db.QueryRowContext(ctx, query, name)
-	var link string
-	if err := row.Scan(&link); err != nil {
+func linkByName(ctx context.Context, q queryer, name string) (*Record, bool, error) {
+	const query = "select " + recordColumns + ", revision from links where name=?;"
+	var revision int64
+	r, err := scanRecord(q.QueryRowContext(ctx, query, name), &revision)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, false, nil
 		}
 		return nil, false, err
 	}
-	u, err := url.Parse(link)
+	r.Revision = revision
+	return r, true, nil
+}
+
+// inTx runs f in a transaction, which it commits if f succeeds and rolls back
+// otherwise.
+func inTx(ctx context.Context, db *sql.DB, f func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err := f(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err is a violation of a unique
+// constraint, like a second link with the same name.
+func isUniqueViolation(err error) bool {
+	var e sqlite3.Error
+	return errors.As(err, &e) && (e.ExtendedCode == sqlite3.ErrConstraintUnique || e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
+
+// requireRows returns ErrNotFound if res changed no rows.
+func requireRows(res sql.Result) error {
+	n, err := res.RowsAffected()
 	if err != nil {
-		return nil, false, fmt.Errorf("failed to lookup %q: %w", name, err)
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ParseName returns the name that a user typed without surrounding
+// whitespace, or ErrInvalidLinkName. Names are stored as ParseName returns
+// them, whether they come from a form or the API, and are escaped only when
+// they're shown.
+func ParseName(s string) (string, error) {
+	name := strings.TrimSpace(s)
+	if !validLinkName(name) {
+		return "", ErrInvalidLinkName
 	}
-	return &Record{name, u}, true, nil
+	return name, nil
 }
 
 // validLinkName returns true if name is valid and false otherwise.
 //
-// A name is invalid if it contains whitespace or is the empty string.
+// A name is invalid if it's the empty string or has whitespace, control
+// characters or a '/', '?' or '#', which would stop it from being resolved as
+// go/<name>.
 func validLinkName(name string) bool {
 	for _, c := range name {
-		if unicode.IsSpace(c) {
+		if unicode.IsSpace(c) || unicode.IsControl(c) || strings.ContainsRune("/?#", c) {
 			return false
 		}
 	}
@@ -2,6 +2,10 @@ package link
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
 	"testing"
 
 	"github.com/spwg/golink/internal/golinktest"
@@ -24,6 +28,26 @@ func TestValidLinkName(t *testing.T) {
 			linkName: "foo foo",
 			want:     false,
 		},
+		{
+			name:     "html characters",
+			linkName: `a&b<c>"d'`,
+			want:     true,
+		},
+		{
+			name:     "path",
+			linkName: "foo/bar",
+			want:     false,
+		},
+		{
+			name:     "query",
+			linkName: "foo?bar",
+			want:     false,
+		},
+		{
+			name:     "control character",
+			linkName: "foo\x00",
+			want:     false,
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -35,6 +59,15 @@ func TestValidLinkName(t *testing.T) {
 	}
 }
 
+func TestParseName(t *testing.T) {
+	if got, err := ParseName("  a&b \n"); got != "a&b" || err != nil {
+		t.Errorf("ParseName(%q) = %q, %v, want %q, nil", "  a&b \n", got, err, "a&b")
+	}
+	if got, err := ParseName(" "); err != ErrInvalidLinkName {
+		t.Errorf("ParseName(%q) = %q, %v, want %v", " ", got, err, ErrInvalidLinkName)
+	}
+}
+
 func TestCreate(t *testing.T) {
 	type testCase struct {
 		name     string
@@ -69,3 +102,265 @@ func TestCreate(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdate(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	if err := Create(ctx, db, "foo", "http://example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Create(ctx, db, "bar", "http://example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Update(ctx, db, "missing", "missing", "http://example.com"); err != ErrNotFound {
+		t.Errorf("Update() of a missing link returned err=%v, want %v", err, ErrNotFound)
+	}
+	if err := Update(ctx, db, "foo", "bar", "http://example.com"); err != ErrAlreadyExists {
+		t.Errorf("Update() to a taken name returned err=%v, want %v", err, ErrAlreadyExists)
+	}
+	// The parsed address is stored, the same as Create does.
+	if err := Update(ctx, db, "foo", "foo", "HTTP://example.com/a b"); err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	if err := db.QueryRowContext(ctx, "select url from links where name = 'foo';").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://example.com/a%20b"; stored != want {
+		t.Errorf("Update() stored %q, want %q", stored, want)
+	}
+}
+
+func TestIfRevision(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	if err := Create(ctx, db, "foo", "http://example.com/1"); err != nil {
+		t.Fatal(err)
+	}
+	read, err := Read(ctx, db, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Update(ctx, db, "foo", "foo", "http://example.com/2", IfRevision(read.Revision)); err != nil {
+		t.Fatalf("Update() at the revision that was read failed: %v", err)
+	}
+	// The first update moved the link on, so updates and deletes based on
+	// the same read conflict.
+	if err := Update(ctx, db, "foo", "foo", "http://example.com/3", IfRevision(read.Revision)); err != ErrConflict {
+		t.Errorf("Update() at an old revision returned err=%v, want %v", err, ErrConflict)
+	}
+	if err := Delete(ctx, db, "foo", "", IfRevision(read.Revision)); err != ErrConflict {
+		t.Errorf("Delete() at an old revision returned err=%v, want %v", err, ErrConflict)
+	}
+	if got, err := Read(ctx, db, "foo"); err != nil || got.Link.String() != "http://example.com/2" {
+		t.Fatalf("Read() after the conflicts = %v, %v, want the first update", got, err)
+	}
+	current, err := Read(ctx, db, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Delete(ctx, db, "foo", "", IfRevision(current.Revision)); err != nil {
+		t.Errorf("Delete() at the current revision failed: %v", err)
+	}
+}
+
+// race runs f(i) for i in [0, n) at the same time and returns their errors.
+func race(n int, f func(i int) error) []error {
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			errs[i] = f(i)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	return errs
+}
+
+// checkOneWinner checks that exactly one of errs is nil and the rest are
+// loser.
+func checkOneWinner(t *testing.T, op string, errs []error, loser error) {
+	t.Helper()
+	wins := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			wins++
+		case !errors.Is(err, loser):
+			t.Errorf("Concurrent %s returned err=%v, want nil or %v", op, err, loser)
+		}
+	}
+	if wins != 1 {
+		t.Errorf("%d concurrent calls to %s succeeded, want 1", wins, op)
+	}
+}
+
+func TestCreateRace(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	errs := race(16, func(i int) error {
+		return Create(ctx, db, "foo", fmt.Sprintf("http://example.com/%d", i))
+	})
+	checkOneWinner(t, "Create()", errs, ErrAlreadyExists)
+}
+
+func TestUpdateRace(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	const n = 16
+	for i := 0; i < n; i++ {
+		if err := Create(ctx, db, fmt.Sprintf("link-%d", i), "http://example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errs := race(n, func(i int) error {
+		return Update(ctx, db, fmt.Sprintf("link-%d", i), "target", "http://example.com")
+	})
+	checkOneWinner(t, "Update() to the same name", errs, ErrAlreadyExists)
+
+	// Renaming the same link many times, only the first rename finds it.
+	errs = race(n, func(i int) error {
+		return Update(ctx, db, "target", fmt.Sprintf("renamed-%d", i), "http://example.com")
+	})
+	checkOneWinner(t, "Update() of the same link", errs, ErrNotFound)
+}
+
+func TestDeleteRace(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	if err := Create(ctx, db, "foo", "http://example.com"); err != nil {
+		t.Fatal(err)
+	}
+	errs := race(16, func(i int) error {
+		return Delete(ctx, db, "foo", "")
+	})
+	checkOneWinner(t, "Delete()", errs, ErrNotFound)
+	if trash, err := ListTrash(ctx, db); err != nil || len(trash) != 1 {
+		t.Errorf("ListTrash() = %d links, %v, want the link deleted once", len(trash), err)
+	}
+}
+
+func TestCountCreatedBy(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	for _, name := range []string{"a", "b"} {
+		if err := Create(ctx, db, name, "http://example.com", CreatedBy("alice")); err != nil {
+			t.Fatalf("Create(%q) failed: %v", name, err)
+		}
+	}
+	if err := Create(ctx, db, "c", "http://example.com"); err != nil {
+		t.Fatalf("Create(%q) failed: %v", "c", err)
+	}
+	r, err := Read(ctx, db, "a")
+	if err != nil {
+		t.Fatalf("Read(%q) failed: %v", "a", err)
+	}
+	if got, want := r.CreatedBy, "alice"; got != want {
+		t.Errorf("Read(%q) returned CreatedBy=%q, want %q", "a", got, want)
+	}
+	for user, want := range map[string]int{"alice": 2, "bob": 0} {
+		got, err := CountCreatedBy(ctx, db, user)
+		if err != nil {
+			t.Fatalf("CountCreatedBy(%q) failed: %v", user, err)
+		}
+		if got != want {
+			t.Errorf("CountCreatedBy(%q)=%v, want %v", user, got, want)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	type testCase struct {
+		name    string
+		address string
+		args    string
+		want    string
+	}
+	testCases := []testCase{
+		{
+			name:    "no placeholder",
+			address: "https://example.com/a?b=c",
+			args:    "foo bar",
+			want:    "https://example.com/a?b=c",
+		},
+		{
+			name:    "query",
+			address: "https://www.google.com/search?q={args}",
+			args:    "foo bar&baz",
+			want:    "https://www.google.com/search?q=foo+bar%26baz",
+		},
+		{
+			name:    "path",
+			address: "https://github.com/{args}",
+			args:    "spwg/golink",
+			want:    "https://github.com/spwg/golink",
+		},
+		{
+			name:    "no args",
+			address: "https://github.com/{args}",
+			args:    "",
+			want:    "https://github.com/",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := url.Parse(tc.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := &Record{Name: "foo", Link: u}
+			if got := r.Expand(tc.args).String(); got != tc.want {
+				t.Errorf("Expand(%q) = %q, want %q", tc.args, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestConcurrentChanges(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	if err := Create(ctx, db, "shared", "http://example.com/0"); err != nil {
+		t.Fatal(err)
+	}
+	const workers, iterations = 8, 20
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				name := fmt.Sprintf("link-%d-%d", w, i)
+				address := fmt.Sprintf("http://example.com/%d/%d", w, i)
+				if err := Create(ctx, db, name, address); err != nil {
+					t.Errorf("Create(%q) failed: %v", name, err)
+					continue
+				}
+				if err := Update(ctx, db, name, name, address+"/updated"); err != nil {
+					t.Errorf("Update(%q) failed: %v", name, err)
+				}
+				if err := Update(ctx, db, "shared", "shared", address); err != nil {
+					t.Errorf("Update(%q) failed: %v", "shared", err)
+				}
+				if _, err := Read(ctx, db, "shared"); err != nil {
+					t.Errorf("Read(%q) failed: %v", "shared", err)
+				}
+				if _, err := List(ctx, db, ""); err != nil {
+					t.Errorf("List() failed: %v", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	all, err := List(ctx, db, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(all), workers*iterations+1; got != want {
+		t.Errorf("List() returned %d links after the concurrent changes, want %d", got, want)
+	}
+}
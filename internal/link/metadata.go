@@ -0,0 +1,62 @@
+package link
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// ErrInvalidTag means that a tag has characters other than letters, digits,
+// '-', '_' and '.'.
+var ErrInvalidTag = errors.New("invalid tag: must only contain letters, digits, '-', '_' and '.'")
+
+// WithDescription sets the description of a link.
+func WithDescription(description string) Option {
+	return func(r *Record) {
+		r.Description = description
+	}
+}
+
+// WithTags sets the tags of a link. They're normalized with NormalizeTags.
+func WithTags(tags []string) Option {
+	return func(r *Record) {
+		r.Tags = NormalizeTags(tags)
+	}
+}
+
+// UpdatedBy records user as the last person to change a link.
+func UpdatedBy(user string) Option {
+	return func(r *Record) {
+		r.UpdatedBy = user
+	}
+}
+
+// ParseTags splits s on commas and whitespace into normalized tags.
+func ParseTags(s string) []string {
+	return NormalizeTags(strings.FieldsFunc(s, func(c rune) bool {
+		return c == ',' || unicode.IsSpace(c)
+	}))
+}
+
+// NormalizeTags lower-cases tags, drops empty and duplicate ones, and sorts
+// them.
+func NormalizeTags(tags []string) []string {
+	normal := []string{}
+	for _, t := range tags {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			normal = append(normal, t)
+		}
+	}
+	slices.Sort(normal)
+	return slices.Compact(normal)
+}
+
+func validTag(tag string) bool {
+	for _, c := range tag {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && !strings.ContainsRune("-_.", c) {
+			return false
+		}
+	}
+	return tag != ""
+}
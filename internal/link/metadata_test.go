@@ -0,0 +1,69 @@
+package link
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/spwg/golink/internal/golinktest"
+)
+
+func TestParseTags(t *testing.T) {
+	got := ParseTags(" OnCall,infra  oncall,, docs")
+	if want := []string{"docs", "infra", "oncall"}; !slices.Equal(got, want) {
+		t.Errorf("ParseTags() returned %q, want %q", got, want)
+	}
+	if got := ParseTags(""); got == nil || len(got) != 0 {
+		t.Errorf("ParseTags(%q) returned %#v, want an empty slice", "", got)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	create := func(name string, opts ...Option) {
+		t.Helper()
+		if err := Create(ctx, db, name, "http://example.com/"+name, opts...); err != nil {
+			t.Fatalf("Create(%q) failed: %v", name, err)
+		}
+	}
+	create("pager", WithDescription("Who's on call"), WithTags([]string{"oncall", "infra"}), CreatedBy("alice"))
+	create("runbook", WithTags([]string{"oncall"}))
+	create("wiki")
+	if err := Create(ctx, db, "bad", "http://example.com", WithTags([]string{"on call?"})); err != ErrInvalidTag {
+		t.Errorf("Create() with an invalid tag returned err=%v, want %v", err, ErrInvalidTag)
+	}
+
+	r, err := Read(ctx, db, "pager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Description != "Who's on call" || !slices.Equal(r.Tags, []string{"infra", "oncall"}) || r.CreatedAt.IsZero() || r.UpdatedBy != "alice" {
+		t.Errorf("Read() returned %+v, want the description, tags, creation time and creator", r)
+	}
+
+	for tag, want := range map[string][]string{"oncall": {"pager", "runbook"}, "infra": {"pager"}, "": {"pager", "runbook", "wiki"}, "none": nil} {
+		records, err := List(ctx, db, tag)
+		if err != nil {
+			t.Fatalf("List(%q) failed: %v", tag, err)
+		}
+		var got []string
+		for _, r := range records {
+			got = append(got, r.Name)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("List(%q) returned %q, want %q", tag, got, want)
+		}
+	}
+
+	if err := Update(ctx, db, "pager", "pager", "http://example.com/new", UpdatedBy("bob")); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := Read(ctx, db, "pager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Description != r.Description || !slices.Equal(updated.Tags, r.Tags) || !updated.CreatedAt.Equal(r.CreatedAt) || updated.UpdatedBy != "bob" {
+		t.Errorf("Update() changed %+v to %+v, want only the link and who updated it to change", r, updated)
+	}
+}
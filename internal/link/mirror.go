@@ -0,0 +1,90 @@
+package link
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Put creates or replaces the link called r.Name with r as is, including who
+// created it and when. It's for copying links from another server; users
+// change links with Create and Update. A link that's already the same isn't
+// written, so that it doesn't show up in the log of changes.
+func Put(ctx context.Context, db *sql.DB, r *Record) error {
+	return put(ctx, db, r)
+}
+
+// putQuery inserts a link, or updates the link with the same name if it
+// differs.
+var putQuery = func() string {
+	cols := strings.Split(recordColumns, ", ")
+	var set, old, new []string
+	for _, c := range cols[1:] {
+		set = append(set, c+" = excluded."+c)
+		old = append(old, "links."+c)
+		new = append(new, "excluded."+c)
+	}
+	return "insert into links (" + recordColumns + ") values (" + recordPlaceholders + ") " +
+		"on conflict (name) do update set " + strings.Join(set, ", ") +
+		" where (" + strings.Join(old, ", ") + ") is not (" + strings.Join(new, ", ") + ");"
+}()
+
+func put(ctx context.Context, e execer, r *Record) error {
+	if !validLinkName(r.Name) {
+		return ErrInvalidLinkName
+	}
+	if r.Link == nil {
+		return ErrUnparseableAddress
+	}
+	if err := r.validate(); err != nil {
+		return err
+	}
+	values, err := r.values()
+	if err != nil {
+		return err
+	}
+	if _, err := e.ExecContext(ctx, putQuery, values...); err != nil {
+		return fmt.Errorf("failed to put %q: %w", r.Name, err)
+	}
+	return nil
+}
+
+// Remove deletes the link called name for good, without moving it to the
+// trash. It's for copying deletions from another server; users delete links
+// with Delete. Removing a link that doesn't exist is not an error.
+func Remove(ctx context.Context, db *sql.DB, name string) error {
+	if _, err := db.ExecContext(ctx, "delete from links where name=?;", name); err != nil {
+		return fmt.Errorf("failed to remove %q: %w", name, err)
+	}
+	return nil
+}
+
+// ReplaceAll makes records the only links, as if by Put and Remove, in a
+// single transaction.
+func ReplaceAll(ctx context.Context, db *sql.DB, records []*Record) error {
+	names := make([]string, len(records))
+	for i, r := range records {
+		names[i] = r.Name
+	}
+	keep, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	return inTx(ctx, db, func(tx *sql.Tx) error {
+		for _, r := range records {
+			if err := put(ctx, tx, r); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "delete from links where name not in (select value from json_each(?));", string(keep)); err != nil {
+			return fmt.Errorf("failed to remove old links: %w", err)
+		}
+		return nil
+	})
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
@@ -0,0 +1,70 @@
+package link
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/spwg/golink/internal/golinktest"
+)
+
+func TestPut(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	r := &Record{
+		Name:       "foo",
+		Link:       &url.URL{Scheme: "http", Host: "example.com"},
+		CreatedBy:  "alice",
+		Visibility: Unlisted,
+		Tags:       []string{"docs"},
+		CreatedAt:  created,
+		UpdatedAt:  created,
+	}
+	if err := Put(ctx, db, r); err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+	got, err := Read(ctx, db, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CreatedBy != "alice" || got.Visibility != Unlisted || !got.CreatedAt.Equal(created) || len(got.Tags) != 1 {
+		t.Errorf("Read() after Put() = %+v, want the record as put", got)
+	}
+	// Putting the same record again doesn't change anything.
+	if err := Put(ctx, db, r); err != nil {
+		t.Fatal(err)
+	}
+	if latest, err := LatestRevision(ctx, db); err != nil || latest != 1 {
+		t.Errorf("LatestRevision() after putting the same record = %v, %v, want 1, nil", latest, err)
+	}
+	r.Link = &url.URL{Scheme: "http", Host: "example.org"}
+	if err := Put(ctx, db, r); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Read(ctx, db, "foo"); err != nil || got.Link.Host != "example.org" || got.Revision != 2 {
+		t.Errorf("Read() after putting a change = %+v, %v, want example.org at revision 2", got, err)
+	}
+
+	bar := &Record{Name: "bar", Link: &url.URL{Scheme: "http", Host: "bar.com"}, Visibility: Public}
+	if err := ReplaceAll(ctx, db, []*Record{bar}); err != nil {
+		t.Fatalf("ReplaceAll() failed: %v", err)
+	}
+	all, err := List(ctx, db, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].Name != "bar" {
+		t.Errorf("List() after ReplaceAll() returned %d links, want only bar", len(all))
+	}
+	if err := Remove(ctx, db, "bar"); err != nil {
+		t.Fatalf("Remove() failed: %v", err)
+	}
+	if _, err := Read(ctx, db, "bar"); err != ErrNotFound {
+		t.Errorf("Read() after Remove() returned err=%v, want %v", err, ErrNotFound)
+	}
+	if trash, err := ListTrash(ctx, db); err != nil || len(trash) != 0 {
+		t.Errorf("ListTrash() after Remove() = %v, %v, want nothing", trash, err)
+	}
+}
@@ -0,0 +1,48 @@
+package link
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultRedirectCode is the status code of redirects to links that don't
+	// choose one. It's temporary, so that clients ask again and see changes
+	// to the link.
+	DefaultRedirectCode = http.StatusTemporaryRedirect
+	// MaxCacheMaxAge is the longest that a link may let clients cache its
+	// redirects for.
+	MaxCacheMaxAge = 365 * 24 * time.Hour
+)
+
+// ErrInvalidRedirect means that a link has a redirect code other than 301,
+// 302, 307 and 308, or a negative or too long cache max age.
+var ErrInvalidRedirect = errors.New("invalid redirect: the status must be 301, 302, 307 or 308 and caching must last between 0 and a year")
+
+// WithRedirect sets the status code of redirects to a link, or 0 for
+// DefaultRedirectCode, and how long clients may cache them, or 0 for not at
+// all. maxAge is truncated to seconds.
+func WithRedirect(code int, maxAge time.Duration) Option {
+	return func(r *Record) {
+		r.RedirectCode = code
+		r.CacheMaxAge = maxAge.Truncate(time.Second)
+	}
+}
+
+// RedirectStatus returns the status code of redirects to r.
+func (r *Record) RedirectStatus() int {
+	if r.RedirectCode == 0 {
+		return DefaultRedirectCode
+	}
+	return r.RedirectCode
+}
+
+func validRedirect(code int, maxAge time.Duration) bool {
+	switch code {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return false
+	}
+	return maxAge >= 0 && maxAge <= MaxCacheMaxAge
+}
@@ -0,0 +1,59 @@
+package link
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/spwg/golink/internal/golinktest"
+)
+
+func TestRedirect(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	for _, opt := range []Option{
+		WithRedirect(http.StatusOK, 0),
+		WithRedirect(http.StatusSeeOther, 0),
+		WithRedirect(0, -time.Second),
+		WithRedirect(0, MaxCacheMaxAge+time.Second),
+	} {
+		if err := Create(ctx, db, "bad", "http://example.com", opt); err != ErrInvalidRedirect {
+			t.Errorf("Create() returned err=%v, want %v", err, ErrInvalidRedirect)
+		}
+	}
+	if err := Create(ctx, db, "foo", "http://example.com"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Read(ctx, db, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.RedirectStatus(); got != DefaultRedirectCode || r.CacheMaxAge != 0 {
+		t.Errorf("Read() of a new link has status %d and max age %v, want %d and 0", got, r.CacheMaxAge, DefaultRedirectCode)
+	}
+	if err := Update(ctx, db, "foo", "foo", "http://example.com", WithRedirect(http.StatusPermanentRedirect, 90*time.Minute+time.Millisecond)); err != nil {
+		t.Fatalf("Update() failed: %v", err)
+	}
+	// Options that don't set the redirect keep it.
+	if err := Update(ctx, db, "foo", "bar", "http://example.com/bar", WithDescription("bar")); err != nil {
+		t.Fatalf("Update() failed: %v", err)
+	}
+	if r, err = Read(ctx, db, "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if r.RedirectStatus() != http.StatusPermanentRedirect || r.CacheMaxAge != 90*time.Minute {
+		t.Errorf("Read() after Update() has status %d and max age %v, want %d and %v", r.RedirectStatus(), r.CacheMaxAge, http.StatusPermanentRedirect, 90*time.Minute)
+	}
+	// The trash keeps the redirect too.
+	if err := Delete(ctx, db, "bar", ""); err != nil {
+		t.Fatal(err)
+	}
+	trashed, err := ListTrash(ctx, db)
+	if err != nil || len(trashed) != 1 {
+		t.Fatalf("ListTrash() = %v, %v, want one link", trashed, err)
+	}
+	if got := trashed[0].Record; got.RedirectCode != http.StatusPermanentRedirect || got.CacheMaxAge != 90*time.Minute {
+		t.Errorf("ListTrash() has status %d and max age %v, want %d and %v", got.RedirectCode, got.CacheMaxAge, http.StatusPermanentRedirect, 90*time.Minute)
+	}
+}
@@ -0,0 +1,83 @@
+package link
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidSchedule means that a link would expire before it becomes active.
+var ErrInvalidSchedule = errors.New("invalid schedule: the link must expire after it becomes active")
+
+// WithSchedule sets when a link starts and stops resolving. Either can be
+// the zero time.
+func WithSchedule(notBefore, expiresAt time.Time) Option {
+	return func(r *Record) {
+		r.NotBefore = notBefore
+		r.ExpiresAt = expiresAt
+	}
+}
+
+// Pending reports whether r isn't active yet at now.
+func (r *Record) Pending(now time.Time) bool {
+	return !r.NotBefore.IsZero() && now.Before(r.NotBefore)
+}
+
+// Expired reports whether r has expired at now.
+func (r *Record) Expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && !now.Before(r.ExpiresAt)
+}
+
+// ArchiveExpired moves the links that have expired at now out of the links
+// table and into the archive, and returns how many it moved. Archived links
+// free up their names.
+func ArchiveExpired(ctx context.Context, db *sql.DB, now time.Time) (int, error) {
+	var n int64
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		const archive = "insert into archived_links (" + recordColumns + ", archived_at) " +
+			"select " + recordColumns + ", ? from links where expires_at <= ?;"
+		if _, err := tx.ExecContext(ctx, archive, now.Unix(), now.Unix()); err != nil {
+			return fmt.Errorf("failed to archive expired links: %w", err)
+		}
+		res, err := tx.ExecContext(ctx, "delete from links where expires_at <= ?;", now.Unix())
+		if err != nil {
+			return fmt.Errorf("failed to delete expired links: %w", err)
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// ReadArchived returns the most recently archived link called name. Returns
+// ErrNotFound if there isn't one.
+func ReadArchived(ctx context.Context, db *sql.DB, name string) (*Record, error) {
+	const query = "select " + recordColumns + " from archived_links where name=? order by archived_at desc, id desc limit 1;"
+	r, err := scanRecord(db.QueryRowContext(ctx, query, name))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to read archived link %q: %w", name, err)
+	}
+	return r, nil
+}
+
+func unixOrNull(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.Unix()
+}
+
+func timeOrZero(n sql.NullInt64) time.Time {
+	if !n.Valid {
+		return time.Time{}
+	}
+	return time.Unix(n.Int64, 0).UTC()
+}
@@ -0,0 +1,73 @@
+package link
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spwg/golink/internal/golinktest"
+)
+
+func TestSchedule(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	r := &Record{NotBefore: now, ExpiresAt: now.Add(time.Hour)}
+	type testCase struct {
+		at          time.Time
+		wantPending bool
+		wantExpired bool
+	}
+	for _, tc := range []testCase{
+		{at: now.Add(-time.Second), wantPending: true},
+		{at: now},
+		{at: now.Add(time.Hour), wantExpired: true},
+	} {
+		if got := r.Pending(tc.at); got != tc.wantPending {
+			t.Errorf("Pending(%v)=%v, want %v", tc.at, got, tc.wantPending)
+		}
+		if got := r.Expired(tc.at); got != tc.wantExpired {
+			t.Errorf("Expired(%v)=%v, want %v", tc.at, got, tc.wantExpired)
+		}
+	}
+	if (&Record{}).Pending(now) || (&Record{}).Expired(now) {
+		t.Errorf("A record without a schedule is pending or expired, want active")
+	}
+}
+
+func TestArchiveExpired(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	now := time.Now().Truncate(time.Second)
+	if err := Create(ctx, db, "bad", "http://example.com", WithSchedule(now, now)); err != ErrInvalidSchedule {
+		t.Errorf("Create() with an empty schedule returned err=%v, want %v", err, ErrInvalidSchedule)
+	}
+	if err := Create(ctx, db, "old", "http://example.com/old", WithSchedule(time.Time{}, now.Add(-time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	if err := Create(ctx, db, "new", "http://example.com/new", WithSchedule(time.Time{}, now.Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	n, err := ArchiveExpired(ctx, db, now)
+	if err != nil {
+		t.Fatalf("ArchiveExpired() failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("ArchiveExpired() archived %d links, want 1", n)
+	}
+	if _, err := Read(ctx, db, "old"); err != ErrNotFound {
+		t.Errorf("Read(%q) of an archived link returned err=%v, want %v", "old", err, ErrNotFound)
+	}
+	r, err := ReadArchived(ctx, db, "old")
+	if err != nil {
+		t.Fatalf("ReadArchived(%q) failed: %v", "old", err)
+	}
+	if got, want := r.ExpiresAt, now.Add(-time.Minute); !got.Equal(want) {
+		t.Errorf("ReadArchived(%q) returned ExpiresAt=%v, want %v", "old", got, want)
+	}
+	if _, err := Read(ctx, db, "new"); err != nil {
+		t.Errorf("Read(%q) of an active link failed: %v", "new", err)
+	}
+	// The name can be used again.
+	if err := Create(ctx, db, "old", "http://example.com/again"); err != nil {
+		t.Errorf("Create() with the name of an archived link failed: %v", err)
+	}
+}
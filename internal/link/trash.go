@@ -0,0 +1,161 @@
+package link
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Trashed is a deleted link that can still be restored.
+type Trashed struct {
+	*Record
+	// ID identifies the link in the trash, since a name can be deleted more
+	// than once.
+	ID int64
+	// DeletedAt is when the link was deleted.
+	DeletedAt time.Time
+	// DeletedBy is the user who deleted the link, or "" if it's not known.
+	DeletedBy string
+}
+
+// ListedFor reports whether t should be listed in the trash for user, who
+// belongs to groups: if the link would be listed on the index, or if user
+// deleted it.
+func (t *Trashed) ListedFor(user string, groups []string) bool {
+	return t.Record.ListedFor(user, groups) || user != "" && user == t.DeletedBy
+}
+
+// Delete moves the link called name to the trash, recording that user
+// deleted it. Its name is free to be used again straight away. The only
+// option that applies is IfRevision, which makes it return ErrConflict if the
+// link has changed.
+func Delete(ctx context.Context, db *sql.DB, name, user string, opts ...Option) error {
+	return inTx(ctx, db, func(tx *sql.Tx) error {
+		r, found, err := linkByName(ctx, tx, name)
+		if err != nil {
+			return fmt.Errorf("failed to read %q: %w", name, err)
+		}
+		if !found {
+			return ErrNotFound
+		}
+		for _, opt := range opts {
+			opt(r)
+		}
+		if r.conflicts() {
+			return ErrConflict
+		}
+		const trash = "insert into deleted_links (" + recordColumns + ", deleted_at, deleted_by) " +
+			"select " + recordColumns + ", ?, ? from links where name=?;"
+		res, err := tx.ExecContext(ctx, trash, time.Now().Unix(), user, name)
+		if err != nil {
+			return fmt.Errorf("failed to move %q to the trash: %w", name, err)
+		}
+		if err := requireRows(res); err != nil {
+			return err
+		}
+		res, err = tx.ExecContext(ctx, "delete from links where name=?;", name)
+		if err != nil {
+			return fmt.Errorf("failed to execute delete statement: %w", err)
+		}
+		return requireRows(res)
+	})
+}
+
+// trashColumns are the columns that scanTrashed reads.
+const trashColumns = recordColumns + ", id, deleted_at, deleted_by"
+
+func scanTrashed(row interface{ Scan(...any) error }) (*Trashed, error) {
+	var t Trashed
+	var deletedAt int64
+	r, err := scanRecord(row, &t.ID, &deletedAt, &t.DeletedBy)
+	if err != nil {
+		return nil, err
+	}
+	t.Record = r
+	t.DeletedAt = time.Unix(deletedAt, 0).UTC()
+	return &t, nil
+}
+
+// ListTrash returns the links in the trash, most recently deleted first.
+func ListTrash(ctx context.Context, db *sql.DB) ([]*Trashed, error) {
+	const query = "select " + trashColumns + " from deleted_links order by deleted_at desc, id desc;"
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the trash: %w", err)
+	}
+	defer rows.Close()
+	var trashed []*Trashed
+	for rows.Next() {
+		t, err := scanTrashed(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the trash: %w", err)
+		}
+		trashed = append(trashed, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list the trash: %w", err)
+	}
+	return trashed, nil
+}
+
+// ReadTrashed returns the link in the trash with the given id. Returns
+// ErrNotFound if there isn't one.
+func ReadTrashed(ctx context.Context, db *sql.DB, id int64) (*Trashed, error) {
+	const query = "select " + trashColumns + " from deleted_links where id=?;"
+	t, err := scanTrashed(db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to read deleted link %d: %w", id, err)
+	}
+	return t, nil
+}
+
+// Restore moves the link with the given id out of the trash and returns it.
+// Returns ErrNotFound if it's not in the trash and ErrAlreadyExists if its
+// name has been used again since it was deleted.
+func Restore(ctx context.Context, db *sql.DB, id int64) (*Record, error) {
+	var t *Trashed
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		t, err = scanTrashed(tx.QueryRowContext(ctx, "select "+trashColumns+" from deleted_links where id=?;", id))
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			return fmt.Errorf("failed to read deleted link %d: %w", id, err)
+		}
+		const restore = "insert into links (" + recordColumns + ") select " + recordColumns + " from deleted_links where id=?;"
+		if _, err := tx.ExecContext(ctx, restore, id); err != nil {
+			if isUniqueViolation(err) {
+				return ErrAlreadyExists
+			}
+			return fmt.Errorf("failed to restore %q: %w", t.Name, err)
+		}
+		if _, err := tx.ExecContext(ctx, "delete from deleted_links where id=?;", id); err != nil {
+			return fmt.Errorf("failed to remove %q from the trash: %w", t.Name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t.Record, nil
+}
+
+// PurgeTrash permanently removes the links that were deleted before before,
+// and returns how many it removed.
+func PurgeTrash(ctx context.Context, db *sql.DB, before time.Time) (int, error) {
+	res, err := db.ExecContext(ctx, "delete from deleted_links where deleted_at < ?;", before.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge the trash: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
@@ -0,0 +1,73 @@
+package link
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spwg/golink/internal/golinktest"
+)
+
+func TestTrash(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	if err := Create(ctx, db, "foo", "http://example.com/1", CreatedBy("alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Delete(ctx, db, "missing", "bob"); err != ErrNotFound {
+		t.Errorf("Delete(%q) returned err=%v, want %v", "missing", err, ErrNotFound)
+	}
+	if err := Delete(ctx, db, "foo", "bob"); err != nil {
+		t.Fatalf("Delete(%q) failed: %v", "foo", err)
+	}
+	if _, err := Read(ctx, db, "foo"); err != ErrNotFound {
+		t.Errorf("Read(%q) of a deleted link returned err=%v, want %v", "foo", err, ErrNotFound)
+	}
+	trash, err := ListTrash(ctx, db)
+	if err != nil {
+		t.Fatalf("ListTrash() failed: %v", err)
+	}
+	if len(trash) != 1 {
+		t.Fatalf("ListTrash() returned %d links, want 1", len(trash))
+	}
+	first := trash[0]
+	if first.Name != "foo" || first.DeletedBy != "bob" || first.CreatedBy != "alice" || first.Link.String() != "http://example.com/1" {
+		t.Errorf("ListTrash() returned %+v, want foo created by alice and deleted by bob", first)
+	}
+
+	// The name is reused, so the deleted link can't come back until the new
+	// one is deleted too.
+	if err := Create(ctx, db, "foo", "http://example.com/2"); err != nil {
+		t.Fatalf("Create() with the name of a deleted link failed: %v", err)
+	}
+	if _, err := Restore(ctx, db, first.ID); err != ErrAlreadyExists {
+		t.Errorf("Restore() over an existing name returned err=%v, want %v", err, ErrAlreadyExists)
+	}
+	if err := Delete(ctx, db, "foo", ""); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Restore(ctx, db, first.ID)
+	if err != nil {
+		t.Fatalf("Restore() failed: %v", err)
+	}
+	if got, want := r.Link.String(), "http://example.com/1"; got != want {
+		t.Errorf("Restore() returned a link to %q, want %q", got, want)
+	}
+	if _, err := ReadTrashed(ctx, db, first.ID); err != ErrNotFound {
+		t.Errorf("ReadTrashed() of a restored link returned err=%v, want %v", err, ErrNotFound)
+	}
+	if _, err := Restore(ctx, db, first.ID); err != ErrNotFound {
+		t.Errorf("Restore() twice returned err=%v, want %v", err, ErrNotFound)
+	}
+
+	n, err := PurgeTrash(ctx, db, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("PurgeTrash() failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("PurgeTrash() removed %d links, want 1", n)
+	}
+	if trash, err := ListTrash(ctx, db); err != nil || len(trash) != 0 {
+		t.Errorf("ListTrash() after purging returned %d links, err=%v, want none", len(trash), err)
+	}
+}
@@ -0,0 +1,67 @@
+package link
+
+import (
+	"errors"
+	"slices"
+)
+
+// Visibility controls who can see and resolve a link.
+type Visibility string
+
+const (
+	// Public links are listed on the index and resolve for everyone.
+	Public Visibility = "public"
+	// Unlisted links resolve for everyone but are only listed for the user
+	// who created them.
+	Unlisted Visibility = "unlisted"
+	// Private links only resolve for the user who created them and for
+	// members of their allowed group.
+	Private Visibility = "private"
+)
+
+// ErrInvalidVisibility means that a visibility is not one of the constants.
+var ErrInvalidVisibility = errors.New("invalid visibility: must be public, unlisted or private")
+
+// ParseVisibility parses s, which defaults to Public if empty.
+func ParseVisibility(s string) (Visibility, error) {
+	switch v := Visibility(s); v {
+	case "":
+		return Public, nil
+	case Public, Unlisted, Private:
+		return v, nil
+	}
+	return "", ErrInvalidVisibility
+}
+
+// WithVisibility sets the visibility of a link and the group whose members
+// can resolve it if it's Private.
+func WithVisibility(v Visibility, group string) Option {
+	return func(r *Record) {
+		r.Visibility = v
+		r.Group = group
+	}
+}
+
+// VisibleTo reports whether user, who belongs to groups, can resolve and
+// manage r. Anonymous users have user "".
+func (r *Record) VisibleTo(user string, groups []string) bool {
+	if r.Visibility != Private {
+		return true
+	}
+	if user != "" && user == r.CreatedBy {
+		return true
+	}
+	return r.Group != "" && slices.Contains(groups, r.Group)
+}
+
+// ListedFor reports whether r should be listed on the index for user, who
+// belongs to groups.
+func (r *Record) ListedFor(user string, groups []string) bool {
+	switch r.Visibility {
+	case Unlisted:
+		return user != "" && user == r.CreatedBy
+	case Private:
+		return r.VisibleTo(user, groups)
+	}
+	return true
+}
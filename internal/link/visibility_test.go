@@ -0,0 +1,101 @@
+package link
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spwg/golink/internal/golinktest"
+)
+
+func TestVisibleTo(t *testing.T) {
+	type testCase struct {
+		name        string
+		record      Record
+		user        string
+		groups      []string
+		wantVisible bool
+		wantListed  bool
+	}
+	testCases := []testCase{
+		{
+			name:        "public",
+			record:      Record{Visibility: Public, CreatedBy: "alice"},
+			wantVisible: true,
+			wantListed:  true,
+		},
+		{
+			name:        "unlisted",
+			record:      Record{Visibility: Unlisted, CreatedBy: "alice"},
+			user:        "bob",
+			wantVisible: true,
+			wantListed:  false,
+		},
+		{
+			name:        "unlisted owner",
+			record:      Record{Visibility: Unlisted, CreatedBy: "alice"},
+			user:        "alice",
+			wantVisible: true,
+			wantListed:  true,
+		},
+		{
+			name:   "private anonymous",
+			record: Record{Visibility: Private, CreatedBy: "alice", Group: "hr"},
+		},
+		{
+			name:   "private other user",
+			record: Record{Visibility: Private, CreatedBy: "alice", Group: "hr"},
+			user:   "bob",
+			groups: []string{"eng"},
+		},
+		{
+			name:        "private owner",
+			record:      Record{Visibility: Private, CreatedBy: "alice"},
+			user:        "alice",
+			wantVisible: true,
+			wantListed:  true,
+		},
+		{
+			name:        "private group member",
+			record:      Record{Visibility: Private, CreatedBy: "alice", Group: "hr"},
+			user:        "bob",
+			groups:      []string{"eng", "hr"},
+			wantVisible: true,
+			wantListed:  true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.record.VisibleTo(tc.user, tc.groups); got != tc.wantVisible {
+				t.Errorf("VisibleTo(%q, %q)=%v, want %v", tc.user, tc.groups, got, tc.wantVisible)
+			}
+			if got := tc.record.ListedFor(tc.user, tc.groups); got != tc.wantListed {
+				t.Errorf("ListedFor(%q, %q)=%v, want %v", tc.user, tc.groups, got, tc.wantListed)
+			}
+		})
+	}
+}
+
+func TestUpdateKeepsVisibility(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	if err := Create(ctx, db, "hr", "http://example.com", CreatedBy("alice"), WithVisibility(Private, "hr")); err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	if err := Update(ctx, db, "hr", "hr", "http://example.com/new"); err != nil {
+		t.Fatalf("Update() failed: %v", err)
+	}
+	records, err := List(ctx, db, "")
+	if err != nil {
+		t.Fatalf("List() failed: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("List() returned %d records, want 1", len(records))
+	}
+	r := records[0]
+	if r.Link.String() != "http://example.com/new" || r.Visibility != Private || r.Group != "hr" || r.CreatedBy != "alice" {
+		t.Errorf("List() returned %+v, want the new link with the old visibility and creator", r)
+	}
+	if err := Update(ctx, db, "hr", "hr", "http://example.com/new", WithVisibility("secret", "")); err != ErrInvalidVisibility {
+		t.Errorf("Update() with an invalid visibility returned err=%v, want %v", err, ErrInvalidVisibility)
+	}
+}
@@ -0,0 +1,256 @@
+// Package metrics provides counters, histograms and gauges that are exported
+// in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram buckets suitable for request latencies
+// measured in seconds.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// labelSeparator joins label values into a map key. It can't appear in valid
+// UTF-8 text.
+const labelSeparator = "\xff"
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry is a set of metrics that are exported together.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry creates an empty *Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteText writes every metric in r to w in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves the metrics in r to a Prometheus scraper.
+func (r *Registry) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := r.WriteText(resp); err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Counter is a monotonically increasing value, partitioned by labels.
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// Counter creates and registers a new *Counter.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: map[string]float64{}}
+	r.register(c)
+	return c
+}
+
+// Inc adds one to the counter for labelValues.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter for labelValues. It panics if v is negative or the
+// number of label values doesn't match the number of labels.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metrics: counter %s cannot decrease", c.name))
+	}
+	key := labelKey(c.name, c.labels, labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += v
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		writeSample(w, c.name, c.labels, key, "", "", c.values[key])
+	}
+}
+
+// Histogram counts observations in configurable buckets, partitioned by
+// labels.
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram creates and registers a new *Histogram. The buckets are upper
+// bounds and must be sorted in increasing order.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets for %s are not sorted", name))
+	}
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogramValue{}}
+	r.register(h)
+	return h
+}
+
+// Observe records v for labelValues.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := labelKey(h.name, h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hv := h.values[key]
+		for i, b := range h.buckets {
+			writeSample(w, h.name+"_bucket", h.labels, key, "le", formatFloat(b), float64(hv.counts[i]))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, key, "le", "+Inf", float64(hv.count))
+		writeSample(w, h.name+"_sum", h.labels, key, "", "", hv.sum)
+		writeSample(w, h.name+"_count", h.labels, key, "", "", float64(hv.count))
+	}
+}
+
+// funcMetric is a single unlabelled value that's computed at collection time.
+type funcMetric struct {
+	name string
+	help string
+	typ  string
+	f    func() float64
+}
+
+// GaugeFunc registers a gauge whose value is the result of calling f.
+func (r *Registry) GaugeFunc(name, help string, f func() float64) {
+	r.register(&funcMetric{name, help, "gauge", f})
+}
+
+// CounterFunc registers a counter whose value is the result of calling f. f
+// must never return a smaller value than it did before.
+func (r *Registry) CounterFunc(name, help string, f func() float64) {
+	r.register(&funcMetric{name, help, "counter", f})
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	writeHeader(w, m.name, m.help, m.typ)
+	writeSample(w, m.name, nil, "", "", "", m.f())
+}
+
+func labelKey(name string, labels, values []string) string {
+	if len(labels) != len(values) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", name, len(labels), len(values)))
+	}
+	return strings.Join(values, labelSeparator)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, helpEscaper.Replace(help), name, typ)
+}
+
+// writeSample writes one line for a metric. key holds the joined label values
+// and extraLabel, if not empty, is appended after them.
+func writeSample(w *bufio.Writer, name string, labels []string, key, extraLabel, extraValue string, v float64) {
+	w.WriteString(name)
+	var pairs []string
+	if len(labels) > 0 {
+		values := strings.Split(key, labelSeparator)
+		for i, l := range labels {
+			pairs = append(pairs, l+`="`+labelEscaper.Replace(values[i])+`"`)
+		}
+	}
+	if extraLabel != "" {
+		pairs = append(pairs, extraLabel+`="`+extraValue+`"`)
+	}
+	if len(pairs) > 0 {
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
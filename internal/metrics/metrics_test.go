@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("requests_total", "Requests served.", "route", "code")
+	c.Inc("/go/", "307")
+	c.Inc("/go/", "307")
+	c.Add(3, `/"x"`, "200")
+	h := r.Histogram("latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+	h.Observe(0.05, "/")
+	h.Observe(0.5, "/")
+	r.GaugeFunc("open_connections", "Open connections.", func() float64 { return 4 })
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatalf("WriteText() failed: %v", err)
+	}
+	want := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{route="/\"x\"",code="200"} 3
+requests_total{route="/go/",code="307"} 2
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/",le="0.1"} 1
+latency_seconds_bucket{route="/",le="1"} 2
+latency_seconds_bucket{route="/",le="+Inf"} 2
+latency_seconds_sum{route="/"} 0.55
+latency_seconds_count{route="/"} 2
+# HELP open_connections Open connections.
+# TYPE open_connections gauge
+open_connections 4
+`
+	if got := b.String(); got != want {
+		t.Errorf("WriteText() wrote:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLabelMismatchPanics(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("c", "", "a", "b")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Inc() with the wrong number of labels did not panic")
+		}
+	}()
+	c.Inc("only one")
+}
@@ -0,0 +1,97 @@
+// Package ratelimit provides token bucket rate limits for many clients in a
+// bounded amount of memory.
+package ratelimit
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter is a set of token buckets, one per key. Buckets start full and
+// refill at a constant rate. Only the most recently used keys are tracked;
+// the least recently used bucket is forgotten when there are too many.
+//
+// A nil *Limiter allows everything.
+type Limiter struct {
+	rate    float64
+	burst   float64
+	maxKeys int
+	now     func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// New creates a *Limiter that allows rate events per second with bursts of up
+// to burst events, for each of up to maxKeys keys. It returns nil, which
+// allows everything, if rate is not positive.
+func New(rate float64, burst, maxKeys int) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	if maxKeys < 1 {
+		maxKeys = 1
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		maxKeys: maxKeys,
+		now:     time.Now,
+		buckets: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// Allow takes a token from the bucket for key. If the bucket is empty it
+// returns false and how long it will be until there's a token.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var b *bucket
+	if e, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*bucket)
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	} else {
+		b = &bucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+		for l.lru.Len() > l.maxKeys {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*bucket).key)
+		}
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// Len returns the number of keys being tracked.
+func (l *Limiter) Len() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lru.Len()
+}
@@ -0,0 +1,58 @@
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	l := New(2, 3, 10)
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("Allow() #%d within the burst returned false, want true", i)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok {
+		t.Fatalf("Allow() after the burst returned true, want false")
+	}
+	if want := 500 * time.Millisecond; wait != want {
+		t.Errorf("Allow() returned wait=%v, want %v", wait, want)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Errorf("Allow() for another key returned false, want true")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Errorf("Allow() after refilling returned false, want true")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Errorf("Allow() after using the refilled token returned true, want false")
+	}
+}
+
+func TestBoundedKeys(t *testing.T) {
+	l := New(1, 1, 3)
+	for i := 0; i < 100; i++ {
+		l.Allow(fmt.Sprint(i))
+	}
+	if got, want := l.Len(), 3; got != want {
+		t.Errorf("Len()=%v, want %v", got, want)
+	}
+	// The most recent keys are still limited.
+	if ok, _ := l.Allow("99"); ok {
+		t.Errorf("Allow(%q) returned true, want false", "99")
+	}
+}
+
+func TestNilAllowsEverything(t *testing.T) {
+	l := New(0, 0, 0)
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("Allow() on a disabled limiter returned false, want true")
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spwg/golink/internal/forwarded"
+)
+
+// sensitiveHeaders are never written to the logs verbatim.
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Cookie":              true,
+	"Proxy-Authorization": true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+}
+
+type requestInfoKey struct{}
+
+// requestInfo holds details about a request that handlers fill in so that they
+// can be reported once the request is done.
+type requestInfo struct {
+	id       string
+	origin   forwarded.Origin
+	route    string
+	linkName string
+}
+
+// infoFromContext returns the *requestInfo for the request that ctx belongs
+// to. It never returns nil so handlers can use it without checking.
+func infoFromContext(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// setLinkName records the name of the link that a request looked up, whether
+// or not it resolved.
+func setLinkName(ctx context.Context, name string) {
+	infoFromContext(ctx).linkName = name
+}
+
+// statusWriter records the status code and the number of bytes of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// accessLogHandler works out the origin of each request with proxies and
+// writes one structured log line per request to logger. Request headers are
+// only logged at debug level and sensitive values are redacted.
+func accessLogHandler(logger *slog.Logger, proxies *forwarded.Resolver, h http.Handler) http.Handler {
+	fn := func(resp http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		info := &requestInfo{id: requestID(req), origin: proxies.Resolve(req)}
+		resp.Header().Set("X-Request-Id", info.id)
+		sw := &statusWriter{ResponseWriter: resp}
+		req = req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, info))
+		h.ServeHTTP(sw, req)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		attrs := []slog.Attr{
+			slog.String("request_id", info.id),
+			slog.String("method", req.Method),
+			slog.String("host", req.Host),
+			slog.String("path", req.URL.Path),
+			slog.Int("status", sw.status),
+			slog.Int64("bytes", sw.bytes),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("client_ip", info.origin.ClientIP.String()),
+			slog.String("proto", info.origin.Proto),
+			slog.String("remote_addr", req.RemoteAddr),
+		}
+		if info.route != "" {
+			attrs = append(attrs, slog.String("route", info.route))
+		}
+		if info.linkName != "" {
+			attrs = append(attrs, slog.String("link", info.linkName))
+		}
+		ctx := req.Context()
+		if logger.Enabled(ctx, slog.LevelDebug) {
+			attrs = append(attrs, slog.Any("headers", redactHeaders(req.Header)))
+		}
+		logger.LogAttrs(ctx, slog.LevelInfo, "http request", attrs...)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// requestID returns the request ID supplied by the client or a proxy, or a new
+// random one if there isn't a usable one.
+func requestID(req *http.Request) string {
+	if id := req.Header.Get("X-Request-Id"); id != "" && len(id) <= 128 && isPrintable(id) {
+		return id
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+func isPrintable(s string) bool {
+	for _, c := range s {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// redactHeaders returns a copy of h that is safe to log.
+func redactHeaders(h http.Header) map[string]string {
+	m := make(map[string]string, len(h))
+	for k, v := range h {
+		if sensitiveHeaders[http.CanonicalHeaderKey(k)] {
+			m[k] = "REDACTED"
+			continue
+		}
+		m[k] = strings.Join(v, ", ")
+	}
+	return m
+}
@@ -0,0 +1,432 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spwg/golink/internal/link"
+)
+
+// apiLinksPath is the collection of links in the JSON API. A link is at
+// apiLinksPath/<name>.
+const apiLinksPath = "/api/v1/links"
+
+// apiLink is the JSON form of a link.
+type apiLink struct {
+	Name        string     `json:"name"`
+	URL         string     `json:"url"`
+	Description string     `json:"description"`
+	Tags        []string   `json:"tags"`
+	Visibility  string     `json:"visibility"`
+	Group       string     `json:"group,omitempty"`
+	NotBefore   *time.Time `json:"not_before,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	CreatedBy   string     `json:"created_by,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	UpdatedBy   string     `json:"updated_by,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+	// RedirectCode is the status code of redirects to the link.
+	RedirectCode int `json:"redirect_code"`
+	// CacheMaxAge is how many seconds clients may cache redirects for.
+	CacheMaxAge int64 `json:"cache_max_age"`
+	Revision    int64 `json:"revision"`
+}
+
+func newAPILink(r *link.Record) *apiLink {
+	timeOrNil := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+	return &apiLink{
+		Name:         r.Name,
+		URL:          r.Link.String(),
+		Description:  r.Description,
+		Tags:         r.Tags,
+		Visibility:   string(r.Visibility),
+		Group:        r.Group,
+		NotBefore:    timeOrNil(r.NotBefore),
+		ExpiresAt:    timeOrNil(r.ExpiresAt),
+		CreatedBy:    r.CreatedBy,
+		CreatedAt:    timeOrNil(r.CreatedAt),
+		UpdatedBy:    r.UpdatedBy,
+		UpdatedAt:    timeOrNil(r.UpdatedAt),
+		RedirectCode: r.RedirectStatus(),
+		CacheMaxAge:  int64(r.CacheMaxAge / time.Second),
+		Revision:     r.Revision,
+	}
+}
+
+// record converts a to a *link.Record.
+func (a *apiLink) record() (*link.Record, error) {
+	u, err := url.Parse(a.URL)
+	if err != nil {
+		return nil, fmt.Errorf("%q has an invalid url: %w", a.Name, err)
+	}
+	timeOrZero := func(t *time.Time) time.Time {
+		if t == nil {
+			return time.Time{}
+		}
+		return t.UTC()
+	}
+	tags := a.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return &link.Record{
+		Name:         a.Name,
+		Link:         u,
+		CreatedBy:    a.CreatedBy,
+		Visibility:   link.Visibility(a.Visibility),
+		Group:        a.Group,
+		NotBefore:    timeOrZero(a.NotBefore),
+		ExpiresAt:    timeOrZero(a.ExpiresAt),
+		Description:  a.Description,
+		Tags:         tags,
+		CreatedAt:    timeOrZero(a.CreatedAt),
+		UpdatedAt:    timeOrZero(a.UpdatedAt),
+		UpdatedBy:    a.UpdatedBy,
+		RedirectCode: a.RedirectCode,
+		CacheMaxAge:  time.Duration(a.CacheMaxAge) * time.Second,
+	}, nil
+}
+
+// apiLinkChange is the body of a request that creates or updates a link.
+// Fields that are missing from an update are left as they are; a zero time
+// clears not_before or expires_at.
+type apiLinkChange struct {
+	Name         *string    `json:"name"`
+	URL          *string    `json:"url"`
+	Description  *string    `json:"description"`
+	Tags         *[]string  `json:"tags"`
+	Visibility   *string    `json:"visibility"`
+	Group        *string    `json:"group"`
+	NotBefore    *time.Time `json:"not_before"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	RedirectCode *int       `json:"redirect_code"`
+	CacheMaxAge  *int64     `json:"cache_max_age"`
+}
+
+// options returns the link options for the fields of c other than the name
+// and the URL. current is the link being updated, or nil.
+func (c *apiLinkChange) options(current *link.Record, owner string) ([]link.Option, error) {
+	var opts []link.Option
+	if c.Visibility != nil || c.Group != nil {
+		v, group := link.Public, ""
+		if current != nil {
+			v, group = current.Visibility, current.Group
+		}
+		if c.Visibility != nil {
+			var err error
+			if v, err = link.ParseVisibility(*c.Visibility); err != nil {
+				return nil, err
+			}
+		}
+		if c.Group != nil {
+			group = strings.TrimSpace(*c.Group)
+		}
+		if v == link.Private && owner == "" && group == "" {
+			return nil, errPrivateWithoutOwner
+		}
+		opts = append(opts, link.WithVisibility(v, group))
+	}
+	if c.NotBefore != nil || c.ExpiresAt != nil {
+		var notBefore, expiresAt time.Time
+		if current != nil {
+			notBefore, expiresAt = current.NotBefore, current.ExpiresAt
+		}
+		if c.NotBefore != nil {
+			notBefore = *c.NotBefore
+		}
+		if c.ExpiresAt != nil {
+			expiresAt = *c.ExpiresAt
+		}
+		opts = append(opts, link.WithSchedule(notBefore, expiresAt))
+	}
+	if c.Description != nil {
+		opts = append(opts, link.WithDescription(description(*c.Description)))
+	}
+	if c.Tags != nil {
+		opts = append(opts, link.WithTags(*c.Tags))
+	}
+	if c.RedirectCode != nil || c.CacheMaxAge != nil {
+		var code int
+		var maxAge time.Duration
+		if current != nil {
+			code, maxAge = current.RedirectCode, current.CacheMaxAge
+		}
+		if c.RedirectCode != nil {
+			code = *c.RedirectCode
+		}
+		if c.CacheMaxAge != nil {
+			maxAge = time.Duration(*c.CacheMaxAge) * time.Second
+		}
+		opts = append(opts, link.WithRedirect(code, maxAge))
+	}
+	return opts, nil
+}
+
+// errPrivateWithoutOwner means that nobody would be able to use a private
+// link.
+var errPrivateWithoutOwner = errors.New("a private link needs a signed-in owner or a group")
+
+// apiLinksHandler serves the links in the JSON API:
+//
+//	GET    /api/v1/links[?tag=<tag>]  lists links
+//	POST   /api/v1/links              creates a link
+//	GET    /api/v1/links/<name>       reads a link
+//	PATCH  /api/v1/links/<name>       updates a link
+//	DELETE /api/v1/links/<name>       moves a link to the trash
+func (gl *GoLink) apiLinksHandler(resp http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, apiLinksPath), "/")
+	switch {
+	case name == "" && req.Method == http.MethodGet:
+		gl.apiList(resp, req)
+	case name == "" && req.Method == http.MethodPost:
+		gl.limit(gl.writeLimit, gl.apiCreate)(resp, req)
+	case name != "" && req.Method == http.MethodGet:
+		gl.apiRead(resp, req, name)
+	case name != "" && (req.Method == http.MethodPatch || req.Method == http.MethodPut):
+		gl.limit(gl.writeLimit, func(resp http.ResponseWriter, req *http.Request) { gl.apiUpdate(resp, req, name) })(resp, req)
+	case name != "" && req.Method == http.MethodDelete:
+		gl.limit(gl.writeLimit, func(resp http.ResponseWriter, req *http.Request) { gl.apiDelete(resp, req, name) })(resp, req)
+	default:
+		writeAPIError(resp, http.StatusMethodNotAllowed, req.Method+" method not supported")
+	}
+}
+
+func (gl *GoLink) apiList(resp http.ResponseWriter, req *http.Request) {
+	done := gl.metrics.timeQuery("list")
+	all, err := link.List(req.Context(), gl.db, strings.ToLower(req.URL.Query().Get("tag")))
+	done()
+	if err != nil {
+		gl.apiLinkError(resp, err)
+		return
+	}
+	user, groups, mirror := gl.user(req), gl.groups(req), gl.fromMirror(req)
+	links := []*apiLink{}
+	for _, l := range all {
+		if mirror || l.ListedFor(user, groups) {
+			links = append(links, newAPILink(l))
+		}
+	}
+	writeJSON(resp, http.StatusOK, struct {
+		Links []*apiLink `json:"links"`
+	}{links})
+}
+
+func (gl *GoLink) apiRead(resp http.ResponseWriter, req *http.Request, name string) {
+	var r *link.Record
+	var err error
+	if gl.fromMirror(req) {
+		r, err = link.Read(req.Context(), gl.db, name)
+	} else {
+		r, err = gl.visibleLink(req, name)
+	}
+	if err != nil {
+		gl.apiLinkError(resp, err)
+		return
+	}
+	etag := revisionETag(r.Revision)
+	resp.Header().Set("ETag", etag)
+	if req.Method == http.MethodGet && req.Header.Get("If-None-Match") == etag {
+		resp.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(resp, http.StatusOK, newAPILink(r))
+}
+
+// revisionETag returns the entity tag of a link at revision.
+func revisionETag(revision int64) string {
+	return `"` + strconv.FormatInt(revision, 10) + `"`
+}
+
+// ifMatch reads the If-Match header of req, which holds the ETag of the link
+// that the client read, into an option that makes a change fail with
+// link.ErrConflict if the link has changed since. It responds with an error
+// and returns false if the header can't match any revision.
+func ifMatch(resp http.ResponseWriter, req *http.Request) ([]link.Option, bool) {
+	h := strings.TrimSpace(req.Header.Get("If-Match"))
+	if h == "" || h == "*" {
+		return nil, true
+	}
+	s, ok := strings.CutPrefix(h, `"`)
+	if ok {
+		s, ok = strings.CutSuffix(s, `"`)
+	}
+	revision, err := strconv.ParseInt(s, 10, 64)
+	if !ok || err != nil {
+		writeAPIError(resp, http.StatusPreconditionFailed, fmt.Sprintf("If-Match %s is not the ETag of a link", h))
+		return nil, false
+	}
+	return []link.Option{link.IfRevision(revision)}, true
+}
+
+func (gl *GoLink) apiCreate(resp http.ResponseWriter, req *http.Request) {
+	var c apiLinkChange
+	if !readJSON(resp, req, &c) {
+		return
+	}
+	if c.Name == nil || c.URL == nil {
+		writeAPIError(resp, http.StatusBadRequest, "name and url are required")
+		return
+	}
+	name, err := link.ParseName(*c.Name)
+	if err != nil {
+		gl.apiLinkError(resp, err)
+		return
+	}
+	user := gl.user(req)
+	opts, err := c.options(nil, user)
+	if err == nil {
+		err = gl.createLink(req.Context(), user, name, *c.URL, opts...)
+	}
+	if err != nil {
+		gl.apiLinkError(resp, err)
+		return
+	}
+	r, err := link.Read(req.Context(), gl.db, name)
+	if err != nil {
+		gl.apiLinkError(resp, err)
+		return
+	}
+	resp.Header().Set("Location", apiLinksPath+"/"+url.PathEscape(name))
+	resp.Header().Set("ETag", revisionETag(r.Revision))
+	writeJSON(resp, http.StatusCreated, newAPILink(r))
+}
+
+func (gl *GoLink) apiUpdate(resp http.ResponseWriter, req *http.Request, name string) {
+	var c apiLinkChange
+	if !readJSON(resp, req, &c) {
+		return
+	}
+	ifRevision, ok := ifMatch(resp, req)
+	if !ok {
+		return
+	}
+	r, err := gl.visibleLink(req, name)
+	if err != nil {
+		gl.apiLinkError(resp, err)
+		return
+	}
+	newName, address := r.Name, r.Link.String()
+	if c.Name != nil {
+		if newName, err = link.ParseName(*c.Name); err != nil {
+			gl.apiLinkError(resp, err)
+			return
+		}
+	}
+	if c.URL != nil {
+		address = *c.URL
+	}
+	opts, err := c.options(r, r.CreatedBy)
+	if err == nil {
+		opts = append(append(opts, ifRevision...), link.UpdatedBy(gl.user(req)))
+		err = gl.updateLink(req.Context(), name, newName, address, opts...)
+	}
+	if err != nil {
+		gl.apiLinkError(resp, err)
+		return
+	}
+	gl.apiRead(resp, req, newName)
+}
+
+func (gl *GoLink) apiDelete(resp http.ResponseWriter, req *http.Request, name string) {
+	ifRevision, ok := ifMatch(resp, req)
+	if !ok {
+		return
+	}
+	_, err := gl.visibleLink(req, name)
+	if err == nil {
+		err = gl.deleteLink(req.Context(), name, gl.user(req), ifRevision...)
+	}
+	if err != nil {
+		gl.apiLinkError(resp, err)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// apiLinkError responds with the status that fits err.
+func (gl *GoLink) apiLinkError(resp http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, link.ErrNotFound):
+		writeAPIError(resp, http.StatusNotFound, err.Error())
+	case errors.Is(err, link.ErrAlreadyExists):
+		writeAPIError(resp, http.StatusConflict, err.Error())
+	case errors.Is(err, link.ErrConflict):
+		writeAPIError(resp, http.StatusPreconditionFailed, err.Error())
+	case errors.Is(err, errLinkQuota):
+		writeAPIError(resp, http.StatusForbidden, err.Error())
+	case errors.Is(err, link.ErrInvalidLinkName),
+		errors.Is(err, link.ErrUnparseableAddress),
+		errors.Is(err, link.ErrInvalidVisibility),
+		errors.Is(err, link.ErrInvalidSchedule),
+		errors.Is(err, link.ErrInvalidTag),
+		errors.Is(err, link.ErrInvalidRedirect),
+		errors.Is(err, errPrivateWithoutOwner):
+		writeAPIError(resp, http.StatusBadRequest, err.Error())
+	default:
+		log.Printf("API request failed: %v", err)
+		writeAPIError(resp, http.StatusInternalServerError, "internal error")
+	}
+}
+
+// maxAPIBody limits the size of API request bodies.
+const maxAPIBody = 64 << 10
+
+// readJSON decodes the body of req into v. It responds with an error and
+// returns false if it can't.
+func readJSON(resp http.ResponseWriter, req *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(resp, req.Body, maxAPIBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeAPIError(resp, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// getJSON sends req with client and decodes the JSON response into v. It
+// returns the status code, and an error unless it's 200 OK.
+func getJSON(client *http.Client, req *http.Request, v any) (int, error) {
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("%s %s returned %s: %s", req.Method, req.URL, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return resp.StatusCode, fmt.Errorf("%s %s returned invalid JSON: %w", req.Method, req.URL, err)
+	}
+	return resp.StatusCode, nil
+}
+
+func writeJSON(resp http.ResponseWriter, code int, v any) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(code)
+	enc := json.NewEncoder(resp)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Failed to write JSON response: %v", err)
+	}
+}
+
+func writeAPIError(resp http.ResponseWriter, code int, msg string) {
+	writeJSON(resp, code, struct {
+		Error string `json:"error"`
+	}{msg})
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spwg/golink/internal/datastore"
+)
+
+const (
+	defaultBackupInterval  = 6 * time.Hour
+	defaultBackupRetention = 7 * 24 * time.Hour
+	// backupWriteTimeout is how long a download of a backup may take, which
+	// is longer than Options.WriteTimeout for large databases.
+	backupWriteTimeout = 10 * time.Minute
+)
+
+// hasBearerToken reports whether req carries token as its bearer token. It's
+// false for every request if token is empty.
+func hasBearerToken(req *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// backupHandler serves a consistent copy of the database to requests with
+// Options.AdminToken, without stopping the service:
+//
+//	curl -H "Authorization: Bearer $ADMIN_TOKEN" -o golink.db https://go.example.com/admin/backup
+func (gl *GoLink) backupHandler(resp http.ResponseWriter, req *http.Request) {
+	if gl.opts.AdminToken == "" {
+		http.NotFound(resp, req)
+		return
+	}
+	if !hasBearerToken(req, gl.opts.AdminToken) {
+		resp.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(resp, "An admin token is required.", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(resp, req.Method+" method not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	f, err := os.CreateTemp("", "golink-backup-*.db")
+	if err != nil {
+		log.Printf("Failed to create a backup file: %v", err)
+		http.Error(resp, "Failed to back up the database.", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	now := time.Now()
+	done := gl.metrics.timeQuery("backup")
+	err = datastore.Backup(req.Context(), gl.db, f.Name())
+	done()
+	if err != nil {
+		log.Printf("Failed to back up the database: %v", err)
+		http.Error(resp, "Failed to back up the database.", http.StatusInternalServerError)
+		return
+	}
+	if f, err = os.Open(f.Name()); err != nil {
+		log.Printf("Failed to open the backup: %v", err)
+		http.Error(resp, "Failed to back up the database.", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	log.Printf("Serving a backup of the database to %s", infoFromContext(req.Context()).origin.ClientIP)
+	http.NewResponseController(resp).SetWriteDeadline(time.Now().Add(backupWriteTimeout))
+	name := "golink-" + now.UTC().Format("20060102T150405Z") + ".db"
+	resp.Header().Set("Content-Type", "application/vnd.sqlite3")
+	resp.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	resp.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(resp, req, name, now, f)
+}
+
+// snapshot backs the database up to Options.BackupDir every
+// Options.BackupInterval, and deletes snapshots older than
+// Options.BackupRetention, until ctx is done.
+func (gl *GoLink) snapshot(ctx context.Context) {
+	log.Printf("Backing up the database to %s every %v", gl.opts.BackupDir, gl.opts.BackupInterval)
+	t := time.NewTicker(gl.opts.BackupInterval)
+	defer t.Stop()
+	for {
+		now := time.Now()
+		done := gl.metrics.timeQuery("snapshot")
+		path, err := datastore.Snapshot(ctx, gl.db, gl.opts.BackupDir, now)
+		done()
+		switch {
+		case err != nil && ctx.Err() == nil:
+			log.Printf("Failed to back up the database: %v", err)
+		case err == nil:
+			log.Printf("Backed up the database to %s", path)
+			gl.backedUp.Store(now.Unix())
+			n, err := datastore.PruneSnapshots(gl.opts.BackupDir, now.Add(-gl.opts.BackupRetention))
+			switch {
+			case err != nil:
+				log.Printf("Failed to delete old backups: %v", err)
+			case n > 0:
+				log.Printf("Deleted %d old backups", n)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
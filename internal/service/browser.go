@@ -0,0 +1,62 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// searchHandler resolves searches like "gh golink" that browsers send when
+// the service is registered as a search engine. The first word is the link
+// name and the rest are the arguments to the link.
+func (gl *GoLink) searchHandler(resp http.ResponseWriter, req *http.Request) {
+	fields := strings.Fields(req.URL.Query().Get("q"))
+	if len(fields) == 0 {
+		http.Redirect(resp, req, "/", http.StatusSeeOther)
+		return
+	}
+	name := fields[0]
+	args := strings.Join(fields[1:], " ")
+	gl.redirectToLink(resp, req, name, args)
+}
+
+// proxyPACHandler serves a proxy auto-config file that sends plain http
+// requests for the short host names to the service and everything else
+// direct, so that go/name works without editing /etc/hosts.
+func (gl *GoLink) proxyPACHandler(resp http.ResponseWriter, req *http.Request) {
+	proxy := gl.opts.BaseURL.Host
+	if gl.opts.BaseURL.Port() == "" {
+		proxy = net.JoinHostPort(gl.opts.BaseURL.Hostname(), "80")
+	}
+	var conds []string
+	for _, h := range gl.opts.ShortHosts {
+		conds = append(conds, fmt.Sprintf("host === %q", strings.ToLower(h)))
+	}
+	if len(conds) == 0 {
+		conds = []string{"false"}
+	}
+	resp.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	const pac = `function FindProxyForURL(url, host) {
+    if ((%s) && url.substring(0, 5) === "http:") {
+        return %q;
+    }
+    return "DIRECT";
+}
+`
+	if _, err := fmt.Fprintf(resp, pac, strings.Join(conds, " || "), "PROXY "+proxy); err != nil {
+		log.Printf("Failed to write proxy.pac: %v", err)
+	}
+}
+
+// openSearchHandler serves the OpenSearch description that lets browsers add
+// the service as a search engine.
+func (gl *GoLink) openSearchHandler(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "application/opensearchdescription+xml")
+	data := struct{ BaseURL string }{gl.baseURL}
+	if err := openSearchTemplate.ExecuteTemplate(resp, "opensearch.tmpl.xml", data); err != nil {
+		log.Printf("Failed to render opensearch.xml: %v", err)
+		http.Error(resp, "Unable to render opensearch.xml.", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,313 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spwg/golink/internal/link"
+)
+
+const (
+	defaultChangePollInterval = time.Second
+	defaultChangeRetention    = 7 * 24 * time.Hour
+	// maxChangesPerRead bounds the changes read from the database at once.
+	maxChangesPerRead = 1000
+	// defaultChangesWait and maxChangesWait are how long a long-poll for
+	// changes waits by default and at most.
+	defaultChangesWait = 30 * time.Second
+	maxChangesWait     = time.Minute
+	// streamHeartbeat is how often a stream of changes without any is sent a
+	// comment, so that proxies don't time it out.
+	streamHeartbeat = 15 * time.Second
+)
+
+// changeFeed tells waiters when the log of changes has advanced. It's fed by
+// followChanges, and poked by changes made in this process so that they're
+// picked up at once rather than at the next poll.
+type changeFeed struct {
+	poked chan struct{}
+	done  chan struct{}
+	close func()
+
+	mu sync.Mutex
+	// advanced is closed, and replaced, when the log advances.
+	advanced chan struct{}
+}
+
+func newChangeFeed() *changeFeed {
+	done := make(chan struct{})
+	return &changeFeed{
+		poked:    make(chan struct{}, 1),
+		done:     done,
+		close:    sync.OnceFunc(func() { close(done) }),
+		advanced: make(chan struct{}),
+	}
+}
+
+// next returns a channel that's closed when the log next advances.
+func (f *changeFeed) next() <-chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.advanced
+}
+
+// advance wakes everyone waiting for the log to advance.
+func (f *changeFeed) advance() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	close(f.advanced)
+	f.advanced = make(chan struct{})
+}
+
+// poke asks followChanges to read the log now.
+func (f *changeFeed) poke() {
+	select {
+	case f.poked <- struct{}{}:
+	default:
+	}
+}
+
+// changed forgets what's known about the links called names after they were
+// changed in this process.
+func (gl *GoLink) changed(names ...string) {
+	gl.resolved.Remove(names...)
+	gl.changes.poke()
+}
+
+// followChanges reads the log of changes every Options.ChangePollInterval, and
+// when poked, until ctx is done. It forgets the links that other replicas
+// changed and wakes the requests that are waiting for changes.
+func (gl *GoLink) followChanges(ctx context.Context) {
+	t := time.NewTicker(gl.opts.ChangePollInterval)
+	defer t.Stop()
+	since := int64(-1)
+	for {
+		since = gl.applyChanges(ctx, since)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-gl.changes.poked:
+		}
+	}
+}
+
+// applyChanges applies the changes after revision since, or starts over from
+// the latest revision if since is negative. It returns the revision that it
+// got to.
+func (gl *GoLink) applyChanges(ctx context.Context, since int64) int64 {
+	if since < 0 {
+		latest, err := link.LatestRevision(ctx, gl.db)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to follow changes: %v", err)
+			}
+			return since
+		}
+		// Links cached before now may have changed before latest.
+		gl.resolved.Clear()
+		return latest
+	}
+	for {
+		changes, err := link.Changes(ctx, gl.db, since, maxChangesPerRead)
+		if errors.Is(err, link.ErrChangesPruned) {
+			// This replica fell so far behind that it can't tell what changed.
+			log.Printf("Changes after revision %d were pruned, starting over", since)
+			gl.changes.advance()
+			return gl.applyChanges(ctx, -1)
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to follow changes: %v", err)
+			}
+			return since
+		}
+		if len(changes) == 0 {
+			return since
+		}
+		for _, c := range changes {
+			gl.resolved.Remove(c.Name)
+		}
+		since = changes[len(changes)-1].Revision
+		gl.changes.advance()
+		if len(changes) < maxChangesPerRead {
+			return since
+		}
+	}
+}
+
+// apiChange is the JSON form of a change.
+type apiChange struct {
+	Revision  int64     `json:"revision"`
+	Name      string    `json:"name"`
+	Op        link.Op   `json:"op"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// apiChanges is a response to a long-poll for changes. Revision is what to
+// ask for changes since next time.
+type apiChanges struct {
+	Revision int64        `json:"revision"`
+	Changes  []*apiChange `json:"changes"`
+}
+
+// changesHandler serves the log of changes to links:
+//
+//	GET /api/v1/changes                     the latest revision
+//	GET /api/v1/changes?since=<revision>    changes after revision
+//
+// A request for changes waits up to ?wait=<duration> for one if there are
+// none yet. With Accept: text/event-stream it streams them as server-sent
+// events instead, starting after ?since= or Last-Event-ID. If changes since
+// the revision have been pruned it responds 410 Gone, and the client has to
+// start over from the latest revision.
+func (gl *GoLink) changesHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeAPIError(resp, http.StatusMethodNotAllowed, req.Method+" method not supported")
+		return
+	}
+	q := req.URL.Query()
+	sinceStr := q.Get("since")
+	if sinceStr == "" {
+		sinceStr = req.Header.Get("Last-Event-ID")
+	}
+	if sinceStr == "" {
+		latest, err := link.LatestRevision(req.Context(), gl.db)
+		if err != nil {
+			gl.apiLinkError(resp, err)
+			return
+		}
+		writeJSON(resp, http.StatusOK, apiChanges{Revision: latest, Changes: []*apiChange{}})
+		return
+	}
+	since, err := strconv.ParseInt(sinceStr, 10, 64)
+	if err != nil || since < 0 {
+		writeAPIError(resp, http.StatusBadRequest, fmt.Sprintf("invalid revision %q", sinceStr))
+		return
+	}
+	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		gl.streamChanges(resp, req, since)
+		return
+	}
+	wait := defaultChangesWait
+	if s := q.Get("wait"); s != "" {
+		if wait, err = time.ParseDuration(s); err != nil || wait < 0 {
+			writeAPIError(resp, http.StatusBadRequest, fmt.Sprintf("invalid wait %q", s))
+			return
+		}
+		wait = min(wait, maxChangesWait)
+	}
+	// Long-polls outlive Options.WriteTimeout.
+	http.NewResponseController(resp).SetWriteDeadline(time.Now().Add(wait + 10*time.Second))
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		// Wait for the next advance from before reading, so that none is
+		// missed.
+		next := gl.changes.next()
+		changes, err := link.Changes(req.Context(), gl.db, since, maxChangesPerRead)
+		if err != nil {
+			gl.changesError(resp, err)
+			return
+		}
+		if len(changes) > 0 {
+			writeJSON(resp, http.StatusOK, apiChanges{
+				Revision: changes[len(changes)-1].Revision,
+				Changes:  gl.visibleChanges(req, changes),
+			})
+			return
+		}
+		select {
+		case <-next:
+			continue
+		case <-timeout.C:
+		case <-gl.changes.done:
+		case <-req.Context().Done():
+		}
+		writeJSON(resp, http.StatusOK, apiChanges{Revision: since, Changes: []*apiChange{}})
+		return
+	}
+}
+
+// streamChanges sends the changes after revision since as server-sent events
+// until the client goes away or the service shuts down.
+func (gl *GoLink) streamChanges(resp http.ResponseWriter, req *http.Request, since int64) {
+	rc := http.NewResponseController(resp)
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.WriteHeader(http.StatusOK)
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		next := gl.changes.next()
+		changes, err := link.Changes(req.Context(), gl.db, since, maxChangesPerRead)
+		if errors.Is(err, link.ErrChangesPruned) {
+			fmt.Fprint(resp, "event: reset\ndata: {}\n\n")
+			rc.Flush()
+			return
+		}
+		if err != nil {
+			if req.Context().Err() == nil {
+				log.Printf("Failed to stream changes: %v", err)
+			}
+			return
+		}
+		// Streams outlive Options.WriteTimeout.
+		rc.SetWriteDeadline(time.Now().Add(2 * streamHeartbeat))
+		for _, c := range gl.visibleChanges(req, changes) {
+			data, err := json.Marshal(c)
+			if err != nil {
+				log.Printf("Failed to encode change %d: %v", c.Revision, err)
+				return
+			}
+			fmt.Fprintf(resp, "id: %d\nevent: change\ndata: %s\n\n", c.Revision, data)
+		}
+		if len(changes) > 0 {
+			since = changes[len(changes)-1].Revision
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		if len(changes) == maxChangesPerRead {
+			continue
+		}
+		select {
+		case <-next:
+		case <-heartbeat.C:
+			rc.SetWriteDeadline(time.Now().Add(2 * streamHeartbeat))
+			fmt.Fprint(resp, ": keep-alive\n\n")
+		case <-gl.changes.done:
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// visibleChanges returns the changes that the user of req can see.
+func (gl *GoLink) visibleChanges(req *http.Request, changes []*link.Change) []*apiChange {
+	user, groups, mirror := gl.user(req), gl.groups(req), gl.fromMirror(req)
+	visible := []*apiChange{}
+	for _, c := range changes {
+		if mirror || c.VisibleTo(user, groups) {
+			visible = append(visible, &apiChange{Revision: c.Revision, Name: c.Name, Op: c.Op, ChangedAt: c.ChangedAt})
+		}
+	}
+	return visible
+}
+
+func (gl *GoLink) changesError(resp http.ResponseWriter, err error) {
+	if errors.Is(err, link.ErrChangesPruned) {
+		writeAPIError(resp, http.StatusGone, "changes since the revision have been pruned, start over from the latest revision")
+		return
+	}
+	gl.apiLinkError(resp, err)
+}
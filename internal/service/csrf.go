@@ -0,0 +1,101 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+)
+
+const (
+	// csrfCookie holds the CSRF token of a browser session.
+	csrfCookie = "golink_csrf"
+	// csrfField is the form field that pages echo the token back in.
+	csrfField = "csrf_token"
+)
+
+// csrfToken returns the CSRF token of the browser that made req, setting a
+// session cookie with a new one if it doesn't have one yet. Pages put the
+// token in their forms so that csrfProtect can check it.
+func (gl *GoLink) csrfToken(resp http.ResponseWriter, req *http.Request) string {
+	if c, err := req.Cookie(csrfCookie); err == nil && len(c.Value) == 64 {
+		return c.Value
+	}
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Printf("Failed to generate a CSRF token: %v", err)
+		return ""
+	}
+	token := hex.EncodeToString(b[:])
+	http.SetCookie(resp, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   infoFromContext(req.Context()).origin.Proto == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token
+}
+
+// csrfProtect rejects state-changing requests that another website could
+// have made the browser send. Browsers say where a request came from in
+// Sec-Fetch-Site or Origin, and a request from one of our forms carries the
+// token from the session cookie. Requests with an Authorization header are
+// API calls, which browsers can't forge across sites, so they're let through.
+// So are same-origin requests that no html form can make, like JSON bodies or
+// DELETE: across sites they need a CORS preflight, which the service never
+// grants.
+func (gl *GoLink) csrfProtect(h http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			h(resp, req)
+			return
+		}
+		if req.Header.Get("Authorization") != "" {
+			h(resp, req)
+			return
+		}
+		switch req.Header.Get("Sec-Fetch-Site") {
+		case "", "same-origin", "none":
+		default:
+			http.Error(resp, "Cross-site requests are not allowed.", http.StatusForbidden)
+			return
+		}
+		if origin := req.Header.Get("Origin"); origin != "" && !gl.sameOrigin(origin, req) {
+			http.Error(resp, "Cross-origin requests are not allowed.", http.StatusForbidden)
+			return
+		}
+		if mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mt == "application/json" || req.Method != http.MethodPost {
+			h(resp, req)
+			return
+		}
+		c, err := req.Cookie(csrfCookie)
+		if err != nil || c.Value == "" {
+			http.Error(resp, "Missing CSRF cookie, reload the page and try again.", http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(c.Value), []byte(req.PostFormValue(csrfField))) != 1 {
+			http.Error(resp, "Invalid CSRF token, reload the page and try again.", http.StatusForbidden)
+			return
+		}
+		h(resp, req)
+	}
+}
+
+// sameOrigin reports whether the Origin header value origin is the service
+// itself, either Options.BaseURL or the host that req was sent to.
+func (gl *GoLink) sameOrigin(origin string, req *http.Request) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if u.Scheme == gl.opts.BaseURL.Scheme && u.Host == gl.opts.BaseURL.Host {
+		return true
+	}
+	return u.Host == req.Host
+}
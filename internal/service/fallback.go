@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spwg/golink/internal/link"
+)
+
+const (
+	defaultFallbackTTL     = time.Minute
+	defaultFallbackTimeout = 2 * time.Second
+	// hopsHeader marks the lookups that a server makes on its fallbacks. The
+	// API answers every lookup from the server's own links and never asks
+	// its fallbacks in turn, so lookups can't go around a loop of fallbacks
+	// and clients can't use a server to reach its fallbacks.
+	hopsHeader = "Golink-Hops"
+)
+
+// fallback asks Options.Fallbacks in turn for the link called name. It
+// returns nil if none of them has the link. Answers are cached for
+// Options.FallbackTTL, except when a fallback couldn't be asked.
+func (gl *GoLink) fallback(ctx context.Context, name string) *link.Record {
+	if len(gl.opts.Fallbacks) == 0 {
+		return nil
+	}
+	if r, ok := gl.fallbacks.Get(name); ok {
+		return r
+	}
+	done := gl.metrics.timeQuery("fallback")
+	defer done()
+	failed := false
+	for _, u := range gl.opts.Fallbacks {
+		r, err := gl.askFallback(ctx, u, name)
+		if err != nil {
+			log.Printf("Failed to look up %q in fallback %s: %v", name, u, err)
+			failed = true
+			continue
+		}
+		if r != nil {
+			gl.fallbacks.Add(name, r)
+			return r
+		}
+	}
+	if !failed {
+		gl.fallbacks.Add(name, nil)
+	}
+	return nil
+}
+
+// askFallback looks up the link called name on the golink server at base. It
+// returns nil if the server doesn't have it.
+func (gl *GoLink) askFallback(ctx context.Context, base *url.URL, name string) (*link.Record, error) {
+	u := strings.TrimSuffix(base.String(), "/") + apiLinksPath + "/" + url.PathEscape(name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(hopsHeader, "1")
+	var a apiLink
+	code, err := getJSON(gl.fallbackClient, req, &a)
+	if code == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a.record()
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+type nonceKey struct{}
+
+// page holds what base.tmpl.html needs to render any page.
+type page struct {
+	// AnalyticsID is the Google Analytics measurement ID, or "" to leave
+	// analytics out.
+	AnalyticsID string
+	// Nonce allows the inline scripts of the page under the
+	// Content-Security-Policy.
+	Nonce string
+	// Primary is the address of the server that this one mirrors, or "" if
+	// it's not a mirror.
+	Primary string
+}
+
+// page returns the base page data for req.
+func (gl *GoLink) page(req *http.Request) page {
+	nonce, _ := req.Context().Value(nonceKey{}).(string)
+	p := page{AnalyticsID: gl.opts.AnalyticsID, Nonce: nonce}
+	if gl.opts.Upstream != nil {
+		p.Primary = gl.opts.Upstream.String()
+	}
+	return p
+}
+
+// securityHeaders sets headers that stop pages from being framed, sniffed or
+// made to load resources from elsewhere, and that keep page addresses out of
+// the Referer of requests to other sites. Handlers can loosen
+// Referrer-Policy or tighten it, like redirects to links do.
+func (gl *GoLink) securityHeaders(h http.Handler) http.Handler {
+	fn := func(resp http.ResponseWriter, req *http.Request) {
+		var b [16]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			http.Error(resp, "", http.StatusInternalServerError)
+			return
+		}
+		// Hex digits are valid in a nonce and need no escaping in html.
+		nonce := hex.EncodeToString(b[:])
+		hdr := resp.Header()
+		hdr.Set("Content-Security-Policy", gl.contentSecurityPolicy(nonce))
+		hdr.Set("X-Content-Type-Options", "nosniff")
+		hdr.Set("X-Frame-Options", "DENY")
+		hdr.Set("Referrer-Policy", "same-origin")
+		hdr.Set("Cross-Origin-Opener-Policy", "same-origin")
+		h.ServeHTTP(resp, req.WithContext(context.WithValue(req.Context(), nonceKey{}, nonce)))
+	}
+	return http.HandlerFunc(fn)
+}
+
+// contentSecurityPolicy only allows the service's own styles and forms, and
+// scripts with nonce. Analytics needs Google's hosts too.
+func (gl *GoLink) contentSecurityPolicy(nonce string) string {
+	scripts := []string{"'nonce-" + nonce + "'"}
+	images := []string{"'self'"}
+	connect := []string{"'none'"}
+	if gl.opts.AnalyticsID != "" {
+		scripts = append(scripts, "https://www.googletagmanager.com")
+		images = append(images, "https://*.google-analytics.com", "https://*.googletagmanager.com")
+		connect = []string{"https://*.google-analytics.com", "https://*.analytics.google.com", "https://*.googletagmanager.com"}
+	}
+	return strings.Join([]string{
+		"default-src 'none'",
+		"script-src " + strings.Join(scripts, " "),
+		"style-src 'self'",
+		"img-src " + strings.Join(images, " "),
+		"connect-src " + strings.Join(connect, " "),
+		"form-action 'self'",
+		"frame-ancestors 'none'",
+		"base-uri 'none'",
+	}, "; ")
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/spwg/golink/internal/datastore"
+)
+
+// readinessTimeout bounds how long the database checks in /readyz may take.
+const readinessTimeout = 2 * time.Second
+
+type healthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type healthStatus struct {
+	Status string         `json:"status"`
+	Checks []*healthCheck `json:"checks,omitempty"`
+}
+
+// healthzHandler reports that the process is alive and serving requests.
+func (gl *GoLink) healthzHandler(resp http.ResponseWriter, req *http.Request) {
+	writeHealth(resp, &healthStatus{Status: "ok"})
+}
+
+// readyzHandler reports whether the service can serve traffic, which requires
+// the database to be reachable and at the expected schema version.
+func (gl *GoLink) readyzHandler(resp http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), readinessTimeout)
+	defer cancel()
+	check := func(name string, f func() (string, error)) *healthCheck {
+		detail, err := f()
+		if err != nil {
+			return &healthCheck{Name: name, Detail: err.Error()}
+		}
+		return &healthCheck{Name: name, OK: true, Detail: detail}
+	}
+	checks := []*healthCheck{
+		check("ping", func() (string, error) {
+			return "", gl.db.PingContext(ctx)
+		}),
+		check("links", func() (string, error) {
+			var n int
+			err := gl.db.QueryRowContext(ctx, "select count(*) from (select 1 from links limit 1);").Scan(&n)
+			return "", err
+		}),
+		check("schema_version", func() (string, error) {
+			v, err := datastore.Version(ctx, gl.db)
+			if err != nil {
+				return "", err
+			}
+			if want := datastore.SchemaVersion(); v != want {
+				return "", fmt.Errorf("database is at version %d, want %d", v, want)
+			}
+			return fmt.Sprintf("version %d", v), nil
+		}),
+	}
+	status := &healthStatus{Status: "ok", Checks: checks}
+	for _, c := range checks {
+		if !c.OK {
+			status.Status = "unavailable"
+			log.Printf("Readiness check %q failed: %s", c.Name, c.Detail)
+		}
+	}
+	writeHealth(resp, status)
+}
+
+func writeHealth(resp http.ResponseWriter, status *healthStatus) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Cache-Control", "no-store")
+	if status.Status != "ok" {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(resp).Encode(status); err != nil {
+		log.Printf("Failed to write health status: %v", err)
+	}
+}
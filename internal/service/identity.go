@@ -0,0 +1,32 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+)
+
+// user returns the user named by the Options.UserHeader of req, or "" if there
+// isn't one. The header is only believed from a trusted proxy.
+func (gl *GoLink) user(req *http.Request) string {
+	if gl.opts.UserHeader == "" || !infoFromContext(req.Context()).origin.Trusted {
+		return ""
+	}
+	return req.Header.Get(gl.opts.UserHeader)
+}
+
+// groups returns the comma-separated groups in the Options.GroupsHeader of
+// req. Like the user, they're only believed from a trusted proxy.
+func (gl *GoLink) groups(req *http.Request) []string {
+	if gl.opts.GroupsHeader == "" || !infoFromContext(req.Context()).origin.Trusted {
+		return nil
+	}
+	var groups []string
+	for _, v := range req.Header.Values(gl.opts.GroupsHeader) {
+		for _, g := range strings.Split(v, ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				groups = append(groups, g)
+			}
+		}
+	}
+	return groups
+}
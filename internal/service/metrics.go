@@ -0,0 +1,121 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/spwg/golink/internal/link"
+	"github.com/spwg/golink/internal/metrics"
+)
+
+// serviceMetrics are the metrics exported on /metrics.
+type serviceMetrics struct {
+	registry        *metrics.Registry
+	requests        *metrics.Counter
+	requestDuration *metrics.Histogram
+	redirects       *metrics.Counter
+	linkErrors      *metrics.Counter
+	queryDuration   *metrics.Histogram
+	rateLimited     *metrics.Counter
+	cacheLookups    *metrics.Counter
+}
+
+func newServiceMetrics(db *sql.DB) *serviceMetrics {
+	r := metrics.NewRegistry()
+	m := &serviceMetrics{
+		registry:        r,
+		requests:        r.Counter("golink_http_requests_total", "HTTP requests served, by route, method and status code.", "route", "method", "code"),
+		requestDuration: r.Histogram("golink_http_request_duration_seconds", "Latency of HTTP requests, by route.", metrics.DefaultBuckets, "route"),
+		redirects:       r.Counter("golink_redirects_total", "Go link lookups, by result (hit, miss, inactive or fallback).", "result"),
+		linkErrors:      r.Counter("golink_link_errors_total", "Errors returned by the link package, by operation and error.", "op", "error"),
+		queryDuration:   r.Histogram("golink_db_query_duration_seconds", "Latency of database queries, by operation.", metrics.DefaultBuckets, "op"),
+		rateLimited:     r.Counter("golink_rate_limited_total", "Requests rejected by a rate limit, by class (redirect or write) and key (client or user).", "class", "key"),
+		cacheLookups:    r.Counter("golink_link_cache_lookups_total", "Lookups of names in the redirect cache, by result (hit or miss).", "result"),
+	}
+	stat := func(f func(sql.DBStats) float64) func() float64 {
+		return func() float64 { return f(db.Stats()) }
+	}
+	r.GaugeFunc("golink_db_max_open_connections", "Maximum number of open connections to the database.", stat(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	r.GaugeFunc("golink_db_open_connections", "Number of established connections to the database.", stat(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+	r.GaugeFunc("golink_db_in_use_connections", "Number of database connections currently in use.", stat(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+	r.GaugeFunc("golink_db_idle_connections", "Number of idle database connections.", stat(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+	r.CounterFunc("golink_db_wait_count_total", "Number of times a query waited for a database connection.", stat(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	r.CounterFunc("golink_db_wait_duration_seconds_total", "Time spent waiting for database connections.", stat(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+	return m
+}
+
+// instrument records request metrics for h under the name route, which should
+// be the pattern that h is registered with.
+func (m *serviceMetrics) instrument(route string, h http.HandlerFunc) http.Handler {
+	fn := func(resp http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		infoFromContext(req.Context()).route = route
+		sw := &statusWriter{ResponseWriter: resp}
+		h(sw, req)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		m.requests.Inc(route, req.Method, strconv.Itoa(sw.status))
+		m.requestDuration.Observe(time.Since(start).Seconds(), route)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// redirect counts the outcome of a go link lookup.
+func (m *serviceMetrics) redirect(found bool) {
+	if found {
+		m.redirects.Inc("hit")
+		return
+	}
+	m.redirects.Inc("miss")
+}
+
+// fallback counts a lookup that one of Options.Fallbacks answered.
+func (m *serviceMetrics) fallback() {
+	m.redirects.Inc("fallback")
+}
+
+// inactive counts a lookup of a link that isn't active yet or has expired.
+func (m *serviceMetrics) inactive() {
+	m.redirects.Inc("inactive")
+}
+
+// linkError counts an error returned by the link package for op.
+func (m *serviceMetrics) linkError(op string, err error) {
+	var name string
+	switch {
+	case errors.Is(err, link.ErrAlreadyExists):
+		name = "already_exists"
+	case errors.Is(err, link.ErrInvalidLinkName):
+		name = "invalid_name"
+	case errors.Is(err, link.ErrNotFound):
+		name = "not_found"
+	case errors.Is(err, link.ErrUnparseableAddress):
+		name = "unparseable_address"
+	case errors.Is(err, link.ErrInvalidVisibility):
+		name = "invalid_visibility"
+	case errors.Is(err, link.ErrInvalidSchedule):
+		name = "invalid_schedule"
+	case errors.Is(err, link.ErrInvalidTag):
+		name = "invalid_tag"
+	case errors.Is(err, link.ErrInvalidRedirect):
+		name = "invalid_redirect"
+	case errors.Is(err, link.ErrConflict):
+		name = "conflict"
+	default:
+		name = "internal"
+	}
+	m.linkErrors.Inc(op, name)
+}
+
+// timeQuery starts timing a database operation. Call the returned function
+// when the operation is done.
+func (m *serviceMetrics) timeQuery(op string) func() {
+	start := time.Now()
+	return func() {
+		m.queryDuration.Observe(time.Since(start).Seconds(), op)
+	}
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spwg/golink/internal/link"
+)
+
+const (
+	defaultMirrorRetry = 10 * time.Second
+	// mirrorWait is how long a mirror long-polls the upstream for changes.
+	mirrorWait = 30 * time.Second
+)
+
+// errResync means that a mirror has to copy every link again.
+var errResync = errors.New("changes were pruned upstream")
+
+// fromMirror reports whether req was made by a mirror with
+// Options.MirrorToken, which can read every link.
+func (gl *GoLink) fromMirror(req *http.Request) bool {
+	return hasBearerToken(req, gl.opts.MirrorToken)
+}
+
+// readOnly refuses requests that would change links when the service mirrors
+// Options.Upstream, pointing them at the upstream instead.
+func (gl *GoLink) readOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			h(resp, req)
+			return
+		}
+		if gl.opts.Upstream == nil {
+			h(resp, req)
+			return
+		}
+		msg := fmt.Sprintf("This server is a read-only mirror of %s. Make changes there.", gl.opts.Upstream)
+		if strings.HasPrefix(req.URL.Path, "/api/") {
+			writeAPIError(resp, http.StatusForbidden, msg)
+			return
+		}
+		http.Error(resp, msg, http.StatusForbidden)
+	}
+}
+
+// mirror copies the links of Options.Upstream into the database, and then
+// follows the upstream's changes, until ctx is done. If the upstream can't be
+// reached the local copy keeps serving, and mirror tries again every
+// Options.MirrorRetry.
+func (gl *GoLink) mirror(ctx context.Context) {
+	log.Printf("Mirroring %s", gl.opts.Upstream)
+	since := int64(-1)
+	for ctx.Err() == nil {
+		var err error
+		if since < 0 {
+			since, err = gl.mirrorAll(ctx)
+		} else {
+			since, err = gl.mirrorChanges(ctx, since)
+		}
+		switch {
+		case err == nil:
+			gl.mirrorSynced.Store(time.Now().Unix())
+			continue
+		case errors.Is(err, errResync):
+			log.Printf("Mirror fell behind %s, copying every link again", gl.opts.Upstream)
+			since = -1
+			continue
+		case ctx.Err() != nil:
+			return
+		}
+		log.Printf("Failed to mirror %s, retrying in %v: %v", gl.opts.Upstream, gl.opts.MirrorRetry, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(gl.opts.MirrorRetry):
+		}
+	}
+}
+
+// mirrored reports whether a mirror keeps r. Without Options.UpstreamToken it
+// keeps the links that anonymous users can list, as the upstream only lists
+// those, whether it got them from the list or one by one.
+func (gl *GoLink) mirrored(r *link.Record) bool {
+	return gl.opts.UpstreamToken != "" || r.ListedFor("", nil)
+}
+
+// mirrorAll replaces every link with those of the upstream. It returns the
+// upstream revision to follow changes from.
+func (gl *GoLink) mirrorAll(ctx context.Context) (int64, error) {
+	// Changes made while the links are being copied are applied again
+	// later, which does no harm.
+	var latest apiChanges
+	if _, err := gl.upstreamGet(ctx, "/api/v1/changes", &latest); err != nil {
+		return -1, err
+	}
+	var all struct {
+		Links []*apiLink `json:"links"`
+	}
+	if _, err := gl.upstreamGet(ctx, apiLinksPath, &all); err != nil {
+		return -1, err
+	}
+	records := make([]*link.Record, 0, len(all.Links))
+	for _, a := range all.Links {
+		r, err := a.record()
+		if err != nil {
+			return -1, err
+		}
+		if gl.mirrored(r) {
+			records = append(records, r)
+		}
+	}
+	if err := link.ReplaceAll(ctx, gl.db, records); err != nil {
+		return -1, err
+	}
+	gl.resolved.Clear()
+	gl.changes.poke()
+	log.Printf("Copied %d links from %s at revision %d", len(records), gl.opts.Upstream, latest.Revision)
+	return latest.Revision, nil
+}
+
+// mirrorChanges waits for the upstream's changes after revision since and
+// copies the links that changed. It returns the revision it got to.
+func (gl *GoLink) mirrorChanges(ctx context.Context, since int64) (int64, error) {
+	var changes apiChanges
+	path := "/api/v1/changes?since=" + strconv.FormatInt(since, 10) + "&wait=" + mirrorWait.String()
+	code, err := gl.upstreamGet(ctx, path, &changes)
+	if code == http.StatusGone {
+		return -1, errResync
+	}
+	if err != nil {
+		return since, err
+	}
+	names := map[string]bool{}
+	for _, c := range changes.Changes {
+		names[c.Name] = true
+	}
+	for name := range names {
+		var a apiLink
+		code, err := gl.upstreamGet(ctx, apiLinksPath+"/"+url.PathEscape(name), &a)
+		switch {
+		case code == http.StatusNotFound:
+			err = link.Remove(ctx, gl.db, name)
+		case err == nil:
+			var r *link.Record
+			if r, err = a.record(); err != nil {
+				break
+			}
+			if gl.mirrored(r) {
+				err = link.Put(ctx, gl.db, r)
+			} else {
+				err = link.Remove(ctx, gl.db, name)
+			}
+		}
+		if err != nil {
+			return since, fmt.Errorf("failed to copy %q: %w", name, err)
+		}
+		gl.changed(name)
+	}
+	return changes.Revision, nil
+}
+
+// upstreamGet gets path from Options.Upstream and decodes the JSON response
+// into v. It returns the status code, and an error unless it's 200 OK.
+func (gl *GoLink) upstreamGet(ctx context.Context, path string, v any) (int, error) {
+	u := strings.TrimSuffix(gl.opts.Upstream.String(), "/") + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	if gl.opts.UpstreamToken != "" {
+		req.Header.Set("Authorization", "Bearer "+gl.opts.UpstreamToken)
+	}
+	return getJSON(gl.upstreamClient, req, v)
+}
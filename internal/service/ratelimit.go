@@ -0,0 +1,56 @@
+package service
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/spwg/golink/internal/ratelimit"
+)
+
+// RateLimit is a token bucket limit on the requests of each client and of
+// each user.
+type RateLimit struct {
+	// Rate is the sustained number of requests allowed per second. Zero
+	// disables the limit.
+	Rate float64
+	// Burst is the number of requests allowed in quick succession.
+	Burst int
+}
+
+const defaultMaxTrackedClients = 10000
+
+// limiter applies a RateLimit separately to client addresses and to users.
+type limiter struct {
+	class   string
+	clients *ratelimit.Limiter
+	users   *ratelimit.Limiter
+}
+
+func newLimiter(class string, l RateLimit, maxTracked int) *limiter {
+	return &limiter{
+		class:   class,
+		clients: ratelimit.New(l.Rate, l.Burst, maxTracked),
+		users:   ratelimit.New(l.Rate, l.Burst, maxTracked),
+	}
+}
+
+// limit responds with 429 Too Many Requests instead of calling h when the
+// client or the user of a request is over the limit of l.
+func (gl *GoLink) limit(l *limiter, h http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		ok, wait := l.clients.Allow(infoFromContext(req.Context()).origin.ClientIP.String())
+		key := "client"
+		if user := gl.user(req); ok && user != "" {
+			ok, wait = l.users.Allow(user)
+			key = "user"
+		}
+		if !ok {
+			gl.metrics.rateLimited.Inc(l.class, key)
+			resp.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(wait.Seconds())))))
+			http.Error(resp, "Too many requests, try again later.", http.StatusTooManyRequests)
+			return
+		}
+		h(resp, req)
+	}
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/spwg/golink/internal/link"
+)
+
+// parseRedirect reads the redirect_code and cache_max_age fields of a form,
+// the latter in seconds. Empty fields are 0, the defaults. It responds with an
+// error and returns false if they aren't numbers.
+func parseRedirect(resp http.ResponseWriter, req *http.Request) (code int, maxAge time.Duration, ok bool) {
+	parse := func(field string) (int, bool) {
+		v := req.PostForm.Get(field)
+		if v == "" {
+			return 0, true
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(resp, fmt.Sprintf("Invalid number %q for %s.", v, field), http.StatusBadRequest)
+			return 0, false
+		}
+		return n, true
+	}
+	if code, ok = parse("redirect_code"); !ok {
+		return
+	}
+	seconds, ok := parse("cache_max_age")
+	return code, time.Duration(seconds) * time.Second, ok
+}
+
+// cacheControl returns the Cache-Control header of a redirect to l at now.
+// Redirects aren't cached unless l allows it, and never past its expiry, so
+// that clients don't keep going to a destination after it changes. Only
+// clients cache redirects to links that aren't public.
+func cacheControl(l *link.Record, now time.Time) string {
+	maxAge := l.CacheMaxAge
+	if !l.ExpiresAt.IsZero() {
+		maxAge = min(maxAge, l.ExpiresAt.Sub(now))
+	}
+	if maxAge < time.Second {
+		return "no-store"
+	}
+	scope := "private"
+	if l.Visibility == link.Public {
+		scope = "public"
+	}
+	return fmt.Sprintf("%s, max-age=%d", scope, int64(maxAge/time.Second))
+}
+
+// describeRedirect says how redirects to l behave, for its manage page.
+func describeRedirect(l *link.Record) string {
+	code := l.RedirectStatus()
+	s := fmt.Sprintf("%d %s", code, http.StatusText(code))
+	if l.CacheMaxAge == 0 {
+		return s + ", not cached"
+	}
+	return s + ", cached for " + l.CacheMaxAge.String()
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/spwg/golink/internal/link"
+)
+
+const (
+	defaultCacheSize = 10000
+	defaultCacheTTL  = 30 * time.Second
+)
+
+// resolution is what a name resolves to. Both links are nil if the name
+// doesn't exist, which is cached too so that typos don't reach the database
+// over and over.
+type resolution struct {
+	// link is the link called the name.
+	link *link.Record
+	// archived is the expired link that was called the name, if link is nil.
+	archived *link.Record
+}
+
+// resolve looks up the link called name, from the cache if possible. The
+// records it returns are shared and must not be changed.
+func (gl *GoLink) resolve(ctx context.Context, name string) (resolution, error) {
+	if res, ok := gl.resolved.Get(name); ok {
+		gl.metrics.cacheLookups.Inc("hit")
+		return res, nil
+	}
+	gl.metrics.cacheLookups.Inc("miss")
+	defer gl.metrics.timeQuery("resolve")()
+	var res resolution
+	var err error
+	res.link, err = link.Read(ctx, gl.db, name)
+	if errors.Is(err, link.ErrNotFound) {
+		res.archived, err = link.ReadArchived(ctx, gl.db, name)
+		if errors.Is(err, link.ErrNotFound) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return resolution{}, err
+	}
+	gl.resolved.Add(name, res)
+	return res, nil
+}
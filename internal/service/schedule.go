@@ -0,0 +1,102 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/spwg/golink/internal/link"
+)
+
+const (
+	defaultExpiryWarning = 7 * 24 * time.Hour
+	// scheduleLayout is the format of datetime-local form inputs. The forms
+	// take and show times in UTC.
+	scheduleLayout = "2006-01-02T15:04"
+	// displayLayout is how times are written on pages.
+	displayLayout = "2006-01-02 15:04 MST"
+)
+
+// parseSchedule reads the not_before and expires_at fields of a form. It
+// responds with an error and returns false if they're invalid.
+func parseSchedule(resp http.ResponseWriter, req *http.Request) (notBefore, expiresAt time.Time, ok bool) {
+	parse := func(field string) (time.Time, bool) {
+		v := req.PostForm.Get(field)
+		if v == "" {
+			return time.Time{}, true
+		}
+		t, err := time.ParseInLocation(scheduleLayout, v, time.UTC)
+		if err != nil {
+			http.Error(resp, fmt.Sprintf("Invalid time %q for %s: want a time like 2006-01-02T15:04.", v, field), http.StatusBadRequest)
+			return time.Time{}, false
+		}
+		return t, true
+	}
+	if notBefore, ok = parse("not_before"); !ok {
+		return
+	}
+	expiresAt, ok = parse("expires_at")
+	return
+}
+
+// formatSchedule formats t for a datetime-local input, or returns "" for the
+// zero time.
+func formatSchedule(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(scheduleLayout)
+}
+
+// expiryWarning returns a warning for the manage page of r if it expires
+// within Options.ExpiryWarning of now, or "".
+func (gl *GoLink) expiryWarning(r *link.Record, now time.Time) string {
+	if r.ExpiresAt.IsZero() || r.ExpiresAt.Sub(now) > gl.opts.ExpiryWarning {
+		return ""
+	}
+	return fmt.Sprintf("This link expires in %v, at %s. Change the expiry time below to keep it.",
+		r.ExpiresAt.Sub(now).Round(time.Minute), r.ExpiresAt.UTC().Format(displayLayout))
+}
+
+// describeDuration writes d in whole days or hours, like "7 days", if it is
+// one, for pages.
+func describeDuration(d time.Duration) string {
+	plural := func(n time.Duration, unit string) string {
+		if n == 1 {
+			return "1 " + unit
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	switch {
+	case d > 0 && d%(24*time.Hour) == 0:
+		return plural(d/(24*time.Hour), "day")
+	case d > 0 && d%time.Hour == 0:
+		return plural(d/time.Hour, "hour")
+	}
+	return d.String()
+}
+
+// inactiveHandler explains why the link r doesn't resolve right now.
+func (gl *GoLink) inactiveHandler(resp http.ResponseWriter, req *http.Request, r *link.Record, now time.Time) {
+	d := struct {
+		page
+		Name    string
+		Pending bool
+		When    string
+	}{page: gl.page(req), Name: r.Name}
+	// A link that isn't active yet may be about to be, so it's not "gone".
+	code := http.StatusGone
+	if r.Pending(now) {
+		code = http.StatusNotFound
+		d.Pending = true
+		d.When = r.NotBefore.UTC().Format(displayLayout)
+	} else {
+		d.When = r.ExpiresAt.UTC().Format(displayLayout)
+	}
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resp.WriteHeader(code)
+	if err := inactiveTemplate.ExecuteTemplate(resp, "inactive.tmpl.html", d); err != nil {
+		log.Printf("Failed to render the inactive page of %q: %v", r.Name, err)
+	}
+}
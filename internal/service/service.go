@@ -4,94 +4,446 @@ package service
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"embed"
 	"errors"
 	"fmt"
-	"html"
 	"html/template"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
-	"net/http/httptest"
-	"net/http/httputil"
+	"net/netip"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	texttemplate "text/template"
+	"time"
 
+	"github.com/spwg/golink/internal/cache"
+	"github.com/spwg/golink/internal/forwarded"
 	"github.com/spwg/golink/internal/link"
 )
 
 var (
 	//go:embed static
-	static         embed.FS
-	goLinkTemplate = template.Must(template.ParseFS(static, "static/golink.tmpl.html", "static/base.tmpl.html", "static/nav.tmpl.html"))
-	indexTemplate  = template.Must(template.ParseFS(static, "static/index.tmpl.html", "static/base.tmpl.html", "static/nav.tmpl.html"))
-	cssPage        = mustReadFile(static.ReadFile("static/site.css"))
-	docsPage       = template.Must(template.ParseFS(static, "static/docs.tmpl.html", "static/base.tmpl.html", "static/nav.tmpl.html"))
+	static           embed.FS
+	goLinkTemplate   = template.Must(template.ParseFS(static, "static/golink.tmpl.html", "static/base.tmpl.html", "static/nav.tmpl.html"))
+	indexTemplate    = template.Must(template.ParseFS(static, "static/index.tmpl.html", "static/base.tmpl.html", "static/nav.tmpl.html"))
+	cssPage          = mustReadFile(static.ReadFile("static/site.css"))
+	docsPage         = template.Must(template.ParseFS(static, "static/docs.tmpl.html", "static/base.tmpl.html", "static/nav.tmpl.html"))
+	inactiveTemplate = template.Must(template.ParseFS(static, "static/inactive.tmpl.html", "static/base.tmpl.html", "static/nav.tmpl.html"))
+	trashTemplate    = template.Must(template.ParseFS(static, "static/trash.tmpl.html", "static/base.tmpl.html", "static/nav.tmpl.html"))
+	// The OpenSearch description is XML, which html/template would mangle, so
+	// the template escapes its values itself.
+	openSearchTemplate = texttemplate.Must(texttemplate.ParseFS(static, "static/opensearch.tmpl.xml"))
 )
 
+// Options configures a *GoLink. Zero durations and sizes use the defaults of
+// http.Server, except for ShutdownTimeout.
+type Options struct {
+	// BaseURL is the public address of the service, like
+	// https://go.example.com. It must not have a path. Defaults to
+	// http://localhost.
+	BaseURL *url.URL
+	// ShortHosts are host names, like "go", that users type instead of the
+	// host of BaseURL. Requests for them are redirected to BaseURL.
+	ShortHosts []string
+	// EnforceHTTPS redirects requests that reached the proxy in front of the
+	// service over plain http to BaseURL, which should then be https.
+	EnforceHTTPS bool
+	// PermanentHostRedirects makes the redirects to BaseURL, for
+	// EnforceHTTPS, ShortHosts and RunHTTPRedirect, permanent: 301 rather
+	// than 307. Browsers cache those until their cache is cleared, so only
+	// set it once BaseURL won't change.
+	PermanentHostRedirects bool
+	// TrustedProxies are the networks of proxies whose Forwarded and
+	// X-Forwarded-* headers are believed.
+	TrustedProxies []netip.Prefix
+	// TLSConfig, if set, makes the service terminate TLS itself, with HTTP/2
+	// enabled. It must provide the certificates.
+	TLSConfig *tls.Config
+	// Logger receives access logs and server errors. Defaults to
+	// slog.Default().
+	Logger *slog.Logger
+	// ReadHeaderTimeout is the time allowed to read request headers.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout is the time allowed to read an entire request.
+	ReadTimeout time.Duration
+	// WriteTimeout is the time allowed to write a response.
+	WriteTimeout time.Duration
+	// IdleTimeout is how long keep-alive connections are kept open between
+	// requests.
+	IdleTimeout time.Duration
+	// MaxHeaderBytes limits the size of request headers.
+	MaxHeaderBytes int
+	// ShutdownTimeout is how long Run waits for in-flight requests to finish
+	// once its context is done. Defaults to 10 seconds.
+	ShutdownTimeout time.Duration
+	// UserHeader is the request header, like X-Forwarded-User, in which a
+	// trusted proxy names the signed-in user. Users are anonymous if empty.
+	UserHeader string
+	// GroupsHeader is the request header in which a trusted proxy lists the
+	// comma-separated groups of the signed-in user, which can be allowed to
+	// resolve private links.
+	GroupsHeader string
+	// RedirectLimit limits how often each client and user can resolve links.
+	RedirectLimit RateLimit
+	// WriteLimit limits how often each client and user can create, update and
+	// delete links.
+	WriteLimit RateLimit
+	// MaxTrackedClients bounds the number of clients and of users that the
+	// rate limits keep state for. Defaults to 10000.
+	MaxTrackedClients int
+	// MaxLinksPerUser is the number of links that each user can create. Zero
+	// means no limit. Anonymous users aren't limited.
+	MaxLinksPerUser int
+	// AnalyticsID is a Google Analytics measurement ID, like G-XXXXXXXXXX, to
+	// add to every page. Pages have no analytics if empty.
+	AnalyticsID string
+	// CleanupInterval is how often expired links are archived and old links
+	// are purged from the trash. Defaults to an hour.
+	CleanupInterval time.Duration
+	// TrashRetention is how long deleted links can be restored before they're
+	// purged. Defaults to 30 days.
+	TrashRetention time.Duration
+	// ExpiryWarning is how long before a link expires its manage page starts
+	// to warn about it. Defaults to a week.
+	ExpiryWarning time.Duration
+	// CacheSize is the number of names whose links are cached for redirects.
+	// Defaults to 10000.
+	CacheSize int
+	// CacheTTL is how long a resolved name, or the absence of a link for it,
+	// is cached. Changes made through the service are seen at once, and
+	// changes that other processes make to the database within
+	// ChangePollInterval; CacheTTL bounds how stale the cache gets if
+	// following the log of changes fails. Defaults to 30 seconds; negative
+	// disables the cache.
+	CacheTTL time.Duration
+	// ChangePollInterval is how often the log of changes is checked for
+	// changes that other replicas made. Defaults to a second.
+	ChangePollInterval time.Duration
+	// ChangeRetention is how long changes are kept in the log. Replicas and
+	// clients that fall further behind have to start over. Defaults to a
+	// week.
+	ChangeRetention time.Duration
+	// Upstream, if set, makes the service a read-only mirror of the golink
+	// server at this address. It copies the upstream's links into its own
+	// database and keeps serving them when the upstream can't be reached.
+	Upstream *url.URL
+	// UpstreamToken is the upstream's MirrorToken. Without it only the links
+	// that anonymous users can list are mirrored.
+	UpstreamToken string
+	// MirrorRetry is how long a mirror waits to try again after failing to
+	// reach Upstream. Defaults to 10 seconds.
+	MirrorRetry time.Duration
+	// MirrorToken lets the mirrors of this service read every link, including
+	// unlisted and private ones, by sending it as a bearer token. Mirrors
+	// can't read every link if empty.
+	MirrorToken string
+	// Fallbacks are golink servers, like a company-wide one behind a team's,
+	// that are asked in turn for the links that the service doesn't have.
+	// Requests are redirected to their answer.
+	Fallbacks []*url.URL
+	// FallbackTTL is how long the answers of Fallbacks are cached. Defaults
+	// to a minute; negative disables the cache.
+	FallbackTTL time.Duration
+	// FallbackTimeout limits how long each fallback has to answer. Defaults
+	// to 2 seconds.
+	FallbackTimeout time.Duration
+	// AdminToken lets requests that send it as a bearer token download a
+	// backup of the database from /admin/backup. The endpoint is disabled if
+	// empty.
+	AdminToken string
+	// BackupDir, if set, is a directory that the database is backed up to
+	// every BackupInterval.
+	BackupDir string
+	// BackupInterval is how often the database is backed up to BackupDir.
+	// Defaults to 6 hours.
+	BackupInterval time.Duration
+	// BackupRetention is how long backups are kept in BackupDir. The latest
+	// one is always kept. Defaults to a week.
+	BackupRetention time.Duration
+}
+
+const defaultShutdownTimeout = 10 * time.Second
+
 // GoLink is a service for shortened links.
 type GoLink struct {
-	db       *sql.DB
-	hostName string
+	db *sql.DB
+	// baseURL is Options.BaseURL without a trailing slash.
+	baseURL string
+	opts    Options
+	logger  *slog.Logger
+	proxies *forwarded.Resolver
+	metrics *serviceMetrics
+	// redirectLimit and writeLimit enforce Options.RedirectLimit and
+	// Options.WriteLimit.
+	redirectLimit *limiter
+	writeLimit    *limiter
+	// resolved caches the links that redirects resolve names to.
+	resolved *cache.Cache[resolution]
+	// changes tells requests for the log of changes when it advances.
+	changes *changeFeed
+	// upstreamClient makes the requests of a mirror to Options.Upstream.
+	upstreamClient *http.Client
+	// mirrorSynced is when a mirror last heard from Options.Upstream, in unix
+	// seconds.
+	mirrorSynced atomic.Int64
+	// fallbacks caches the answers of Options.Fallbacks, including nil for
+	// names that none of them has.
+	fallbacks      *cache.Cache[*link.Record]
+	fallbackClient *http.Client
+	// backedUp is when the database was last backed up to
+	// Options.BackupDir, in unix seconds.
+	backedUp atomic.Int64
+	// background tracks work that outlives a request, which Run waits for
+	// before returning.
+	background sync.WaitGroup
 }
 
 // New creates a *GoLink.
-func New(db *sql.DB, hostName string) *GoLink {
-	return &GoLink{db, hostName}
+func New(db *sql.DB, opts Options) *GoLink {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if opts.ShutdownTimeout == 0 {
+		opts.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if opts.BaseURL == nil {
+		opts.BaseURL = &url.URL{Scheme: "http", Host: "localhost"}
+	}
+	if opts.CleanupInterval == 0 {
+		opts.CleanupInterval = defaultCleanupInterval
+	}
+	if opts.TrashRetention == 0 {
+		opts.TrashRetention = defaultTrashRetention
+	}
+	if opts.ExpiryWarning == 0 {
+		opts.ExpiryWarning = defaultExpiryWarning
+	}
+	if opts.MaxTrackedClients == 0 {
+		opts.MaxTrackedClients = defaultMaxTrackedClients
+	}
+	if opts.CacheSize == 0 {
+		opts.CacheSize = defaultCacheSize
+	}
+	if opts.CacheTTL == 0 {
+		opts.CacheTTL = defaultCacheTTL
+	}
+	if opts.ChangePollInterval == 0 {
+		opts.ChangePollInterval = defaultChangePollInterval
+	}
+	if opts.ChangeRetention == 0 {
+		opts.ChangeRetention = defaultChangeRetention
+	}
+	if opts.MirrorRetry == 0 {
+		opts.MirrorRetry = defaultMirrorRetry
+	}
+	if opts.FallbackTTL == 0 {
+		opts.FallbackTTL = defaultFallbackTTL
+	}
+	if opts.FallbackTimeout == 0 {
+		opts.FallbackTimeout = defaultFallbackTimeout
+	}
+	if opts.BackupInterval == 0 {
+		opts.BackupInterval = defaultBackupInterval
+	}
+	if opts.BackupRetention == 0 {
+		opts.BackupRetention = defaultBackupRetention
+	}
+	gl := &GoLink{
+		db:            db,
+		baseURL:       strings.TrimSuffix(opts.BaseURL.String(), "/"),
+		opts:          opts,
+		logger:        opts.Logger,
+		proxies:       forwarded.NewResolver(opts.TrustedProxies),
+		metrics:       newServiceMetrics(db),
+		redirectLimit: newLimiter("redirect", opts.RedirectLimit, opts.MaxTrackedClients),
+		writeLimit:    newLimiter("write", opts.WriteLimit, opts.MaxTrackedClients),
+		resolved:      cache.New[resolution](opts.CacheSize, opts.CacheTTL),
+		changes:       newChangeFeed(),
+		// Leave time for long-polls for changes.
+		upstreamClient: &http.Client{Timeout: mirrorWait + 30*time.Second},
+		fallbacks:      cache.New[*link.Record](opts.CacheSize, opts.FallbackTTL),
+		fallbackClient: &http.Client{Timeout: opts.FallbackTimeout},
+	}
+	if opts.Upstream != nil {
+		gl.metrics.registry.GaugeFunc("golink_mirror_last_sync_timestamp_seconds", "When the mirror last heard from its upstream, in unix seconds.",
+			func() float64 { return float64(gl.mirrorSynced.Load()) })
+	}
+	if opts.BackupDir != "" {
+		gl.metrics.registry.GaugeFunc("golink_backup_last_success_timestamp_seconds", "When the database was last backed up, in unix seconds.",
+			func() float64 { return float64(gl.backedUp.Load()) })
+	}
+	return gl
 }
 
-// Run installs and starts up the service.
+// Run serves the service on l until ctx is done or serving fails. Then it
+// stops accepting connections, waits up to Options.ShutdownTimeout each for
+// in-flight requests and for background work to finish, and returns. The
+// caller still owns the database.
 func (gl *GoLink) Run(ctx context.Context, l net.Listener) error {
-	if err := gl.startUp(ctx, l); err != nil {
-		return err
-	}
-	return nil
+	log.Printf("Server listening on %s", l.Addr())
+	// The background loops also stop when serving fails, which doesn't
+	// cancel ctx.
+	bgCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	gl.goBackground(func() { gl.cleanUp(bgCtx) })
+	gl.goBackground(func() { gl.followChanges(bgCtx) })
+	if gl.opts.Upstream != nil {
+		gl.goBackground(func() { gl.mirror(bgCtx) })
+	}
+	if gl.opts.BackupDir != "" {
+		gl.goBackground(func() { gl.snapshot(bgCtx) })
+	}
+	server := gl.newServer(gl.handler())
+	// Requests that wait for changes would hold up the shutdown.
+	server.RegisterOnShutdown(gl.changes.close)
+	err := gl.serve(ctx, server, l)
+	cancel()
+	if !gl.waitBackground(gl.opts.ShutdownTimeout) {
+		log.Printf("Background work didn't finish within %v", gl.opts.ShutdownTimeout)
+	}
+	return err
 }
 
-func (gl *GoLink) startUp(ctx context.Context, l net.Listener) error {
-	log.Printf("Server listening on %s", l.Addr())
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", gl.indexHandler)
-	mux.HandleFunc("/favicon.ico", gl.faviconHandler)
-	mux.HandleFunc("/create_golink", gl.createHandler)
-	mux.HandleFunc("/golink/", gl.readHandler)
-	mux.HandleFunc("/update_golink", gl.updateHandler)
-	mux.HandleFunc("/delete_golink", gl.deleteHandler)
-	mux.HandleFunc("/go", gl.goHandler)
-	mux.HandleFunc("/go/", gl.goHandler)
-	mux.HandleFunc("/static/", gl.staticFileHandler)
-	mux.HandleFunc("/docs", gl.docsHandler)
-	server := &http.Server{
-		Handler: logHandler(gl.httpsRedirectHandler(mux)),
+// RunHTTPRedirect serves plain http on l, redirecting every request to the
+// same path on Options.BaseURL, until ctx is done. It's meant for port 80
+// when the service terminates TLS itself.
+func (gl *GoLink) RunHTTPRedirect(ctx context.Context, l net.Listener) error {
+	log.Printf("Redirecting http on %s to %s", l.Addr(), gl.baseURL)
+	server := gl.newServer(gl.httpRedirectHandler())
+	// The redirect listener is always plain http.
+	server.TLSConfig = nil
+	return gl.serve(ctx, server, l)
+}
+
+func (gl *GoLink) newServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           h,
+		TLSConfig:         gl.opts.TLSConfig,
+		ReadHeaderTimeout: gl.opts.ReadHeaderTimeout,
+		ReadTimeout:       gl.opts.ReadTimeout,
+		WriteTimeout:      gl.opts.WriteTimeout,
+		IdleTimeout:       gl.opts.IdleTimeout,
+		MaxHeaderBytes:    gl.opts.MaxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(gl.logger.Handler(), slog.LevelWarn),
 	}
+}
+
+// serve runs server on l until ctx is done and then shuts it down, serving
+// https if the server has a TLS config.
+func (gl *GoLink) serve(ctx context.Context, server *http.Server, l net.Listener) error {
+	errc := make(chan error, 1)
 	go func() {
-		<-ctx.Done()
-		if err := server.Shutdown(context.Background()); err != nil {
-			log.Printf("%v", err)
+		if server.TLSConfig != nil {
+			// The certificates come from the config.
+			errc <- server.ServeTLS(l, "", "")
+			return
 		}
+		errc <- server.Serve(l)
 	}()
-	if err := http.Serve(l, server.Handler); err != nil {
-		if errors.Is(err, http.ErrServerClosed) {
-			return nil
-		}
-		return fmt.Errorf("listen and serve failed: %v", err)
+	select {
+	case err := <-errc:
+		return fmt.Errorf("serve failed: %w", err)
+	case <-ctx.Done():
+	}
+	log.Printf("Shutting down %s, waiting up to %v for in-flight requests", l.Addr(), gl.opts.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), gl.opts.ShutdownTimeout)
+	defer cancel()
+	shutdownErr := server.Shutdown(shutdownCtx)
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serve failed: %w", err)
+	}
+	if shutdownErr != nil {
+		return fmt.Errorf("failed to drain connections: %w", shutdownErr)
 	}
 	return nil
 }
 
+// goBackground runs f in a new goroutine that Run waits for during shutdown.
+func (gl *GoLink) goBackground(f func()) {
+	gl.background.Add(1)
+	go func() {
+		defer gl.background.Done()
+		f()
+	}()
+}
+
+// waitBackground waits up to timeout for the goroutines started by
+// goBackground to return, and reports whether they did.
+func (gl *GoLink) waitBackground(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		gl.background.Wait()
+		close(done)
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// handler returns the root http.Handler of the service.
+func (gl *GoLink) handler() http.Handler {
+	mux := http.NewServeMux()
+	handle := func(pattern string, h http.HandlerFunc) {
+		mux.Handle(pattern, gl.metrics.instrument(pattern, h))
+	}
+	handle("/", gl.limit(gl.redirectLimit, gl.indexHandler))
+	handle("/favicon.ico", gl.faviconHandler)
+	handle("/create_golink", gl.limit(gl.writeLimit, gl.readOnly(gl.csrfProtect(gl.createHandler))))
+	handle("/golink/", gl.readHandler)
+	handle("/update_golink", gl.limit(gl.writeLimit, gl.readOnly(gl.csrfProtect(gl.updateHandler))))
+	handle("/delete_golink", gl.limit(gl.writeLimit, gl.readOnly(gl.csrfProtect(gl.deleteHandler))))
+	handle("/trash", gl.trashHandler)
+	handle("/restore_golink", gl.limit(gl.writeLimit, gl.readOnly(gl.csrfProtect(gl.restoreHandler))))
+	handle("/go", gl.limit(gl.redirectLimit, gl.goHandler))
+	handle("/go/", gl.limit(gl.redirectLimit, gl.goHandler))
+	handle("/static/", gl.staticFileHandler)
+	handle("/docs", gl.docsHandler)
+	handle("/metrics", gl.metrics.registry.ServeHTTP)
+	handle("/search", gl.limit(gl.redirectLimit, gl.searchHandler))
+	handle("/proxy.pac", gl.proxyPACHandler)
+	handle("/opensearch.xml", gl.openSearchHandler)
+	handle(apiLinksPath, gl.readOnly(gl.csrfProtect(gl.apiLinksHandler)))
+	handle(apiLinksPath+"/", gl.readOnly(gl.csrfProtect(gl.apiLinksHandler)))
+	handle("/api/v1/changes", gl.changesHandler)
+	handle("/admin/backup", gl.backupHandler)
+	// Probes bypass the access log and the https redirect so that they can be
+	// made over plain http without filling the logs.
+	root := http.NewServeMux()
+	root.HandleFunc("/healthz", gl.healthzHandler)
+	root.HandleFunc("/readyz", gl.readyzHandler)
+	root.Handle("/", accessLogHandler(gl.logger, gl.proxies, gl.securityHeaders(gl.httpsRedirectHandler(mux))))
+	return root
+}
+
+// httpsRedirectHandler sends requests for the short host names and, if
+// Options.EnforceHTTPS is set, requests that didn't use https to BaseURL.
 func (gl *GoLink) httpsRedirectHandler(h http.Handler) http.Handler {
 	f := func(resp http.ResponseWriter, req *http.Request) {
+		// req.URL.RequestURI() rather than req.RequestURI because requests
+		// routed here by proxy.pac carry an absolute URI, like http://go/name.
+		short := gl.isShortHost(req.Host)
 		switch {
-		case req.Host == "go" && req.URL.Path == "/": // http://go
-			http.Redirect(resp, req, "https://"+gl.hostName+req.RequestURI, http.StatusMovedPermanently)
+		case short && req.URL.Path == "/": // http://go
+			http.Redirect(resp, req, gl.baseURL+req.URL.RequestURI(), gl.hostRedirectCode())
 			return
-		case req.Host == "go" && req.URL.Path != "": // http://go/<name>
-			http.Redirect(resp, req, "https://"+gl.hostName+"/go/"+req.RequestURI, http.StatusMovedPermanently)
+		case short && req.URL.Path != "": // http://go/<name>
+			http.Redirect(resp, req, gl.baseURL+"/go"+req.URL.RequestURI(), gl.hostRedirectCode())
 			return
-		case req.Header.Get("X-Forwarded-Proto") == "http":
+		case gl.opts.EnforceHTTPS && infoFromContext(req.Context()).origin.Proto == "http":
 			// The client did not connect to the proxy using https.
-			http.Redirect(resp, req, "https://"+gl.hostName+req.RequestURI, http.StatusMovedPermanently)
+			http.Redirect(resp, req, gl.baseURL+req.URL.RequestURI(), gl.hostRedirectCode())
 			return
 		}
 		h.ServeHTTP(resp, req)
@@ -99,24 +451,42 @@ func (gl *GoLink) httpsRedirectHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(f)
 }
 
-func logHandler(h http.Handler) http.Handler {
-	fn := func(resp http.ResponseWriter, req *http.Request) {
-		b, err := httputil.DumpRequest(req, true)
-		if err != nil {
-			http.Error(resp, err.Error(), http.StatusInternalServerError)
+// hostRedirectCode returns the status code of redirects to BaseURL.
+func (gl *GoLink) hostRedirectCode() int {
+	if gl.opts.PermanentHostRedirects {
+		return http.StatusMovedPermanently
+	}
+	return http.StatusTemporaryRedirect
+}
+
+// httpRedirectHandler redirects every request to BaseURL, except for health
+// probes.
+func (gl *GoLink) httpRedirectHandler() http.Handler {
+	redirect := func(resp http.ResponseWriter, req *http.Request) {
+		if gl.isShortHost(req.Host) && req.URL.Path != "/" {
+			http.Redirect(resp, req, gl.baseURL+"/go"+req.URL.RequestURI(), gl.hostRedirectCode())
 			return
 		}
-		log.Printf("%q\n", b)
-		recorder := httptest.NewRecorder()
-		h.ServeHTTP(resp, req)
-		b, err = httputil.DumpResponse(recorder.Result(), true)
-		if err != nil {
-			log.Printf("Failed to log http request: %v", err)
-			return
+		http.Redirect(resp, req, gl.baseURL+req.URL.RequestURI(), gl.hostRedirectCode())
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", gl.healthzHandler)
+	mux.Handle("/", accessLogHandler(gl.logger, gl.proxies, http.HandlerFunc(redirect)))
+	return mux
+}
+
+// isShortHost reports whether host, which may have a port, is one of
+// Options.ShortHosts.
+func (gl *GoLink) isShortHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, s := range gl.opts.ShortHosts {
+		if strings.EqualFold(host, s) {
+			return true
 		}
-		log.Printf("%q\n", b)
 	}
-	return http.HandlerFunc(fn)
+	return false
 }
 
 func (gl *GoLink) faviconHandler(resp http.ResponseWriter, req *http.Request) {
@@ -125,52 +495,34 @@ func (gl *GoLink) faviconHandler(resp http.ResponseWriter, req *http.Request) {
 
 func (gl *GoLink) indexHandler(resp http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
-	p := escape(req.URL.EscapedPath())
-	p = strings.TrimPrefix(p, "/")
+	p := strings.TrimPrefix(req.URL.Path, "/")
 	if p != "" {
 		// Requests for go/name will map to p == "name" here, so we need to redirect.
-		link, found, err := gl.linkByName(ctx, p)
-		if err != nil {
-			log.Printf("Failed to lookup %q: %v", p, err)
-			http.Error(resp, fmt.Sprintf("Failed to lookup %q.", p), http.StatusInternalServerError)
-			return
-		}
-		if found {
-			log.Printf("Redirecting %q -> %q", req.URL.String(), link.Link.String())
-			http.Redirect(resp, req, link.Link.String(), http.StatusTemporaryRedirect)
-			return
-		}
-		if !found {
-			http.NotFound(resp, req)
-			return
-		}
+		gl.redirectToLink(resp, req, p, "")
 		return
 	}
-	const query = "select name, url from links;"
-	rows, err := gl.db.QueryContext(ctx, query)
+	tag := strings.ToLower(req.URL.Query().Get("tag"))
+	done := gl.metrics.timeQuery("list")
+	all, err := link.List(ctx, gl.db, tag)
+	done()
 	if err != nil {
 		log.Printf("Failed to query all links in the database: %v", err)
 		http.Error(resp, "Failed to query all links in the database.", http.StatusInternalServerError)
 		return
 	}
+	user, groups := gl.user(req), gl.groups(req)
 	var links []*link.Record
-	for rows.Next() {
-		var name, address string
-		if err := rows.Scan(&name, &address); err != nil {
-			log.Printf("Failed to scan link: %v", err)
-			http.Error(resp, "Failed to query all links in the databse.", http.StatusInternalServerError)
-			return
+	for _, l := range all {
+		if l.ListedFor(user, groups) {
+			links = append(links, l)
 		}
-		u, err := url.Parse(address)
-		if err != nil {
-			http.Error(resp, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		links = append(links, &link.Record{Name: name, Link: u})
 	}
 	if err := indexTemplate.ExecuteTemplate(resp, "index.tmpl.html", struct {
-		Links []*link.Record
-	}{links}); err != nil {
+		page
+		Tag       string
+		Links     []*link.Record
+		CSRFToken string
+	}{gl.page(req), tag, links, gl.csrfToken(resp, req)}); err != nil {
 		http.Error(resp, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -183,11 +535,37 @@ func (gl *GoLink) createHandler(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 	ctx := req.Context()
-	name := escape(req.PostForm.Get("name"))
-	l := escape(req.PostForm.Get("link"))
-	err := link.Create(ctx, gl.db, name, l)
+	name, err := link.ParseName(req.PostForm.Get("name"))
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l := req.PostForm.Get("link")
+	user := gl.user(req)
+	visibility, group, ok := parseVisibility(resp, req, user)
+	if !ok {
+		return
+	}
+	notBefore, expiresAt, ok := parseSchedule(resp, req)
+	if !ok {
+		return
+	}
+	code, maxAge, ok := parseRedirect(resp, req)
+	if !ok {
+		return
+	}
+	err = gl.createLink(ctx, user, name, l,
+		link.WithVisibility(visibility, group),
+		link.WithSchedule(notBefore, expiresAt),
+		link.WithRedirect(code, maxAge),
+		link.WithDescription(description(req.PostForm.Get("description"))),
+		link.WithTags(link.ParseTags(req.PostForm.Get("tags"))))
 	if err != nil {
 		switch err {
+		case errLinkQuota:
+			msg := fmt.Sprintf("You have created %d links, which is the limit.", gl.opts.MaxLinksPerUser)
+			http.Error(resp, msg, http.StatusForbidden)
+			return
 		case link.ErrAlreadyExists:
 			msg := fmt.Sprintf("The golink %q already exists.", name)
 			http.Error(resp, msg, http.StatusConflict)
@@ -199,30 +577,31 @@ func (gl *GoLink) createHandler(resp http.ResponseWriter, req *http.Request) {
 			msg := fmt.Sprintf("Invalid URL %q: not parseable.", l)
 			http.Error(resp, msg, http.StatusBadRequest)
 			return
+		case link.ErrInvalidSchedule, link.ErrInvalidTag, link.ErrInvalidRedirect:
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
 		}
 		log.Printf("Unknown error: %v", err)
 		http.Error(resp, "", http.StatusInternalServerError)
 		return
 	}
-	log.Printf("Saved new link: %v -> %v", name, l)
-	http.Redirect(resp, req, "/golink/"+name, http.StatusSeeOther)
+	log.Printf("Saved new link %q", name)
+	http.Redirect(resp, req, "/golink/"+url.PathEscape(name), http.StatusSeeOther)
 }
 
 func (gl *GoLink) readHandler(resp http.ResponseWriter, req *http.Request) {
-	ctx := req.Context()
-	p := req.URL.EscapedPath()
-	p = strings.TrimPrefix(p, "/")
+	p := strings.TrimPrefix(req.URL.Path, "/")
 	split := strings.Split(p, "/")
 	if len(split) <= 1 {
 		http.Error(resp, "Requests for the /golink endpoint should look like /golink/<name>.", http.StatusBadRequest)
 		return
 	}
 	name := split[1]
-	record, err := link.Read(ctx, gl.db, name)
+	record, err := gl.visibleLink(req, name)
 	if err != nil {
+		gl.metrics.linkError("read", err)
 		switch err {
 		case link.ErrNotFound:
-			log.Printf("here 1")
 			http.NotFound(resp, req)
 			return
 		case link.ErrInvalidLinkName:
@@ -232,17 +611,59 @@ func (gl *GoLink) readHandler(resp http.ResponseWriter, req *http.Request) {
 		http.Error(resp, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// The page varies by user, so the tag is weak.
+	resp.Header().Set("ETag", `W/"`+strconv.FormatInt(record.Revision, 10)+`"`)
+	gl.renderGoLink(resp, req, record, gl.expiryWarning(record, time.Now()), http.StatusOK)
+}
+
+// renderGoLink responds with the manage page of record, with status and
+// warning.
+func (gl *GoLink) renderGoLink(resp http.ResponseWriter, req *http.Request, record *link.Record, warning string, status int) {
 	var b bytes.Buffer
 	type data struct {
-		Name    string
-		Address string
+		page
+		Name         string
+		Address      string
+		Visibility   link.Visibility
+		Group        string
+		NotBefore    string
+		ExpiresAt    string
+		Warning      string
+		Description  string
+		Tags         string
+		Created      string
+		Updated      string
+		RedirectCode int
+		Redirect     string
+		CacheMaxAge  int64
+		Revision     int64
+		CSRFToken    string
+	}
+	d := &data{
+		Description:  record.Description,
+		Tags:         strings.Join(record.Tags, ", "),
+		Created:      changedBy(record.CreatedAt, record.CreatedBy),
+		Updated:      changedBy(record.UpdatedAt, record.UpdatedBy),
+		page:         gl.page(req),
+		Name:         record.Name,
+		Address:      record.Link.String(),
+		Visibility:   record.Visibility,
+		Group:        record.Group,
+		NotBefore:    formatSchedule(record.NotBefore),
+		ExpiresAt:    formatSchedule(record.ExpiresAt),
+		Warning:      warning,
+		RedirectCode: record.RedirectStatus(),
+		Redirect:     describeRedirect(record),
+		CacheMaxAge:  int64(record.CacheMaxAge / time.Second),
+		Revision:     record.Revision,
+		CSRFToken:    gl.csrfToken(resp, req),
 	}
-	d := &data{record.Name, record.Link.String()}
 	if err := goLinkTemplate.ExecuteTemplate(&b, "golink.tmpl.html", d); err != nil {
 		log.Printf("%v\n", err)
 		http.Error(resp, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	resp.WriteHeader(status)
 	if _, err := resp.Write(b.Bytes()); err != nil {
 		log.Printf("%v\n", err)
 	}
@@ -255,22 +676,59 @@ func (gl *GoLink) updateHandler(resp http.ResponseWriter, req *http.Request) {
 		http.Error(resp, "Failed to parse form.", http.StatusBadRequest)
 		return
 	}
-	oldName := escape(req.PostForm.Get("old_name"))
+	oldName := req.PostForm.Get("old_name")
 	if oldName == "" {
 		http.Error(resp, "Invalid form: missing the old name of the link.", http.StatusBadRequest)
 		return
 	}
-	reqName := escape(req.PostForm.Get("name"))
-	if reqName == "" {
-		http.Error(resp, "Invalid form: missing the new name of the link.", http.StatusBadRequest)
+	reqName, err := link.ParseName(req.PostForm.Get("name"))
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
 		return
 	}
-	reqLink := escape(req.PostForm.Get("link"))
+	reqLink := req.PostForm.Get("link")
 	if reqLink == "" {
 		http.Error(resp, "Invalid form: missing the link.", http.StatusBadRequest)
 		return
 	}
-	if err := link.Update(ctx, gl.db, oldName, reqName, reqLink); err != nil {
+	ifRevision, ok := parseRevision(resp, req)
+	if !ok {
+		return
+	}
+	record, err := gl.visibleLink(req, oldName)
+	if err == nil {
+		opts := ifRevision
+		if req.PostForm.Has("visibility") {
+			visibility, group, ok := parseVisibility(resp, req, record.CreatedBy)
+			if !ok {
+				return
+			}
+			opts = append(opts, link.WithVisibility(visibility, group))
+		}
+		if req.PostForm.Has("not_before") || req.PostForm.Has("expires_at") {
+			notBefore, expiresAt, ok := parseSchedule(resp, req)
+			if !ok {
+				return
+			}
+			opts = append(opts, link.WithSchedule(notBefore, expiresAt))
+		}
+		if req.PostForm.Has("redirect_code") || req.PostForm.Has("cache_max_age") {
+			code, maxAge, ok := parseRedirect(resp, req)
+			if !ok {
+				return
+			}
+			opts = append(opts, link.WithRedirect(code, maxAge))
+		}
+		if req.PostForm.Has("description") {
+			opts = append(opts, link.WithDescription(description(req.PostForm.Get("description"))))
+		}
+		if req.PostForm.Has("tags") {
+			opts = append(opts, link.WithTags(link.ParseTags(req.PostForm.Get("tags"))))
+		}
+		opts = append(opts, link.UpdatedBy(gl.user(req)))
+		err = gl.updateLink(ctx, oldName, reqName, reqLink, opts...)
+	}
+	if err != nil {
 		switch err {
 		case link.ErrAlreadyExists:
 			msg := fmt.Sprintf("Link for %q already exists.", reqName)
@@ -283,11 +741,20 @@ func (gl *GoLink) updateHandler(resp http.ResponseWriter, req *http.Request) {
 			msg := fmt.Sprintf("Invalid address %q: failed to parse.", reqLink)
 			http.Error(resp, msg, http.StatusBadRequest)
 			return
+		case link.ErrNotFound:
+			http.NotFound(resp, req)
+			return
+		case link.ErrInvalidSchedule, link.ErrInvalidTag, link.ErrInvalidRedirect:
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		case link.ErrConflict:
+			gl.conflict(resp, req, oldName)
+			return
 		}
 		http.Error(resp, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(resp, req, "/golink/"+reqName, http.StatusTemporaryRedirect)
+	http.Redirect(resp, req, "/golink/"+url.PathEscape(reqName), http.StatusTemporaryRedirect)
 }
 
 func (gl *GoLink) deleteHandler(resp http.ResponseWriter, req *http.Request) {
@@ -300,23 +767,33 @@ func (gl *GoLink) deleteHandler(resp http.ResponseWriter, req *http.Request) {
 		http.Error(resp, "Failed to parse form.", http.StatusBadRequest)
 		return
 	}
-	name := escape(req.PostForm.Get("name"))
-	if err := link.Delete(ctx, gl.db, name); err != nil {
+	name := req.PostForm.Get("name")
+	ifRevision, ok := parseRevision(resp, req)
+	if !ok {
+		return
+	}
+	_, err := gl.visibleLink(req, name)
+	if err == nil {
+		err = gl.deleteLink(ctx, name, gl.user(req), ifRevision...)
+	}
+	if err != nil {
 		switch err {
 		case link.ErrNotFound:
 			http.NotFound(resp, req)
 			return
+		case link.ErrConflict:
+			gl.conflict(resp, req, name)
+			return
 		}
 		http.Error(resp, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(resp, req, "/", http.StatusTemporaryRedirect)
+	// The trash lets the user undo the deletion.
+	http.Redirect(resp, req, "/trash?deleted="+url.QueryEscape(name), http.StatusSeeOther)
 }
 
 func (gl *GoLink) goHandler(resp http.ResponseWriter, req *http.Request) {
-	ctx := req.Context()
-	p := req.URL.EscapedPath()
-	split := strings.Split(p, "/")
+	split := strings.Split(req.URL.Path, "/")
 	if len(split) <= 1 || len(split) > 3 {
 		http.Error(resp, "Requests for the /go endpoint should look like /go/<name>.", http.StatusBadRequest)
 		return
@@ -326,35 +803,195 @@ func (gl *GoLink) goHandler(resp http.ResponseWriter, req *http.Request) {
 		http.NotFound(resp, req)
 		return
 	}
-	name := escape(split[2])
-	l, ok, err := gl.linkByName(ctx, name)
+	name := split[2]
+	gl.redirectToLink(resp, req, name, "")
+}
+
+// redirectToLink redirects to the address of the link called name, expanded
+// with args.
+func (gl *GoLink) redirectToLink(resp http.ResponseWriter, req *http.Request, name, args string) {
+	ctx := req.Context()
+	setLinkName(ctx, name)
+	res, err := gl.resolve(ctx, name)
 	if err != nil {
+		gl.metrics.linkError("resolve", err)
 		log.Printf("Failed to lookup name=%q: %v", name, err)
 		http.Error(resp, fmt.Sprintf("Failed to lookup name %q.", name), http.StatusInternalServerError)
 		return
 	}
-	if !ok {
+	// Private links look like they don't exist to everyone else.
+	user, groups := gl.user(req), gl.groups(req)
+	l, fromFallback := res.link, false
+	if l == nil && res.archived == nil {
+		l = gl.fallback(ctx, name)
+		fromFallback = l != nil
+	}
+	// Only successful redirects are cached, for as long as their link allows.
+	resp.Header().Set("Cache-Control", "no-store")
+	if l == nil || !l.VisibleTo(user, groups) {
+		// Explain that a link has expired rather than that it never existed.
+		if a := res.archived; a != nil && a.VisibleTo(user, groups) {
+			gl.metrics.inactive()
+			gl.inactiveHandler(resp, req, a, time.Now())
+			return
+		}
+		gl.metrics.redirect(false)
 		http.NotFound(resp, req)
 		return
 	}
-	http.Redirect(resp, req, l.Link.String(), http.StatusTemporaryRedirect)
+	if now := time.Now(); l.Pending(now) || l.Expired(now) {
+		gl.metrics.inactive()
+		gl.inactiveHandler(resp, req, l, now)
+		return
+	}
+	if fromFallback {
+		gl.metrics.fallback()
+	} else {
+		gl.metrics.redirect(true)
+	}
+	// Don't tell the destination, which may be outside, which go link led
+	// there.
+	resp.Header().Set("Referrer-Policy", "no-referrer")
+	resp.Header().Set("Cache-Control", cacheControl(l, time.Now()))
+	http.Redirect(resp, req, l.Expand(args).String(), l.RedirectStatus())
+}
+
+// visibleLink reads the link called name. It returns link.ErrNotFound if the
+// user of req can't see it, so that private links can't be discovered.
+func (gl *GoLink) visibleLink(req *http.Request, name string) (*link.Record, error) {
+	done := gl.metrics.timeQuery("read")
+	l, err := link.Read(req.Context(), gl.db, name)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	if !l.VisibleTo(gl.user(req), gl.groups(req)) {
+		return nil, link.ErrNotFound
+	}
+	return l, nil
 }
 
-func (gl *GoLink) linkByName(ctx context.Context, name string) (*link.Record, bool, error) {
-	const query = "select (url) from links where name=?;"
-	row := gl.db.QueryRowContext(ctx, query, name)
-	var s string
-	if err := row.Scan(&s); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, false, nil
+// errLinkQuota means that a user has created Options.MaxLinksPerUser links.
+var errLinkQuota = errors.New("link limit reached")
+
+// createLink creates a link on behalf of user, unless they have reached
+// Options.MaxLinksPerUser.
+func (gl *GoLink) createLink(ctx context.Context, user, name, address string, opts ...link.Option) error {
+	if max := gl.opts.MaxLinksPerUser; max > 0 && user != "" {
+		// Concurrent requests can go slightly over the limit, which is fine
+		// for stopping runaway scripts.
+		n, err := link.CountCreatedBy(ctx, gl.db, user)
+		if err != nil {
+			return fmt.Errorf("failed to count links: %w", err)
 		}
-		return nil, false, err
+		if n >= max {
+			return errLinkQuota
+		}
+	}
+	done := gl.metrics.timeQuery("create")
+	err := link.Create(ctx, gl.db, name, address, append([]link.Option{link.CreatedBy(user)}, opts...)...)
+	done()
+	// A failed lookup of name may have been cached.
+	gl.changed(name)
+	if err != nil {
+		gl.metrics.linkError("create", err)
+	}
+	return err
+}
+
+// updateLink renames the link called oldName to newName and points it at
+// address.
+func (gl *GoLink) updateLink(ctx context.Context, oldName, newName, address string, opts ...link.Option) error {
+	done := gl.metrics.timeQuery("update")
+	err := link.Update(ctx, gl.db, oldName, newName, address, opts...)
+	done()
+	gl.changed(oldName, newName)
+	if err != nil {
+		gl.metrics.linkError("update", err)
+	}
+	return err
+}
+
+// deleteLink moves the link called name to the trash on behalf of user.
+func (gl *GoLink) deleteLink(ctx context.Context, name, user string, opts ...link.Option) error {
+	done := gl.metrics.timeQuery("delete")
+	err := link.Delete(ctx, gl.db, name, user, opts...)
+	done()
+	gl.changed(name)
+	if err != nil {
+		gl.metrics.linkError("delete", err)
+	}
+	return err
+}
+
+// changedBy describes when and by whom a link was changed, as far as that's
+// known.
+func changedBy(at time.Time, user string) string {
+	var parts []string
+	if !at.IsZero() {
+		parts = append(parts, "at "+at.UTC().Format(displayLayout))
+	}
+	if user != "" {
+		parts = append(parts, "by "+user)
+	}
+	if len(parts) == 0 {
+		return "unknown"
+	}
+	return strings.Join(parts, " ")
+}
+
+// description cleans up the description of a link from a form or the API.
+// Templates escape it, so it's stored as is.
+func description(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// parseRevision reads the revision field of a form, which holds the revision
+// of the link that the user saw, into an option that makes the change fail
+// with link.ErrConflict if the link has changed since. It responds with an
+// error and returns false if the field is invalid.
+func parseRevision(resp http.ResponseWriter, req *http.Request) ([]link.Option, bool) {
+	s := req.PostForm.Get("revision")
+	if s == "" {
+		return nil, true
+	}
+	revision, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		http.Error(resp, fmt.Sprintf("Invalid revision %q.", s), http.StatusBadRequest)
+		return nil, false
 	}
-	u, err := url.Parse(s)
+	return []link.Option{link.IfRevision(revision)}, true
+}
+
+// conflict responds to a change of the link called name that failed with
+// link.ErrConflict with the link as it is now, so that the user can review
+// what changed and try again.
+func (gl *GoLink) conflict(resp http.ResponseWriter, req *http.Request, name string) {
+	record, err := gl.visibleLink(req, name)
+	if err != nil {
+		http.Error(resp, "The link was changed since you opened it.", http.StatusConflict)
+		return
+	}
+	warning := fmt.Sprintf("This link was changed %s since you opened it. Review the changes below and try again.",
+		changedBy(record.UpdatedAt, record.UpdatedBy))
+	gl.renderGoLink(resp, req, record, warning, http.StatusConflict)
+}
+
+// parseVisibility reads the visibility and group fields of a form for a link
+// owned by owner. It responds with an error and returns false if they're
+// invalid.
+func parseVisibility(resp http.ResponseWriter, req *http.Request, owner string) (link.Visibility, string, bool) {
+	v, err := link.ParseVisibility(req.PostForm.Get("visibility"))
 	if err != nil {
-		return nil, false, err
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+	group := strings.TrimSpace(req.PostForm.Get("group"))
+	if v == link.Private && owner == "" && group == "" {
+		http.Error(resp, "A private link needs a signed-in owner or a group.", http.StatusBadRequest)
+		return "", "", false
 	}
-	return &link.Record{Name: name, Link: u}, true, nil
+	return v, group, true
 }
 
 func (gl *GoLink) staticFileHandler(resp http.ResponseWriter, req *http.Request) {
@@ -365,7 +1002,11 @@ func (gl *GoLink) staticFileHandler(resp http.ResponseWriter, req *http.Request)
 }
 
 func (gl *GoLink) docsHandler(resp http.ResponseWriter, req *http.Request) {
-	if err := docsPage.ExecuteTemplate(resp, "docs.tmpl.html", nil); err != nil {
+	d := struct {
+		page
+		ExpiryWarning string
+	}{gl.page(req), describeDuration(gl.opts.ExpiryWarning)}
+	if err := docsPage.ExecuteTemplate(resp, "docs.tmpl.html", d); err != nil {
 		http.Error(resp, "Unable to render docs.", http.StatusInternalServerError)
 		log.Printf("Unable to render docs: %v", err)
 	}
@@ -377,11 +1018,3 @@ func mustReadFile(b []byte, err error) []byte {
 	}
 	return b
 }
-
-// escape makes s safe to put in html and logs.
-func escape(s string) string {
-	s = html.EscapeString(s)
-	s = strings.ReplaceAll(s, "\n", "")
-	s = strings.ReplaceAll(s, "\r", "")
-	return s
-}
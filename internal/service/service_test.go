@@ -1,27 +1,54 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"database/sql"
 	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/netip"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/spwg/golink/internal/datastore"
+	"github.com/spwg/golink/internal/forwarded"
 	"github.com/spwg/golink/internal/golinktest"
 	"github.com/spwg/golink/internal/link"
 )
 
+// testOptions returns the options of a service that's served at
+// https://golinkservice.com.
+func testOptions() Options {
+	return Options{
+		BaseURL:    &url.URL{Scheme: "https", Host: "golinkservice.com"},
+		ShortHosts: []string{"go"},
+		// The tests act as the proxy in front of the service.
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")},
+	}
+}
+
 func TestIndex(t *testing.T) {
 	ctx, stop := context.WithCancel(context.Background())
 	defer stop()
 	db := golinktest.NewDatabase(ctx, t)
 	l := golinktest.Listen(ctx, t)
-	go golinktest.RunServer(ctx, t, New(db, "example.com"), l)
+	go golinktest.RunServer(ctx, t, New(db, testOptions()), l)
 	time.Sleep(500 * time.Millisecond)
 	url := "http://" + l.Addr().String()
 	resp, err := http.Get(url)
@@ -46,7 +73,7 @@ func TestGoLinkPage(t *testing.T) {
 	db := golinktest.NewDatabase(ctx, t)
 	addEntry(ctx, t, db, "foo", "http://example.com")
 	l := golinktest.Listen(ctx, t)
-	go golinktest.RunServer(ctx, t, New(db, "example.com"), l)
+	go golinktest.RunServer(ctx, t, New(db, testOptions()), l)
 	time.Sleep(500 * time.Millisecond)
 	url := "http://" + l.Addr().String() + "/golink/foo"
 	resp, err := http.Get(url)
@@ -75,7 +102,9 @@ func TestRedirect(t *testing.T) {
 	db := golinktest.NewDatabase(ctx, t)
 	addEntry(ctx, t, db, "foo", "http://example.com")
 	l := golinktest.Listen(ctx, t)
-	go golinktest.RunServer(ctx, t, New(db, "golinkservice.com"), l)
+	opts := testOptions()
+	opts.EnforceHTTPS = true
+	go golinktest.RunServer(ctx, t, New(db, opts), l)
 	time.Sleep(500 * time.Millisecond)
 	t.Run("rewrite host", func(t *testing.T) {
 		addr := "http://" + l.Addr().String()
@@ -92,7 +121,7 @@ func TestRedirect(t *testing.T) {
 		if err != nil {
 			t.Fatalf("GET %q returned err=%v, want nil", "http://go", err)
 		}
-		if got, want := resp.StatusCode, http.StatusMovedPermanently; got != want {
+		if got, want := resp.StatusCode, http.StatusTemporaryRedirect; got != want {
 			t.Errorf("GET %q returned code=%v, want %v", "http://go", got, want)
 		}
 		l, err := resp.Location()
@@ -103,6 +132,26 @@ func TestRedirect(t *testing.T) {
 			t.Errorf("GET %q returned location=%q, want %q", "http://go", got, want)
 		}
 	})
+	t.Run("rewrite host with name", func(t *testing.T) {
+		addr := "http://" + l.Addr().String() + "/foo?bar=baz"
+		req, err := http.NewRequest(http.MethodGet, addr, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "GO"
+		client := http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("GET %q returned err=%v, want nil", "http://GO/foo?bar=baz", err)
+		}
+		if got, want := resp.Header.Get("Location"), "https://golinkservice.com/go/foo?bar=baz"; got != want {
+			t.Errorf("GET %q returned location=%q, want %q", "http://GO/foo?bar=baz", got, want)
+		}
+	})
 	t.Run("redirect http", func(t *testing.T) {
 		addr := "http://" + l.Addr().String()
 		req, err := http.NewRequest(http.MethodGet, addr, nil)
@@ -118,7 +167,7 @@ func TestRedirect(t *testing.T) {
 		if err != nil {
 			t.Fatalf("GET %q returned err=%v, want nil", addr, err)
 		}
-		if got, want := resp.StatusCode, http.StatusMovedPermanently; got != want {
+		if got, want := resp.StatusCode, http.StatusTemporaryRedirect; got != want {
 			t.Errorf("GET %q returned code=%v, want %v", addr, got, want)
 		}
 		l, err := resp.Location()
@@ -129,6 +178,75 @@ func TestRedirect(t *testing.T) {
 			t.Errorf("GET %q returned location=%q, want %q", addr, got, want)
 		}
 	})
+	t.Run("forwarded https", func(t *testing.T) {
+		addr := "http://" + l.Addr().String() + "/go/foo"
+		req, err := http.NewRequest(http.MethodGet, addr, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Forwarded-Proto", "https")
+		client := http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("GET %q returned err=%v, want nil", addr, err)
+		}
+		if got, want := resp.Header.Get("Location"), "http://example.com"; got != want {
+			t.Errorf("GET %q returned location=%q, want %q", addr, got, want)
+		}
+	})
+}
+
+func TestUntrustedProxy(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	db := golinktest.NewDatabase(ctx, t)
+	addEntry(ctx, t, db, "foo", "http://example.com")
+	l := golinktest.Listen(ctx, t)
+	opts := testOptions()
+	opts.EnforceHTTPS = true
+	opts.TrustedProxies = nil
+	go golinktest.RunServer(ctx, t, New(db, opts), l)
+	time.Sleep(500 * time.Millisecond)
+	addr := "http://" + l.Addr().String() + "/go/foo"
+	req, err := http.NewRequest(http.MethodGet, addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-Proto", "https")
+	client := http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("GET %q returned err=%v, want nil", addr, err)
+	}
+	if got, want := resp.Header.Get("Location"), "https://golinkservice.com/go/foo"; got != want {
+		t.Errorf("GET %q with a spoofed X-Forwarded-Proto returned location=%q, want %q", addr, got, want)
+	}
+}
+
+// formRequest returns a request that posts form to target with a CSRF token,
+// like the forms of the service do.
+func formRequest(t *testing.T, target string, form url.Values) *http.Request {
+	t.Helper()
+	const token = "test-csrf-token"
+	f := url.Values{csrfField: {token}}
+	for k, v := range form {
+		f[k] = v
+	}
+	req, err := http.NewRequest(http.MethodPost, target, strings.NewReader(f.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: csrfCookie, Value: token})
+	return req
 }
 
 func TestCreate(t *testing.T) {
@@ -136,7 +254,7 @@ func TestCreate(t *testing.T) {
 	defer stop()
 	db := golinktest.NewDatabase(ctx, t)
 	l := golinktest.Listen(ctx, t)
-	go golinktest.RunServer(ctx, t, New(db, "golinkservice.com"), l)
+	go golinktest.RunServer(ctx, t, New(db, testOptions()), l)
 	time.Sleep(500 * time.Millisecond)
 	type testCase struct {
 		name     string
@@ -144,6 +262,7 @@ func TestCreate(t *testing.T) {
 		linkAddr string
 		wantName string
 		wantAddr string
+		wantCode int
 	}
 	testCases := []testCase{
 		{
@@ -154,18 +273,24 @@ func TestCreate(t *testing.T) {
 			wantAddr: "http://example.com",
 		},
 		{
-			name:     "escape html",
-			linkName: "<alert>foo</alert>",
+			name:     "html characters",
+			linkName: "<b>foo&bar",
+			linkAddr: "http://example.com/?a=1&b=2",
+			wantName: "<b>foo&bar",
+			wantAddr: "http://example.com/?a=1&b=2",
+		},
+		{
+			name:     "surrounding whitespace",
+			linkName: " baz\n",
 			linkAddr: "http://example.com",
-			wantName: "&lt;alert&gt;foo&lt;/alert&gt;",
+			wantName: "baz",
 			wantAddr: "http://example.com",
 		},
 		{
-			name:     "escape new lines",
+			name:     "new lines",
 			linkName: "foo\nbar",
 			linkAddr: "http://example.com",
-			wantName: "foobar",
-			wantAddr: "http://example.com",
+			wantCode: http.StatusBadRequest,
 		},
 	}
 	for _, tc := range testCases {
@@ -179,7 +304,7 @@ func TestCreate(t *testing.T) {
 					return http.ErrUseLastResponse
 				},
 			}
-			resp, err := client.PostForm(postPath, form)
+			resp, err := client.Do(formRequest(t, postPath, form))
 			if err != nil {
 				t.Fatalf("Failed to post name=%q and link=%q: %v", tc.linkName, tc.linkAddr, err)
 			}
@@ -188,66 +313,1795 @@ func TestCreate(t *testing.T) {
 				t.Error(err)
 			}
 			s := string(b)
-			if got, want := resp.StatusCode, http.StatusSeeOther; got != want {
+			want := tc.wantCode
+			if want == 0 {
+				want = http.StatusSeeOther
+			}
+			if got := resp.StatusCode; got != want {
 				t.Fatalf("Error posting name=%q and link=%q: got http status code %v, want %v\n%s", tc.linkName, tc.linkAddr, got, want, s)
 			}
-			if _, err := link.Read(ctx, db, tc.wantName); err != nil {
+			if tc.wantName == "" {
+				return
+			}
+			r, err := link.Read(ctx, db, tc.wantName)
+			if err != nil {
 				t.Fatal(err)
 			}
+			if got := r.Link.String(); got != tc.wantAddr {
+				t.Errorf("Read(%q) has address %q, want %q", tc.wantName, got, tc.wantAddr)
+			}
 		})
 	}
 }
 
-func TestRead(t *testing.T) {
+func TestRateLimit(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	db := golinktest.NewDatabase(ctx, t)
+	l := golinktest.Listen(ctx, t)
+	opts := testOptions()
+	opts.UserHeader = "X-Forwarded-User"
+	opts.RedirectLimit = RateLimit{Rate: 0.001, Burst: 2}
+	opts.WriteLimit = RateLimit{Rate: 0.001, Burst: 3}
+	opts.MaxLinksPerUser = 1
+	go golinktest.RunServer(ctx, t, New(db, opts), l)
+	time.Sleep(500 * time.Millisecond)
+	addEntry(ctx, t, db, "foo", "http://example.com")
+	client := http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	base := "http://" + l.Addr().String()
+	do := func(method, path, user, clientIP string, form url.Values) *http.Response {
+		t.Helper()
+		req := formRequest(t, base+path, form)
+		req.Method = method
+		req.Header.Set("X-Forwarded-For", clientIP)
+		if user != "" {
+			req.Header.Set("X-Forwarded-User", user)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("redirects", func(t *testing.T) {
+		for i, want := range []int{http.StatusTemporaryRedirect, http.StatusTemporaryRedirect, http.StatusTooManyRequests} {
+			resp := do("GET", "/go/foo", "", "198.51.100.1", nil)
+			if got := resp.StatusCode; got != want {
+				t.Fatalf("Request #%d returned status %v, want %v", i, got, want)
+			}
+			if want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+				t.Errorf("Response with status %v has no Retry-After header", resp.StatusCode)
+			}
+		}
+		// Other clients have their own limit.
+		if got, want := do("GET", "/go/foo", "", "198.51.100.2", nil).StatusCode, http.StatusTemporaryRedirect; got != want {
+			t.Errorf("Request from another client returned status %v, want %v", got, want)
+		}
+	})
+
+	t.Run("users", func(t *testing.T) {
+		// A user is limited across all of their addresses.
+		do("GET", "/go/foo", "alice", "198.51.100.3", nil)
+		do("GET", "/go/foo", "alice", "198.51.100.4", nil)
+		if got, want := do("GET", "/go/foo", "alice", "198.51.100.5", nil).StatusCode, http.StatusTooManyRequests; got != want {
+			t.Errorf("Request over the user's limit returned status %v, want %v", got, want)
+		}
+	})
+
+	t.Run("links per user", func(t *testing.T) {
+		form := url.Values{"name": {"bar"}, "link": {"http://example.com"}}
+		if got, want := do("POST", "/create_golink", "bob", "198.51.100.6", form).StatusCode, http.StatusSeeOther; got != want {
+			t.Fatalf("First create returned status %v, want %v", got, want)
+		}
+		form.Set("name", "baz")
+		if got, want := do("POST", "/create_golink", "bob", "198.51.100.7", form).StatusCode, http.StatusForbidden; got != want {
+			t.Errorf("Create over the user's link limit returned status %v, want %v", got, want)
+		}
+	})
+
+	t.Run("writes", func(t *testing.T) {
+		form := url.Values{"name": {"missing"}}
+		for i, want := range []int{http.StatusNotFound, http.StatusNotFound, http.StatusNotFound, http.StatusTooManyRequests} {
+			if got := do("POST", "/delete_golink", "", "198.51.100.8", form).StatusCode; got != want {
+				t.Fatalf("Request #%d returned status %v, want %v", i, got, want)
+			}
+		}
+	})
+}
+
+func TestCSRF(t *testing.T) {
 	ctx, stop := context.WithCancel(context.Background())
 	defer stop()
 	db := golinktest.NewDatabase(ctx, t)
 	l := golinktest.Listen(ctx, t)
-	go golinktest.RunServer(ctx, t, New(db, "golinkservice.com"), l)
+	go golinktest.RunServer(ctx, t, New(db, testOptions()), l)
 	time.Sleep(500 * time.Millisecond)
+	addEntry(ctx, t, db, "foo", "http://example.com")
+	base := "http://" + l.Addr().String()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(base + "/golink/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := regexp.MustCompile(`name="csrf_token" value="([0-9a-f]+)"`).FindSubmatch(b)
+	if m == nil {
+		t.Fatalf("GET /golink/foo returned a page without a CSRF token:\n%s", b)
+	}
+	token := string(m[1])
+	for _, c := range resp.Cookies() {
+		if c.Name == csrfCookie && c.SameSite != http.SameSiteLaxMode {
+			t.Errorf("CSRF cookie has SameSite=%v, want %v", c.SameSite, http.SameSiteLaxMode)
+		}
+	}
+
 	type testCase struct {
-		name     string
-		linkName string
-		linkAddr string
-		wantName string
-		wantAddr string
+		name   string
+		token  string
+		header http.Header
+		want   int
 	}
 	testCases := []testCase{
 		{
-			name:     "ok",
-			linkName: "foo",
-			linkAddr: "http://example.com",
-			wantName: "foo",
-			wantAddr: "http://example.com",
+			name:  "missing token",
+			token: "",
+			want:  http.StatusForbidden,
+		},
+		{
+			name:  "wrong token",
+			token: strings.Repeat("0", 64),
+			want:  http.StatusForbidden,
+		},
+		{
+			name:   "cross site",
+			token:  token,
+			header: http.Header{"Sec-Fetch-Site": {"cross-site"}},
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "other origin",
+			token:  token,
+			header: http.Header{"Origin": {"https://evil.example.com"}},
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "api call",
+			token:  "",
+			header: http.Header{"Authorization": {"Bearer secret"}},
+			want:   http.StatusNotFound,
+		},
+		{
+			name:   "ok",
+			token:  token,
+			header: http.Header{"Sec-Fetch-Site": {"same-origin"}, "Origin": {base}},
+			want:   http.StatusSeeOther,
 		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			addEntry(ctx, t, db, tc.linkName, tc.linkAddr)
-			client := http.Client{}
-			getPath := "http://" + l.Addr().String() + "/golink/" + tc.linkName
-			resp, err := client.Get(getPath)
+			name := "foo"
+			if tc.want == http.StatusNotFound {
+				name = "missing"
+			}
+			form := url.Values{"name": {name}, csrfField: {tc.token}}
+			req, err := http.NewRequest(http.MethodPost, base+"/delete_golink", strings.NewReader(form.Encode()))
 			if err != nil {
 				t.Fatal(err)
 			}
-			b, err := io.ReadAll(resp.Body)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			resp, err := client.Do(req)
 			if err != nil {
 				t.Fatal(err)
 			}
-			s := string(b)
-			if got, want := resp.StatusCode, http.StatusOK; got != want {
-				t.Errorf("Failed to get %q: status code = %v, want %v", getPath, got, want)
+			resp.Body.Close()
+			if got := resp.StatusCode; got != tc.want {
+				t.Errorf("POST /delete_golink returned status %v, want %v", got, tc.want)
 			}
-			if !strings.Contains(s, tc.wantName) {
-				t.Errorf("Get %q response does not contain name %q, want it to contain %q", getPath, tc.wantName, tc.wantName)
+		})
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	db := golinktest.NewDatabase(ctx, t)
+	addEntry(ctx, t, db, "foo", "http://example.com")
+	nonceRE := regexp.MustCompile(`script-src 'nonce-([^']+)'`)
+
+	t.Run("no analytics", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		New(db, testOptions()).handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		want := map[string]string{
+			"X-Content-Type-Options": "nosniff",
+			"X-Frame-Options":        "DENY",
+			"Referrer-Policy":        "same-origin",
+		}
+		for k, v := range want {
+			if got := rec.Header().Get(k); got != v {
+				t.Errorf("%s=%q, want %q", k, got, v)
 			}
-			if !strings.Contains(s, tc.wantAddr) {
-				t.Errorf("Get %q response does not contain addr %q, want it to contain %q", getPath, tc.wantAddr, tc.wantAddr)
+		}
+		csp := rec.Header().Get("Content-Security-Policy")
+		if !strings.Contains(csp, "default-src 'none'") || !nonceRE.MatchString(csp) {
+			t.Errorf("Content-Security-Policy=%q, want a strict policy with a script nonce", csp)
+		}
+		if body := rec.Body.String(); strings.Contains(body, "googletagmanager") {
+			t.Errorf("GET / returned a page with analytics, want none:\n%s", body)
+		}
+	})
+
+	t.Run("analytics", func(t *testing.T) {
+		opts := testOptions()
+		opts.AnalyticsID = "G-TEST"
+		rec := httptest.NewRecorder()
+		New(db, opts).handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		m := nonceRE.FindStringSubmatch(rec.Header().Get("Content-Security-Policy"))
+		if m == nil {
+			t.Fatalf("Content-Security-Policy=%q has no script nonce", rec.Header().Get("Content-Security-Policy"))
+		}
+		body := rec.Body.String()
+		if !strings.Contains(body, "id=G-TEST") || !strings.Contains(body, `nonce="`+m[1]+`"`) {
+			t.Errorf("GET / returned a page without nonced analytics for G-TEST:\n%s", body)
+		}
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		New(db, testOptions()).handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/go/foo", nil))
+		if got, want := rec.Code, http.StatusTemporaryRedirect; got != want {
+			t.Fatalf("GET /go/foo returned status %v, want %v", got, want)
+		}
+		if got, want := rec.Header().Get("Referrer-Policy"), "no-referrer"; got != want {
+			t.Errorf("Referrer-Policy=%q, want %q", got, want)
+		}
+	})
+}
+
+func TestVisibility(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	db := golinktest.NewDatabase(ctx, t)
+	opts := testOptions()
+	opts.UserHeader = "X-Forwarded-User"
+	opts.GroupsHeader = "X-Forwarded-Groups"
+	h := New(db, opts).handler()
+	do := func(method, target, user, groups string, form url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		req := formRequest(t, "http://golinkservice.com"+target, form)
+		req.Method = method
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("X-Forwarded-Proto", "https")
+		if user != "" {
+			req.Header.Set("X-Forwarded-User", user)
+		}
+		if groups != "" {
+			req.Header.Set("X-Forwarded-Groups", groups)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	for name, visibility := range map[string]string{"pub": "public", "unl": "unlisted", "priv": "private"} {
+		form := url.Values{"name": {name}, "link": {"http://example.com"}, "visibility": {visibility}, "group": {"hr"}}
+		if rec := do(http.MethodPost, "/create_golink", "alice", "", form); rec.Code != http.StatusSeeOther {
+			t.Fatalf("Creating %q returned status %v, want %v\n%s", name, rec.Code, http.StatusSeeOther, rec.Body)
+		}
+	}
+	if rec := do(http.MethodPost, "/create_golink", "", "", url.Values{"name": {"anon"}, "link": {"http://example.com"}, "visibility": {"private"}}); rec.Code != http.StatusBadRequest {
+		t.Errorf("Creating a private link without an owner or group returned status %v, want %v", rec.Code, http.StatusBadRequest)
+	}
+
+	type testCase struct {
+		name       string
+		user       string
+		groups     string
+		wantPriv   int
+		wantListed []string
+		wantHidden []string
+	}
+	testCases := []testCase{
+		{
+			name:       "anonymous",
+			wantPriv:   http.StatusNotFound,
+			wantListed: []string{"pub"},
+			wantHidden: []string{"unl", "priv"},
+		},
+		{
+			name:       "other user",
+			user:       "bob",
+			groups:     "eng",
+			wantPriv:   http.StatusNotFound,
+			wantListed: []string{"pub"},
+			wantHidden: []string{"unl", "priv"},
+		},
+		{
+			name:       "group member",
+			user:       "carol",
+			groups:     "eng, hr",
+			wantPriv:   http.StatusTemporaryRedirect,
+			wantListed: []string{"pub", "priv"},
+			wantHidden: []string{"unl"},
+		},
+		{
+			name:       "owner",
+			user:       "alice",
+			wantPriv:   http.StatusTemporaryRedirect,
+			wantListed: []string{"pub", "unl", "priv"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got, want := do(http.MethodGet, "/go/unl", tc.user, tc.groups, nil).Code, http.StatusTemporaryRedirect; got != want {
+				t.Errorf("GET /go/unl returned status %v, want %v", got, want)
+			}
+			if got := do(http.MethodGet, "/go/priv", tc.user, tc.groups, nil).Code; got != tc.wantPriv {
+				t.Errorf("GET /go/priv returned status %v, want %v", got, tc.wantPriv)
+			}
+			if tc.wantPriv == http.StatusNotFound {
+				if got, want := do(http.MethodGet, "/golink/priv", tc.user, tc.groups, nil).Code, http.StatusNotFound; got != want {
+					t.Errorf("GET /golink/priv returned status %v, want %v", got, want)
+				}
+				if got, want := do(http.MethodPost, "/delete_golink", tc.user, tc.groups, url.Values{"name": {"priv"}}).Code, http.StatusNotFound; got != want {
+					t.Errorf("POST /delete_golink for priv returned status %v, want %v", got, want)
+				}
+			}
+			index := do(http.MethodGet, "/", tc.user, tc.groups, nil).Body.String()
+			for _, name := range tc.wantListed {
+				if !strings.Contains(index, `href="/golink/`+name+`"`) {
+					t.Errorf("Index doesn't list %q, want it to", name)
+				}
+			}
+			for _, name := range tc.wantHidden {
+				if strings.Contains(index, `href="/golink/`+name+`"`) {
+					t.Errorf("Index lists %q, want it hidden", name)
+				}
 			}
 		})
 	}
 }
 
-func init() {
-	log.Default().SetFlags(log.LstdFlags | log.Lshortfile)
+func TestSchedule(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	h := New(db, testOptions()).handler()
+	now := time.Now()
+	create := func(name string, notBefore, expiresAt time.Time) {
+		t.Helper()
+		if err := link.Create(ctx, db, name, "http://example.com", link.WithSchedule(notBefore, expiresAt)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	create("pending", now.Add(time.Hour), time.Time{})
+	create("expired", time.Time{}, now.Add(-time.Minute))
+	create("archived", time.Time{}, now.Add(-time.Hour))
+	create("soon", time.Time{}, now.Add(24*time.Hour))
+	if _, err := link.ArchiveExpired(ctx, db, now.Add(-30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+	type testCase struct {
+		name     string
+		wantCode int
+		wantBody string
+	}
+	testCases := []testCase{
+		{name: "pending", wantCode: http.StatusNotFound, wantBody: "isn't active yet"},
+		{name: "expired", wantCode: http.StatusGone, wantBody: "has expired"},
+		{name: "archived", wantCode: http.StatusGone, wantBody: "has expired"},
+		{name: "soon", wantCode: http.StatusTemporaryRedirect},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := get("/go/" + tc.name)
+			if rec.Code != tc.wantCode {
+				t.Errorf("GET /go/%s returned status %v, want %v", tc.name, rec.Code, tc.wantCode)
+			}
+			if !strings.Contains(rec.Body.String(), tc.wantBody) {
+				t.Errorf("GET /go/%s returned a page without %q:\n%s", tc.name, tc.wantBody, rec.Body)
+			}
+		})
+	}
+	if body := get("/golink/soon").Body.String(); !strings.Contains(body, "This link expires in") {
+		t.Errorf("GET /golink/soon returned a page without an expiry warning:\n%s", body)
+	}
+	if body := get("/golink/pending").Body.String(); strings.Contains(body, "This link expires in") {
+		t.Errorf("GET /golink/pending returned a page with an expiry warning:\n%s", body)
+	}
+	if body := get("/docs").Body.String(); !strings.Contains(body, "7 days before a link expires") {
+		t.Errorf("GET /docs returned a page without the default expiry warning of 7 days:\n%s", body)
+	}
+	opts := testOptions()
+	opts.ExpiryWarning = 36 * time.Hour
+	h = New(db, opts).handler()
+	if body := get("/docs").Body.String(); !strings.Contains(body, "36 hours before") {
+		t.Errorf("GET /docs returned a page without the configured expiry warning of 36 hours:\n%s", body)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	opts := testOptions()
+	opts.UserHeader = "X-Forwarded-User"
+	h := New(db, opts).handler()
+	addEntry(ctx, t, db, "foo", "http://example.com/old")
+	post := func(target string, form url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		req := formRequest(t, "http://golinkservice.com"+target, form)
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("X-Forwarded-User", "bob")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := post("/delete_golink", url.Values{"name": {"foo"}})
+	if got, want := rec.Code, http.StatusSeeOther; got != want {
+		t.Fatalf("POST /delete_golink returned status %v, want %v", got, want)
+	}
+	if got, want := rec.Header().Get("Location"), "/trash?deleted=foo"; got != want {
+		t.Errorf("POST /delete_golink redirected to %q, want %q", got, want)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/trash?deleted=foo", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, "Deleted go/foo") || !strings.Contains(body, "Deleted by bob") {
+		t.Errorf("GET /trash returned a page without the deleted link:\n%s", body)
+	}
+	m := regexp.MustCompile(`name="id" value="(\d+)"`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("GET /trash returned a page without a restore form:\n%s", body)
+	}
+	id := m[1]
+
+	addEntry(ctx, t, db, "foo", "http://example.com/new")
+	if got, want := post("/restore_golink", url.Values{"id": {id}}).Code, http.StatusConflict; got != want {
+		t.Errorf("Restoring over a new link returned status %v, want %v", got, want)
+	}
+	post("/delete_golink", url.Values{"name": {"foo"}})
+	if got, want := post("/restore_golink", url.Values{"id": {id}}).Code, http.StatusSeeOther; got != want {
+		t.Fatalf("POST /restore_golink returned status %v, want %v", got, want)
+	}
+	r, err := link.Read(ctx, db, "foo")
+	if err != nil {
+		t.Fatalf("Read() of the restored link failed: %v", err)
+	}
+	if got, want := r.Link.String(), "http://example.com/old"; got != want {
+		t.Errorf("Restored link points to %q, want %q", got, want)
+	}
+
+	// Deleted unlisted links are only listed for their creator and for the
+	// user who deleted them.
+	if err := link.Create(ctx, db, "secret", "http://example.com/secret", link.CreatedBy("alice"), link.WithVisibility(link.Unlisted, "")); err != nil {
+		t.Fatal(err)
+	}
+	if err := link.Delete(ctx, db, "secret", "carol"); err != nil {
+		t.Fatal(err)
+	}
+	trash, err := link.ListTrash(ctx, db)
+	if err != nil || len(trash) == 0 || trash[0].Name != "secret" {
+		t.Fatalf("ListTrash() = %v, %v, want the deleted unlisted link first", trash, err)
+	}
+	secretID := strconv.FormatInt(trash[0].ID, 10)
+	for user, want := range map[string]bool{"": false, "bob": false, "alice": true, "carol": true} {
+		req := httptest.NewRequest(http.MethodGet, "/trash", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		if user != "" {
+			req.Header.Set("X-Forwarded-User", user)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if got := strings.Contains(rec.Body.String(), "example.com/secret"); got != want {
+			t.Errorf("GET /trash as %q lists the deleted unlisted link: %v, want %v", user, got, want)
+		}
+	}
+	if got, want := post("/restore_golink", url.Values{"id": {secretID}}).Code, http.StatusNotFound; got != want {
+		t.Errorf("Restoring the deleted unlisted link of alice as bob returned status %v, want %v", got, want)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	opts := testOptions()
+	opts.UserHeader = "X-Forwarded-User"
+	h := New(db, opts).handler()
+	post := func(target string, form url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		req := formRequest(t, "http://golinkservice.com"+target, form)
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("X-Forwarded-User", "bob")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	get := func(target string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec.Body.String()
+	}
+	if got, want := post("/create_golink", url.Values{"name": {"pager"}, "link": {"http://example.com/pager"}, "description": {"Who is\non call"}, "tags": {"OnCall, sre"}}).Code, http.StatusSeeOther; got != want {
+		t.Fatalf("POST /create_golink returned status %v, want %v", got, want)
+	}
+	if got, want := post("/create_golink", url.Values{"name": {"wiki"}, "link": {"http://example.com/wiki"}, "tags": {"docs"}}).Code, http.StatusSeeOther; got != want {
+		t.Fatalf("POST /create_golink returned status %v, want %v", got, want)
+	}
+	if got, want := post("/create_golink", url.Values{"name": {"bad"}, "link": {"http://example.com"}, "tags": {"not<ok>"}}).Code, http.StatusBadRequest; got != want {
+		t.Errorf("POST /create_golink with an invalid tag returned status %v, want %v", got, want)
+	}
+	r, err := link.Read(ctx, db, "pager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.Description, "Who is on call"; got != want {
+		t.Errorf("Description = %q, want %q", got, want)
+	}
+	if got, want := strings.Join(r.Tags, ","), "oncall,sre"; got != want {
+		t.Errorf("Tags = %q, want %q", got, want)
+	}
+
+	body := get("/?tag=oncall")
+	if !strings.Contains(body, `href="/golink/pager"`) || strings.Contains(body, `href="/golink/wiki"`) {
+		t.Errorf("GET /?tag=oncall returned the wrong links:\n%s", body)
+	}
+	if body := get("/"); !strings.Contains(body, `href="/golink/pager"`) || !strings.Contains(body, `href="/golink/wiki"`) {
+		t.Errorf("GET / left out links:\n%s", body)
+	}
+
+	// An update without the metadata fields keeps them.
+	post("/update_golink", url.Values{"old_name": {"pager"}, "name": {"pager"}, "link": {"http://example.com/pager2"}})
+	if r, err = link.Read(ctx, db, "pager"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.Link.String(), "http://example.com/pager2"; got != want {
+		t.Fatalf("Link after the update = %q, want %q", got, want)
+	}
+	if r.Description != "Who is on call" || len(r.Tags) != 2 {
+		t.Errorf("Update without metadata changed it to %q %q", r.Description, r.Tags)
+	}
+	if got, want := r.UpdatedBy, "bob"; got != want {
+		t.Errorf("UpdatedBy = %q, want %q", got, want)
+	}
+	if body := get("/golink/pager"); !strings.Contains(body, "Who is on call") || !strings.Contains(body, "oncall, sre") {
+		t.Errorf("GET /golink/pager returned a page without the metadata:\n%s", body)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	opts := testOptions()
+	opts.UserHeader = "X-Forwarded-User"
+	h := New(db, opts).handler()
+	do := func(method, target, body string) (int, map[string]any) {
+		t.Helper()
+		req := httptest.NewRequest(method, "http://golinkservice.com"+target, strings.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("X-Forwarded-User", "bob")
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		got := map[string]any{}
+		if rec.Body.Len() > 0 {
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("%s %s returned invalid JSON %q: %v", method, target, rec.Body, err)
+			}
+		}
+		return rec.Code, got
+	}
+
+	code, got := do(http.MethodPost, "/api/v1/links", `{"name": "pager", "url": "http://example.com/pager", "description": "Who is on call", "tags": ["oncall"]}`)
+	if code != http.StatusCreated {
+		t.Fatalf("POST /api/v1/links returned status %v: %v", code, got)
+	}
+	if got["created_by"] != "bob" || got["description"] != "Who is on call" {
+		t.Errorf("POST /api/v1/links returned %v", got)
+	}
+	if code, got := do(http.MethodPost, "/api/v1/links", `{"name": "pager", "url": "http://example.com"}`); code != http.StatusConflict || got["error"] == nil {
+		t.Errorf("Creating a duplicate returned status %v and %v, want %v and an error", code, got, http.StatusConflict)
+	}
+	if code, _ := do(http.MethodPost, "/api/v1/links", `{"name": "x"}`); code != http.StatusBadRequest {
+		t.Errorf("Creating without a url returned status %v, want %v", code, http.StatusBadRequest)
+	}
+	do(http.MethodPost, "/api/v1/links", `{"name": "wiki", "url": "http://example.com/wiki", "tags": ["docs"]}`)
+
+	code, got = do(http.MethodGet, "/api/v1/links?tag=oncall", "")
+	if links, _ := got["links"].([]any); code != http.StatusOK || len(links) != 1 {
+		t.Errorf("GET /api/v1/links?tag=oncall returned status %v and %v, want one link", code, got)
+	}
+
+	code, got = do(http.MethodPatch, "/api/v1/links/pager", `{"tags": ["oncall", "sre"]}`)
+	if code != http.StatusOK {
+		t.Fatalf("PATCH /api/v1/links/pager returned status %v: %v", code, got)
+	}
+	if got["description"] != "Who is on call" || got["url"] != "http://example.com/pager" {
+		t.Errorf("PATCH changed fields that were left out: %v", got)
+	}
+	if tags, _ := got["tags"].([]any); len(tags) != 2 {
+		t.Errorf("PATCH returned tags %v, want 2", got["tags"])
+	}
+
+	if code, _ := do(http.MethodDelete, "/api/v1/links/pager", ""); code != http.StatusNoContent {
+		t.Errorf("DELETE /api/v1/links/pager returned status %v, want %v", code, http.StatusNoContent)
+	}
+	if code, _ := do(http.MethodGet, "/api/v1/links/pager", ""); code != http.StatusNotFound {
+		t.Errorf("GET of a deleted link returned status %v, want %v", code, http.StatusNotFound)
+	}
+
+	// Cross-site requests are refused even with a JSON body.
+	req := httptest.NewRequest(http.MethodPost, "http://golinkservice.com/api/v1/links", strings.NewReader(`{"name": "evil", "url": "http://evil.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Cross-site POST /api/v1/links returned status %v, want %v", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestAPIName(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	h := New(db, testOptions()).handler()
+	do := func(req *http.Request) *httptest.ResponseRecorder {
+		req.RemoteAddr = "127.0.0.1:1234"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	const name = `a&b<c>"d'`
+	req := httptest.NewRequest(http.MethodPost, apiLinksPath, strings.NewReader(`{"name": " a&b<c>\"d' ", "url": "http://example.com/?a=1&b=2"}`))
+	req.Header.Set("Content-Type", "application/json")
+	if rec := do(req); rec.Code != http.StatusCreated || rec.Header().Get("Location") != apiLinksPath+"/"+url.PathEscape(name) {
+		t.Fatalf("POST %s returned %v %q to %q, want %v to %q", apiLinksPath, rec.Code, rec.Body, rec.Header().Get("Location"), http.StatusCreated, apiLinksPath+"/"+url.PathEscape(name))
+	}
+	rec := do(httptest.NewRequest(http.MethodGet, "/go/"+url.PathEscape(name), nil))
+	if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Location") != "http://example.com/?a=1&b=2" {
+		t.Errorf("GET /go/%s returned %v to %q, want %v to %q", url.PathEscape(name), rec.Code, rec.Header().Get("Location"), http.StatusTemporaryRedirect, "http://example.com/?a=1&b=2")
+	}
+	if rec := do(httptest.NewRequest(http.MethodGet, "/golink/"+url.PathEscape(name), nil)); rec.Code != http.StatusOK {
+		t.Errorf("GET /golink/%s returned %v, want %v", url.PathEscape(name), rec.Code, http.StatusOK)
+	}
+	// The form names links the same way, so it can't create a second one.
+	if rec := do(formRequest(t, "http://golinkservice.com/create_golink", url.Values{"name": {name}, "link": {"http://example.com"}})); rec.Code != http.StatusConflict {
+		t.Errorf("POST /create_golink with the name from the API returned %v, want %v", rec.Code, http.StatusConflict)
+	}
+	req = httptest.NewRequest(http.MethodPost, apiLinksPath, strings.NewReader(`{"name": "a/b", "url": "http://example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	if rec := do(req); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST %s with the name %q returned %v, want %v", apiLinksPath, "a/b", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestResolveCache(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	h := New(db, testOptions()).handler()
+	addEntry(ctx, t, db, "foo", "http://example.com/old")
+	resolve := func(name string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/go/"+name, nil))
+		return rec
+	}
+	post := func(target string, form url.Values) {
+		t.Helper()
+		req := formRequest(t, "http://golinkservice.com"+target, form)
+		req.RemoteAddr = "127.0.0.1:1234"
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if got, want := resolve("foo").Header().Get("Location"), "http://example.com/old"; got != want {
+		t.Fatalf("GET /go/foo redirected to %q, want %q", got, want)
+	}
+	if got, want := resolve("bar").Code, http.StatusNotFound; got != want {
+		t.Fatalf("GET /go/bar returned status %v, want %v", got, want)
+	}
+
+	// Changes made behind the service's back are cached until they expire.
+	if _, err := db.ExecContext(ctx, "update links set url='http://example.com/other' where name='foo';"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resolve("foo").Header().Get("Location"), "http://example.com/old"; got != want {
+		t.Errorf("GET /go/foo after an outside change redirected to %q, want the cached %q", got, want)
+	}
+
+	// Changes made through the service are seen at once.
+	post("/update_golink", url.Values{"old_name": {"foo"}, "name": {"foo"}, "link": {"http://example.com/new"}})
+	if got, want := resolve("foo").Header().Get("Location"), "http://example.com/new"; got != want {
+		t.Errorf("GET /go/foo after an update redirected to %q, want %q", got, want)
+	}
+	post("/create_golink", url.Values{"name": {"bar"}, "link": {"http://example.com/bar"}})
+	if got, want := resolve("bar").Header().Get("Location"), "http://example.com/bar"; got != want {
+		t.Errorf("GET /go/bar after creating it redirected to %q, want %q", got, want)
+	}
+	post("/delete_golink", url.Values{"name": {"foo"}})
+	if got, want := resolve("foo").Code, http.StatusNotFound; got != want {
+		t.Errorf("GET /go/foo after deleting it returned status %v, want %v", got, want)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	db := golinktest.NewDatabase(ctx, t)
+	opts := testOptions()
+	opts.UserHeader = "X-Forwarded-User"
+	opts.ChangePollInterval = 10 * time.Millisecond
+	// Two replicas share the database.
+	a, b := New(db, opts), New(db, opts)
+	go a.followChanges(ctx)
+	ha, hb := a.handler(), b.handler()
+	addEntry(ctx, t, db, "foo", "http://example.com/old")
+	get := func(h http.Handler, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+	var latest apiChanges
+	if err := json.Unmarshal(get(ha, "/api/v1/changes").Body.Bytes(), &latest); err != nil {
+		t.Fatal(err)
+	}
+	if latest.Revision != 1 {
+		t.Errorf("GET /api/v1/changes returned revision %v, want 1", latest.Revision)
+	}
+	if got, want := get(ha, "/go/foo").Header().Get("Location"), "http://example.com/old"; got != want {
+		t.Fatalf("GET /go/foo redirected to %q, want %q", got, want)
+	}
+
+	polled := make(chan *httptest.ResponseRecorder)
+	go func() { polled <- get(ha, "/api/v1/changes?since=1&wait=10s") }()
+	req := formRequest(t, "http://golinkservice.com/update_golink", url.Values{"old_name": {"foo"}, "name": {"foo"}, "link": {"http://example.com/new"}})
+	req.RemoteAddr = "127.0.0.1:1234"
+	hb.ServeHTTP(httptest.NewRecorder(), req)
+	rec := <-polled
+	var got apiChanges
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Long-poll returned invalid JSON %q: %v", rec.Body, err)
+	}
+	if got.Revision != 2 || len(got.Changes) != 1 || got.Changes[0].Name != "foo" || got.Changes[0].Op != link.OpUpdate {
+		t.Errorf("Long-poll returned %+v, want the update of foo at revision 2", got)
+	}
+	// a follows the other replica's change, so it soon stops serving foo
+	// from its cache.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(opts.ChangePollInterval) {
+		got, want := get(ha, "/go/foo").Header().Get("Location"), "http://example.com/new"
+		if got == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GET /go/foo after another replica's update redirected to %q, want %q", got, want)
+		}
+	}
+
+	if err := link.Create(ctx, db, "secret", "http://example.com", link.CreatedBy("alice"), link.WithVisibility(link.Private, "")); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(get(ha, "/api/v1/changes?since=2&wait=0s").Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Revision != 3 || len(got.Changes) != 0 {
+		t.Errorf("GET /api/v1/changes of a private link returned %+v, want revision 3 without changes", got)
+	}
+	if rec := get(ha, "/api/v1/changes?since=3&wait=0s"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"changes": []`) {
+		t.Errorf("GET /api/v1/changes without new changes returned %v %s", rec.Code, rec.Body)
+	}
+
+	srv := httptest.NewServer(ha)
+	defer srv.Close()
+	streamReq, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/v1/changes?since=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamReq.Header.Set("Accept", "text/event-stream")
+	streamResp, err := http.DefaultClient.Do(streamReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer streamResp.Body.Close()
+	event := make([]byte, 512)
+	n, err := io.ReadAtLeast(streamResp.Body, event, len("id: 1\nevent: change\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(event[:n]), "id: 1\nevent: change\ndata: {\"revision\":1,\"name\":\"foo\",\"op\":\"create\"") {
+		t.Errorf("The stream of changes started with %q, want the creation of foo", event[:n])
+	}
+
+	if _, err := link.PruneChanges(ctx, db, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := get(ha, "/api/v1/changes?since=0").Code, http.StatusGone; got != want {
+		t.Errorf("GET /api/v1/changes since pruned changes returned status %v, want %v", got, want)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	primaryDB := golinktest.NewDatabase(ctx, t)
+	opts := testOptions()
+	opts.UserHeader = "X-Forwarded-User"
+	opts.ChangePollInterval = 10 * time.Millisecond
+	opts.MirrorToken = "secret"
+	primary := New(primaryDB, opts)
+	go primary.followChanges(ctx)
+	addEntry(ctx, t, primaryDB, "foo", "http://example.com/old")
+	if err := link.Create(ctx, primaryDB, "hidden", "http://example.com/hidden", link.CreatedBy("alice"), link.WithVisibility(link.Unlisted, "")); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(primary.handler())
+	defer srv.Close()
+	// Long-polls from the mirror would hold up srv.Close.
+	defer primary.changes.close()
+
+	for _, tc := range []struct {
+		token     string
+		wantLinks int
+	}{
+		{token: "", wantLinks: 1},
+		{token: "wrong", wantLinks: 1},
+		{token: "secret", wantLinks: 2},
+	} {
+		req := httptest.NewRequest(http.MethodGet, apiLinksPath, nil)
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		rec := httptest.NewRecorder()
+		primary.handler().ServeHTTP(rec, req)
+		var got struct{ Links []apiLink }
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Links) != tc.wantLinks {
+			t.Errorf("GET %s with token %q listed %d links, want %d", apiLinksPath, tc.token, len(got.Links), tc.wantLinks)
+		}
+	}
+
+	mirrorDB := golinktest.NewDatabase(ctx, t)
+	addEntry(ctx, t, mirrorDB, "stale", "http://example.com/stale")
+	mirrorOpts := opts
+	mirrorOpts.MirrorToken = ""
+	mirrorOpts.Upstream, _ = url.Parse(srv.URL)
+	mirrorOpts.UpstreamToken = "secret"
+	mirrorOpts.MirrorRetry = 10 * time.Millisecond
+	m := New(mirrorDB, mirrorOpts)
+	go m.followChanges(ctx)
+	go m.mirror(ctx)
+	h := m.handler()
+	// Another mirror has no token, so it only copies the links that
+	// anonymous users can list.
+	publicDB := golinktest.NewDatabase(ctx, t)
+	publicOpts := mirrorOpts
+	publicOpts.UpstreamToken = ""
+	pm := New(publicDB, publicOpts)
+	go pm.followChanges(ctx)
+	go pm.mirror(ctx)
+	resolveOn := func(h http.Handler, name string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/go/"+name, nil))
+		return rec.Header().Get("Location")
+	}
+	resolve := func(name string) string { return resolveOn(h, name) }
+	waitOn := func(h http.Handler, name, want string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			got := resolveOn(h, name)
+			if got == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("The mirror resolved %q to %q, want %q", name, got, want)
+			}
+		}
+	}
+	waitFor := func(name, want string) {
+		t.Helper()
+		waitOn(h, name, want)
+	}
+	waitFor("foo", "http://example.com/old")
+	waitFor("hidden", "http://example.com/hidden")
+	waitFor("stale", "")
+	if r, err := link.Read(ctx, mirrorDB, "hidden"); err != nil || r.CreatedBy != "alice" || r.Visibility != link.Unlisted {
+		t.Errorf("The mirror copied %+v, %v, want the unlisted link of alice", r, err)
+	}
+
+	post := func(h http.Handler, target string, form url.Values) *httptest.ResponseRecorder {
+		req := formRequest(t, "http://golinkservice.com"+target, form)
+		req.RemoteAddr = "127.0.0.1:1234"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	waitOn(pm.handler(), "foo", "http://example.com/old")
+	// Changes to links that anonymous users can't list aren't copied without
+	// a token either.
+	post(primary.handler(), "/update_golink", url.Values{"old_name": {"hidden"}, "name": {"hidden"}, "link": {"http://example.com/hidden2"}})
+	post(primary.handler(), "/update_golink", url.Values{"old_name": {"foo"}, "name": {"foo"}, "link": {"http://example.com/new"}})
+	waitFor("foo", "http://example.com/new")
+	waitFor("hidden", "http://example.com/hidden2")
+	waitOn(pm.handler(), "foo", "http://example.com/new")
+	if _, err := link.Read(ctx, publicDB, "hidden"); !errors.Is(err, link.ErrNotFound) {
+		t.Errorf("Read() of an unlisted link on the mirror without a token returned err=%v, want %v", err, link.ErrNotFound)
+	}
+	post(primary.handler(), "/delete_golink", url.Values{"name": {"foo"}})
+	waitFor("foo", "")
+
+	// The mirror leaves archiving and purging links to the upstream.
+	if err := link.Create(ctx, mirrorDB, "expired", "http://example.com", link.WithSchedule(time.Time{}, time.Now().Add(-time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	m.cleanUpOnce(ctx, time.Now())
+	if _, err := link.Read(ctx, mirrorDB, "expired"); err != nil {
+		t.Errorf("Read() of an expired link on the mirror after a cleanup returned err=%v, want nil", err)
+	}
+
+	rec := post(h, "/create_golink", url.Values{"name": {"bar"}, "link": {"http://example.com"}})
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), srv.URL) {
+		t.Errorf("POST /create_golink on the mirror returned %v %q, want %v and a pointer to the upstream", rec.Code, rec.Body, http.StatusForbidden)
+	}
+	req := httptest.NewRequest(http.MethodPost, apiLinksPath, strings.NewReader(`{"name": "bar", "url": "http://example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), `"error"`) {
+		t.Errorf("POST %s on the mirror returned %v %q, want %v and a JSON error", apiLinksPath, rec.Code, rec.Body, http.StatusForbidden)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "read-only mirror") || strings.Contains(body, "/create_golink") {
+		t.Errorf("GET / on the mirror returned a page without the mirror notice or with the create form:\n%s", body)
+	}
+
+	// The mirror keeps serving while the upstream is down.
+	primary.changes.close()
+	srv.Close()
+	time.Sleep(50 * time.Millisecond)
+	if got, want := resolve("hidden"), "http://example.com/hidden2"; got != want {
+		t.Errorf("The mirror resolved %q to %q with the upstream down, want %q", "hidden", got, want)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	ctx := context.Background()
+	// a and b fall back to each other, and c to a.
+	servers := map[string]*GoLink{}
+	srvs := map[string]*httptest.Server{}
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		srvs[name] = httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			servers[name].handler().ServeHTTP(resp, req)
+		}))
+		defer srvs[name].Close()
+	}
+	dbs := map[string]*sql.DB{}
+	for name, fallback := range map[string]string{"a": "b", "b": "a", "c": "a"} {
+		dbs[name] = golinktest.NewDatabase(ctx, t)
+		opts := testOptions()
+		u, _ := url.Parse(srvs[fallback].URL)
+		opts.Fallbacks = []*url.URL{u}
+		servers[name] = New(dbs[name], opts)
+	}
+	addEntry(ctx, t, dbs["a"], "foo", "http://example.com/a")
+	addEntry(ctx, t, dbs["b"], "foo", "http://example.com/b")
+	addEntry(ctx, t, dbs["b"], "bar", "http://example.com/bar")
+	if err := link.Create(ctx, dbs["b"], "secret", "http://example.com/secret", link.CreatedBy("alice"), link.WithVisibility(link.Private, "")); err != nil {
+		t.Fatal(err)
+	}
+
+	resolve := func(server, name string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		servers[server].handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/go/"+name, nil))
+		return rec
+	}
+	for _, tc := range []struct {
+		server, name string
+		wantCode     int
+		wantLocation string
+	}{
+		// Local links win over fallbacks.
+		{server: "a", name: "foo", wantCode: http.StatusTemporaryRedirect, wantLocation: "http://example.com/a"},
+		{server: "b", name: "foo", wantCode: http.StatusTemporaryRedirect, wantLocation: "http://example.com/b"},
+		{server: "a", name: "bar", wantCode: http.StatusTemporaryRedirect, wantLocation: "http://example.com/bar"},
+		// c asks a, which doesn't pass the lookup on to b.
+		{server: "c", name: "bar", wantCode: http.StatusNotFound},
+		// Fallbacks don't give away links that anonymous users can't see.
+		{server: "a", name: "secret", wantCode: http.StatusNotFound},
+		// a asks b, which doesn't ask a back.
+		{server: "a", name: "missing", wantCode: http.StatusNotFound},
+	} {
+		rec := resolve(tc.server, tc.name)
+		if rec.Code != tc.wantCode || rec.Header().Get("Location") != tc.wantLocation {
+			t.Errorf("GET /go/%s on %s returned %v to %q, want %v to %q", tc.name, tc.server, rec.Code, rec.Header().Get("Location"), tc.wantCode, tc.wantLocation)
+		}
+	}
+
+	// Clients can't use a to look names up on b.
+	req := httptest.NewRequest(http.MethodGet, apiLinksPath+"/bar", nil)
+	req.Header.Set(hopsHeader, "1")
+	rec := httptest.NewRecorder()
+	servers["a"].handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET %s/bar on a with %s returned %v, want %v", apiLinksPath, hopsHeader, rec.Code, http.StatusNotFound)
+	}
+
+	// Answers are cached, so they outlive the fallback.
+	srvs["b"].Close()
+	if rec := resolve("a", "bar"); rec.Header().Get("Location") != "http://example.com/bar" {
+		t.Errorf("GET /go/bar on a with b down redirected to %q, want the cached answer", rec.Header().Get("Location"))
+	}
+	if rec := resolve("a", "baz"); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /go/baz on a with b down returned %v, want %v", rec.Code, http.StatusNotFound)
+	}
+	if _, ok := servers["a"].fallbacks.Get("baz"); ok {
+		t.Error("a cached the answer for baz although b was down")
+	}
+}
+
+func TestBackup(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	db := golinktest.NewDatabase(ctx, t)
+	addEntry(ctx, t, db, "foo", "http://example.com")
+	download := func(gl *GoLink, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/admin/backup", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		gl.handler().ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := download(New(db, testOptions()), "secret"); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /admin/backup without an admin token configured returned %v, want %v", rec.Code, http.StatusNotFound)
+	}
+	opts := testOptions()
+	opts.AdminToken = "secret"
+	opts.BackupDir = t.TempDir()
+	opts.BackupInterval = time.Hour
+	gl := New(db, opts)
+	for _, token := range []string{"", "wrong"} {
+		if rec := download(gl, token); rec.Code != http.StatusUnauthorized {
+			t.Errorf("GET /admin/backup with token %q returned %v, want %v", token, rec.Code, http.StatusUnauthorized)
+		}
+	}
+	rec := download(gl, "secret")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/vnd.sqlite3" {
+		t.Fatalf("GET /admin/backup returned %v %q, want %v and a database", rec.Code, rec.Header().Get("Content-Type"), http.StatusOK)
+	}
+	path := filepath.Join(t.TempDir(), "backup.db")
+	if err := os.WriteFile(path, rec.Body.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datastore.CheckBackup(ctx, path); err != nil {
+		t.Errorf("The downloaded backup is unusable: %v", err)
+	}
+
+	go gl.snapshot(ctx)
+	for deadline := time.Now().Add(5 * time.Second); gl.backedUp.Load() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("The database wasn't backed up to Options.BackupDir")
+		}
+	}
+	snapshots, err := filepath.Glob(filepath.Join(opts.BackupDir, "golink-*.db"))
+	if err != nil || len(snapshots) != 1 {
+		t.Fatalf("Options.BackupDir has snapshots %v, %v, want one", snapshots, err)
+	}
+	if _, err := datastore.CheckBackup(ctx, snapshots[0]); err != nil {
+		t.Errorf("The snapshot is unusable: %v", err)
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	// Two replicas share the database.
+	replicas := []http.Handler{New(db, testOptions()).handler(), New(db, testOptions()).handler()}
+	do := func(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	const workers, iterations = 8, 10
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			h := replicas[w%len(replicas)]
+			for i := 0; i < iterations; i++ {
+				name := fmt.Sprintf("link-%d-%d", w, i)
+				if rec := do(h, http.MethodPost, apiLinksPath, `{"name": "`+name+`", "url": "http://example.com/old"}`); rec.Code != http.StatusCreated {
+					t.Errorf("POST %s for %q returned %v %q, want %v", apiLinksPath, name, rec.Code, rec.Body, http.StatusCreated)
+					continue
+				}
+				if rec := do(h, http.MethodPatch, apiLinksPath+"/"+name, `{"url": "http://example.com/new"}`); rec.Code != http.StatusOK {
+					t.Errorf("PATCH %s/%s returned %v %q, want %v", apiLinksPath, name, rec.Code, rec.Body, http.StatusOK)
+				}
+				if rec := do(h, http.MethodGet, "/go/"+name, ""); rec.Header().Get("Location") != "http://example.com/new" {
+					t.Errorf("GET /go/%s returned %v to %q, want a redirect to the update", name, rec.Code, rec.Header().Get("Location"))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestConflict(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	opts := testOptions()
+	opts.UserHeader = "X-Forwarded-User"
+	h := New(db, opts).handler()
+	do := func(req *http.Request, user string) *httptest.ResponseRecorder {
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("X-Forwarded-User", user)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	post := func(target, user string, form url.Values) *httptest.ResponseRecorder {
+		return do(formRequest(t, "http://golinkservice.com"+target, form), user)
+	}
+	post("/create_golink", "alice", url.Values{"name": {"foo"}, "link": {"http://example.com/1"}})
+
+	// Alice and Bob open the page of the link at the same time.
+	page := do(httptest.NewRequest(http.MethodGet, "/golink/foo", nil), "alice")
+	m := regexp.MustCompile(`name="revision" value="(\d+)"`).FindStringSubmatch(page.Body.String())
+	if m == nil {
+		t.Fatalf("GET /golink/foo returned a page without the revision:\n%s", page.Body)
+	}
+	revision := m[1]
+	if got, want := page.Header().Get("ETag"), `W/"`+revision+`"`; got != want {
+		t.Errorf("GET /golink/foo returned ETag %q, want %q", got, want)
+	}
+	update := func(user, address string) *httptest.ResponseRecorder {
+		return post("/update_golink", user, url.Values{"old_name": {"foo"}, "name": {"foo"}, "link": {address}, "revision": {revision}})
+	}
+	if rec := update("alice", "http://example.com/alice"); rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("The first update returned %v %q, want %v", rec.Code, rec.Body, http.StatusTemporaryRedirect)
+	}
+	rec := update("bob", "http://example.com/bob")
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "changed") || !strings.Contains(rec.Body.String(), "by alice") {
+		t.Errorf("The second update returned %v, want %v and a page saying that alice changed the link:\n%s", rec.Code, http.StatusConflict, rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), "http://example.com/alice") {
+		t.Errorf("The conflict page doesn't show the link as alice left it:\n%s", rec.Body)
+	}
+	if rec := post("/delete_golink", "bob", url.Values{"name": {"foo"}, "revision": {revision}}); rec.Code != http.StatusConflict {
+		t.Errorf("A delete at an old revision returned %v, want %v", rec.Code, http.StatusConflict)
+	}
+	if r, err := link.Read(ctx, db, "foo"); err != nil || r.Link.String() != "http://example.com/alice" {
+		t.Errorf("Read() after the conflicts = %v, %v, want the update of alice", r, err)
+	}
+
+	api := func(method, etagHeader, etag, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, apiLinksPath+"/foo", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if etag != "" {
+			req.Header.Set(etagHeader, etag)
+		}
+		return do(req, "carol")
+	}
+	rec = api(http.MethodGet, "", "", "")
+	etag := rec.Header().Get("ETag")
+	if !regexp.MustCompile(`^"\d+"$`).MatchString(etag) {
+		t.Fatalf("GET %s/foo returned ETag %q, want a quoted revision", apiLinksPath, etag)
+	}
+	if rec := api(http.MethodGet, "If-None-Match", etag, ""); rec.Code != http.StatusNotModified {
+		t.Errorf("GET %s/foo with If-None-Match returned %v, want %v", apiLinksPath, rec.Code, http.StatusNotModified)
+	}
+	for _, stale := range []string{`"` + revision + `"`, "garbage"} {
+		if rec := api(http.MethodPatch, "If-Match", stale, `{"url": "http://example.com/carol"}`); rec.Code != http.StatusPreconditionFailed {
+			t.Errorf("PATCH %s/foo with If-Match %s returned %v, want %v", apiLinksPath, stale, rec.Code, http.StatusPreconditionFailed)
+		}
+	}
+	rec = api(http.MethodPatch, "If-Match", etag, `{"url": "http://example.com/carol"}`)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("PATCH %s/foo with the current ETag returned %v with ETag %q, want %v and a new ETag", apiLinksPath, rec.Code, rec.Header().Get("ETag"), http.StatusOK)
+	}
+	if rec := api(http.MethodDelete, "If-Match", etag, ""); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("DELETE %s/foo with an old ETag returned %v, want %v", apiLinksPath, rec.Code, http.StatusPreconditionFailed)
+	}
+}
+
+func TestRedirectStatus(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	opts := testOptions()
+	opts.UserHeader = "X-Forwarded-User"
+	h := New(db, opts).handler()
+	do := func(req *http.Request) *httptest.ResponseRecorder {
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("X-Forwarded-User", "alice")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	post := func(target string, form url.Values) *httptest.ResponseRecorder {
+		return do(formRequest(t, "http://golinkservice.com"+target, form))
+	}
+	resolve := func(name string) *httptest.ResponseRecorder {
+		return do(httptest.NewRequest(http.MethodGet, "/go/"+name, nil))
+	}
+
+	post("/create_golink", url.Values{"name": {"plain"}, "link": {"http://example.com"}})
+	if rec := resolve("plain"); rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("GET /go/plain returned %v with Cache-Control %q, want %v and %q", rec.Code, rec.Header().Get("Cache-Control"), http.StatusTemporaryRedirect, "no-store")
+	}
+	if rec := resolve("missing"); rec.Code != http.StatusNotFound || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("GET /go/missing returned %v with Cache-Control %q, want %v and %q", rec.Code, rec.Header().Get("Cache-Control"), http.StatusNotFound, "no-store")
+	}
+	for _, form := range []url.Values{
+		{"redirect_code": {"200"}},
+		{"redirect_code": {"moved"}},
+		{"cache_max_age": {"-1"}},
+	} {
+		form.Set("name", "bad")
+		form.Set("link", "http://example.com")
+		if rec := post("/create_golink", form); rec.Code != http.StatusBadRequest {
+			t.Errorf("POST /create_golink with %v returned %v, want %v", form, rec.Code, http.StatusBadRequest)
+		}
+	}
+
+	post("/create_golink", url.Values{"name": {"moved"}, "link": {"http://example.com/moved"}, "redirect_code": {"308"}, "cache_max_age": {"3600"}})
+	if rec := resolve("moved"); rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Cache-Control") != "public, max-age=3600" {
+		t.Errorf("GET /go/moved returned %v with Cache-Control %q, want %v and %q", rec.Code, rec.Header().Get("Cache-Control"), http.StatusPermanentRedirect, "public, max-age=3600")
+	}
+	if page := do(httptest.NewRequest(http.MethodGet, "/golink/moved", nil)); !strings.Contains(page.Body.String(), "308 Permanent Redirect, cached for 1h0m0s") {
+		t.Errorf("GET /golink/moved returned a page without the redirect:\n%s", page.Body)
+	}
+	// Caching stops when the link expires, and shared caches don't keep
+	// links that aren't public.
+	expiresAt := time.Now().UTC().Add(10 * time.Minute).Format(scheduleLayout)
+	post("/update_golink", url.Values{"old_name": {"moved"}, "name": {"moved"}, "link": {"http://example.com/moved"},
+		"visibility": {"unlisted"}, "expires_at": {expiresAt}})
+	rec := resolve("moved")
+	var maxAge int
+	if _, err := fmt.Sscanf(rec.Header().Get("Cache-Control"), "private, max-age=%d", &maxAge); err != nil || maxAge > 600 || maxAge < 500 {
+		t.Errorf("GET /go/moved of an unlisted link that expires in 10 minutes returned Cache-Control %q, want private and at most 600 seconds", rec.Header().Get("Cache-Control"))
+	}
+	if rec.Code != http.StatusPermanentRedirect {
+		t.Errorf("GET /go/moved after an update that didn't change the redirect returned %v, want %v", rec.Code, http.StatusPermanentRedirect)
+	}
+
+	req := httptest.NewRequest(http.MethodPatch, apiLinksPath+"/moved", strings.NewReader(`{"redirect_code": 302}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec = do(req)
+	var got apiLink
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || got.RedirectCode != http.StatusFound || got.CacheMaxAge != 3600 {
+		t.Errorf("PATCH %s/moved returned %v %q, want redirect_code 302 and cache_max_age 3600", apiLinksPath, rec.Code, rec.Body)
+	}
+	if rec := resolve("moved"); rec.Code != http.StatusFound {
+		t.Errorf("GET /go/moved after PATCH returned %v, want %v", rec.Code, http.StatusFound)
+	}
+}
+
+func TestPermanentHostRedirects(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	opts := testOptions()
+	opts.PermanentHostRedirects = true
+	gl := New(db, opts)
+	for _, h := range []http.Handler{gl.handler(), gl.httpRedirectHandler()} {
+		req := httptest.NewRequest(http.MethodGet, "http://go/foo", nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "https://golinkservice.com/go/foo" {
+			t.Errorf("GET http://go/foo returned %v to %q, want %v to %q", rec.Code, rec.Header().Get("Location"), http.StatusMovedPermanently, "https://golinkservice.com/go/foo")
+		}
+	}
+}
+
+func BenchmarkRedirect(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		ttl  time.Duration
+	}{
+		{name: "cached", ttl: time.Hour},
+		{name: "uncached", ttl: -1},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ctx := context.Background()
+			db := golinktest.NewDatabase(ctx, b)
+			if err := link.Create(ctx, db, "foo", "http://example.com"); err != nil {
+				b.Fatal(err)
+			}
+			opts := testOptions()
+			opts.CacheTTL = bc.ttl
+			opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+			h := New(db, opts).handler()
+			log.SetOutput(io.Discard)
+			defer log.SetOutput(os.Stderr)
+			for _, name := range []string{"foo", "missing"} {
+				b.Run(name, func(b *testing.B) {
+					req := httptest.NewRequest(http.MethodGet, "/go/"+name, nil)
+					b.ReportAllocs()
+					for i := 0; i < b.N; i++ {
+						h.ServeHTTP(httptest.NewRecorder(), req)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestRead(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	db := golinktest.NewDatabase(ctx, t)
+	l := golinktest.Listen(ctx, t)
+	go golinktest.RunServer(ctx, t, New(db, testOptions()), l)
+	time.Sleep(500 * time.Millisecond)
+	type testCase struct {
+		name     string
+		linkName string
+		linkAddr string
+		wantName string
+		wantAddr string
+	}
+	testCases := []testCase{
+		{
+			name:     "ok",
+			linkName: "foo",
+			linkAddr: "http://example.com",
+			wantName: "foo",
+			wantAddr: "http://example.com",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addEntry(ctx, t, db, tc.linkName, tc.linkAddr)
+			client := http.Client{}
+			getPath := "http://" + l.Addr().String() + "/golink/" + tc.linkName
+			resp, err := client.Get(getPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := string(b)
+			if got, want := resp.StatusCode, http.StatusOK; got != want {
+				t.Errorf("Failed to get %q: status code = %v, want %v", getPath, got, want)
+			}
+			if !strings.Contains(s, tc.wantName) {
+				t.Errorf("Get %q response does not contain name %q, want it to contain %q", getPath, tc.wantName, tc.wantName)
+			}
+			if !strings.Contains(s, tc.wantAddr) {
+				t.Errorf("Get %q response does not contain addr %q, want it to contain %q", getPath, tc.wantAddr, tc.wantAddr)
+			}
+		})
+	}
+}
+
+func init() {
+	log.Default().SetFlags(log.LstdFlags | log.Lshortfile)
+}
+
+func TestSearch(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	db := golinktest.NewDatabase(ctx, t)
+	addEntry(ctx, t, db, "gh", "https://github.com/{args}")
+	addEntry(ctx, t, db, "g", "https://www.google.com/search?q={args}")
+	l := golinktest.Listen(ctx, t)
+	go golinktest.RunServer(ctx, t, New(db, testOptions()), l)
+	time.Sleep(500 * time.Millisecond)
+	type testCase struct {
+		name         string
+		query        string
+		wantCode     int
+		wantLocation string
+	}
+	testCases := []testCase{
+		{
+			name:         "path args",
+			query:        "gh spwg/golink",
+			wantCode:     http.StatusTemporaryRedirect,
+			wantLocation: "https://github.com/spwg/golink",
+		},
+		{
+			name:         "query args",
+			query:        "g  go links ",
+			wantCode:     http.StatusTemporaryRedirect,
+			wantLocation: "https://www.google.com/search?q=go+links",
+		},
+		{
+			name:     "unknown link",
+			query:    "nope foo",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:         "empty",
+			query:        "",
+			wantCode:     http.StatusSeeOther,
+			wantLocation: "/",
+		},
+	}
+	client := http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := "http://" + l.Addr().String() + "/search?q=" + url.QueryEscape(tc.query)
+			resp, err := client.Get(addr)
+			if err != nil {
+				t.Fatalf("Get(%q) returned err=%v, want nil", addr, err)
+			}
+			resp.Body.Close()
+			if got, want := resp.StatusCode, tc.wantCode; got != want {
+				t.Errorf("Get(%q) returned code=%v, want %v", addr, got, want)
+			}
+			if got, want := resp.Header.Get("Location"), tc.wantLocation; got != want {
+				t.Errorf("Get(%q) returned location=%q, want %q", addr, got, want)
+			}
+		})
+	}
+}
+
+func TestBrowserSetup(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	db := golinktest.NewDatabase(ctx, t)
+	l := golinktest.Listen(ctx, t)
+	go golinktest.RunServer(ctx, t, New(db, testOptions()), l)
+	time.Sleep(500 * time.Millisecond)
+	type testCase struct {
+		path     string
+		wantType string
+		want     []string
+	}
+	testCases := []testCase{
+		{
+			path:     "/proxy.pac",
+			wantType: "application/x-ns-proxy-autoconfig",
+			want:     []string{`if ((host === "go") && url.substring(0, 5) === "http:")`, `return "PROXY golinkservice.com:80";`},
+		},
+		{
+			path:     "/opensearch.xml",
+			wantType: "application/opensearchdescription+xml",
+			want:     []string{`<?xml version="1.0" encoding="UTF-8"?>`, `template="https://golinkservice.com/search?q={searchTerms}"`},
+		},
+		{
+			path:     "/",
+			wantType: "text/html; charset=utf-8",
+			want:     []string{`<link rel="search" type="application/opensearchdescription+xml"`},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			addr := "http://" + l.Addr().String() + tc.path
+			resp, err := http.Get(addr)
+			if err != nil {
+				t.Fatalf("Get(%q) returned err=%v, want nil", addr, err)
+			}
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("ReadAll() failed: %v", err)
+			}
+			if got, want := resp.Header.Get("Content-Type"), tc.wantType; got != want {
+				t.Errorf("Get(%q) returned Content-Type=%q, want %q", addr, got, want)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(string(b), want) {
+					t.Errorf("Get(%q) returned a page without %q:\n%s", addr, want, b)
+				}
+			}
+		})
+	}
+}
+
+func TestTLS(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	// Borrow the test certificate of httptest and a client that trusts it.
+	ts := httptest.NewUnstartedServer(nil)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	cert := ts.TLS.Certificates[0]
+	client := ts.Client()
+	ts.Close()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	db := golinktest.NewDatabase(ctx, t)
+	addEntry(ctx, t, db, "foo", "http://example.com")
+	opts := testOptions()
+	opts.EnforceHTTPS = false
+	opts.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	gl := New(db, opts)
+	l := golinktest.Listen(ctx, t)
+	redirectListener := golinktest.Listen(ctx, t)
+	go golinktest.RunServer(ctx, t, gl, l)
+	go func() {
+		if err := gl.RunHTTPRedirect(ctx, redirectListener); err != nil {
+			t.Errorf("RunHTTPRedirect() failed: %v", err)
+		}
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	t.Run("https", func(t *testing.T) {
+		addr := "https://" + l.Addr().String() + "/go/foo"
+		resp, err := client.Get(addr)
+		if err != nil {
+			t.Fatalf("Get(%q) returned err=%v, want nil", addr, err)
+		}
+		resp.Body.Close()
+		if got, want := resp.StatusCode, http.StatusTemporaryRedirect; got != want {
+			t.Errorf("Get(%q) returned code=%v, want %v", addr, got, want)
+		}
+		if got, want := resp.ProtoMajor, 2; got != want {
+			t.Errorf("Get(%q) used HTTP/%v, want HTTP/%v", addr, got, want)
+		}
+	})
+	t.Run("http redirect", func(t *testing.T) {
+		addr := "http://" + redirectListener.Addr().String() + "/golink/foo"
+		resp, err := client.Get(addr)
+		if err != nil {
+			t.Fatalf("Get(%q) returned err=%v, want nil", addr, err)
+		}
+		resp.Body.Close()
+		if got, want := resp.Header.Get("Location"), "https://golinkservice.com/golink/foo"; got != want {
+			t.Errorf("Get(%q) returned location=%q, want %q", addr, got, want)
+		}
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	db := golinktest.NewDatabase(ctx, t)
+	l := golinktest.Listen(ctx, t)
+	opts := testOptions()
+	opts.ShutdownTimeout = time.Second
+	gl := New(db, opts)
+	errc := make(chan error, 1)
+	go func() { errc <- gl.Run(ctx, l) }()
+	time.Sleep(500 * time.Millisecond)
+	addr := "http://" + l.Addr().String() + "/healthz"
+	resp, err := http.Get(addr)
+	if err != nil {
+		t.Fatalf("Get(%q) returned err=%v, want nil", addr, err)
+	}
+	resp.Body.Close()
+	stop()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Run() returned err=%v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run() did not return after its context was cancelled")
+	}
+	if _, err := http.Get(addr); err == nil {
+		t.Errorf("Get(%q) after shutdown returned err=nil, want an error", addr)
+	}
+}
+
+func TestServeFailure(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	db := golinktest.NewDatabase(ctx, t)
+	l := golinktest.Listen(ctx, t)
+	opts := testOptions()
+	opts.ShutdownTimeout = time.Second
+	gl := New(db, opts)
+	errc := make(chan error, 1)
+	go func() { errc <- gl.Run(ctx, l) }()
+	time.Sleep(500 * time.Millisecond)
+	// Serving fails while ctx is still live.
+	l.Close()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Errorf("Run() returned err=nil after its listener was closed, want an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run() did not return after its listener was closed")
+	}
+}
+
+func TestHealth(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	db := golinktest.NewDatabase(ctx, t)
+	l := golinktest.Listen(ctx, t)
+	go golinktest.RunServer(ctx, t, New(db, testOptions()), l)
+	time.Sleep(500 * time.Millisecond)
+	for _, path := range []string{"/healthz", "/readyz"} {
+		t.Run(path, func(t *testing.T) {
+			addr := "http://" + l.Addr().String() + path
+			req, err := http.NewRequest(http.MethodGet, addr, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Probes must not be redirected to https.
+			req.Host = "go"
+			req.Header.Set("X-Forwarded-Proto", "http")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("GET %q returned err=%v, want nil", addr, err)
+			}
+			defer resp.Body.Close()
+			if got, want := resp.StatusCode, http.StatusOK; got != want {
+				t.Errorf("GET %q returned code=%v, want %v", addr, got, want)
+			}
+			var status healthStatus
+			if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+				t.Fatalf("Decode() failed: %v", err)
+			}
+			if got, want := status.Status, "ok"; got != want {
+				t.Errorf("GET %q returned status=%q, want %q: %+v", addr, got, want, status)
+			}
+		})
+	}
+	t.Run("database closed", func(t *testing.T) {
+		db.Close()
+		addr := "http://" + l.Addr().String() + "/readyz"
+		resp, err := http.Get(addr)
+		if err != nil {
+			t.Fatalf("Get(%q) returned err=%v, want nil", addr, err)
+		}
+		defer resp.Body.Close()
+		if got, want := resp.StatusCode, http.StatusServiceUnavailable; got != want {
+			t.Errorf("Get(%q) returned code=%v, want %v", addr, got, want)
+		}
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	db := golinktest.NewDatabase(ctx, t)
+	addEntry(ctx, t, db, "foo", "http://example.com")
+	l := golinktest.Listen(ctx, t)
+	go golinktest.RunServer(ctx, t, New(db, testOptions()), l)
+	time.Sleep(500 * time.Millisecond)
+	client := http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	for _, name := range []string{"foo", "bar"} {
+		addr := "http://" + l.Addr().String() + "/go/" + name
+		resp, err := client.Get(addr)
+		if err != nil {
+			t.Fatalf("Get(%q) returned err=%v, want nil", addr, err)
+		}
+		resp.Body.Close()
+	}
+	addr := "http://" + l.Addr().String() + "/metrics"
+	resp, err := client.Get(addr)
+	if err != nil {
+		t.Fatalf("Get(%q) returned err=%v, want nil", addr, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll() failed: %v", err)
+	}
+	for _, want := range []string{
+		`golink_http_requests_total{route="/go/",method="GET",code="307"} 1`,
+		`golink_http_requests_total{route="/go/",method="GET",code="404"} 1`,
+		`golink_redirects_total{result="hit"} 1`,
+		`golink_redirects_total{result="miss"} 1`,
+		`golink_db_query_duration_seconds_count{op="resolve"} 2`,
+		"golink_db_open_connections ",
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("Get(%q) returned metrics without %q:\n%s", addr, want, b)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	h := accessLogHandler(logger, forwarded.NewResolver(nil), http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		setLinkName(req.Context(), "foo")
+		resp.WriteHeader(http.StatusTeapot)
+		io.WriteString(resp, "short and stout")
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/go/foo", strings.NewReader("name=secret"))
+	req.Header.Set("Authorization", "Bearer hunter2")
+	req.Header.Set("Cookie", "session=hunter2")
+	req.Header.Set("X-Request-Id", "abc123")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	var entry struct {
+		RequestID string            `json:"request_id"`
+		Status    int               `json:"status"`
+		Bytes     int               `json:"bytes"`
+		Link      string            `json:"link"`
+		Headers   map[string]string `json:"headers"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Unmarshal(%q) failed: %v", buf.String(), err)
+	}
+	if got, want := entry.RequestID, "abc123"; got != want {
+		t.Errorf("request_id=%q, want %q", got, want)
+	}
+	if got, want := entry.Status, http.StatusTeapot; got != want {
+		t.Errorf("status=%v, want %v", got, want)
+	}
+	if got, want := entry.Bytes, len("short and stout"); got != want {
+		t.Errorf("bytes=%v, want %v", got, want)
+	}
+	if got, want := entry.Link, "foo"; got != want {
+		t.Errorf("link=%q, want %q", got, want)
+	}
+	for _, h := range []string{"Authorization", "Cookie"} {
+		if got, want := entry.Headers[h], "REDACTED"; got != want {
+			t.Errorf("headers[%q]=%q, want %q", h, got, want)
+		}
+	}
+	if strings.Contains(buf.String(), "hunter2") || strings.Contains(buf.String(), "secret") {
+		t.Errorf("access log contains sensitive data:\n%s", buf.String())
+	}
+}
+
+func TestRedirectLog(t *testing.T) {
+	ctx := context.Background()
+	db := golinktest.NewDatabase(ctx, t)
+	addEntry(ctx, t, db, "foo", "http://example.com/?token=hunter2")
+	var access, std bytes.Buffer
+	log.SetOutput(&std)
+	defer log.SetOutput(os.Stderr)
+	opts := testOptions()
+	opts.Logger = slog.New(slog.NewJSONHandler(&access, nil))
+	h := New(db, opts).handler()
+	for _, target := range []string{"/go/foo", "/go/missing"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+	var links []string
+	dec := json.NewDecoder(&access)
+	for dec.More() {
+		var entry struct {
+			Link string `json:"link"`
+		}
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		links = append(links, entry.Link)
+	}
+	if got, want := strings.Join(links, ","), "foo,missing"; got != want {
+		t.Errorf("Access logs have the links %q, want %q", got, want)
+	}
+	if std.Len() > 0 {
+		t.Errorf("Redirects wrote to the standard log, want only access logs:\n%s", std.String())
+	}
+	if strings.Contains(access.String(), "hunter2") {
+		t.Errorf("Access logs contain the target of the redirect:\n%s", access.String())
+	}
 }
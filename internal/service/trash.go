@@ -0,0 +1,155 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/spwg/golink/internal/link"
+)
+
+const (
+	defaultCleanupInterval = time.Hour
+	defaultTrashRetention  = 30 * 24 * time.Hour
+)
+
+// trashHandler lists the deleted links that are listed for the user, with a
+// form to restore each of them.
+func (gl *GoLink) trashHandler(resp http.ResponseWriter, req *http.Request) {
+	done := gl.metrics.timeQuery("list_trash")
+	all, err := link.ListTrash(req.Context(), gl.db)
+	done()
+	if err != nil {
+		log.Printf("Failed to list the trash: %v", err)
+		http.Error(resp, "Failed to list the trash.", http.StatusInternalServerError)
+		return
+	}
+	type entry struct {
+		ID        int64
+		Name      string
+		Address   string
+		DeletedAt string
+		DeletedBy string
+		PurgeAt   string
+	}
+	user, groups := gl.user(req), gl.groups(req)
+	var entries []entry
+	for _, t := range all {
+		if !t.ListedFor(user, groups) {
+			continue
+		}
+		entries = append(entries, entry{
+			ID:        t.ID,
+			Name:      t.Name,
+			Address:   t.Link.String(),
+			DeletedAt: t.DeletedAt.Format(displayLayout),
+			DeletedBy: t.DeletedBy,
+			PurgeAt:   t.DeletedAt.Add(gl.opts.TrashRetention).Format(displayLayout),
+		})
+	}
+	d := struct {
+		page
+		Deleted   string
+		Entries   []entry
+		CSRFToken string
+	}{gl.page(req), req.URL.Query().Get("deleted"), entries, gl.csrfToken(resp, req)}
+	if err := trashTemplate.ExecuteTemplate(resp, "trash.tmpl.html", d); err != nil {
+		log.Printf("Failed to render the trash: %v", err)
+		http.Error(resp, "Failed to render the trash.", http.StatusInternalServerError)
+	}
+}
+
+// restoreHandler moves a link out of the trash, unless its name has been
+// taken again. Only the links that the trash lists for the user can be
+// restored.
+func (gl *GoLink) restoreHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(resp, req.Method+" method not supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(resp, "Failed to parse form.", http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseInt(req.PostForm.Get("id"), 10, 64)
+	if err != nil {
+		http.Error(resp, "Invalid form: missing the id of the deleted link.", http.StatusBadRequest)
+		return
+	}
+	ctx := req.Context()
+	t, err := link.ReadTrashed(ctx, gl.db, id)
+	if err == nil && !t.ListedFor(gl.user(req), gl.groups(req)) {
+		err = link.ErrNotFound
+	}
+	var r *link.Record
+	if err == nil {
+		done := gl.metrics.timeQuery("restore")
+		r, err = link.Restore(ctx, gl.db, id)
+		done()
+		gl.changed(t.Name)
+	}
+	if err != nil {
+		gl.metrics.linkError("restore", err)
+		switch err {
+		case link.ErrNotFound:
+			http.NotFound(resp, req)
+			return
+		case link.ErrAlreadyExists:
+			msg := fmt.Sprintf("The golink %q has been created again since it was deleted. Rename or delete it first.", t.Name)
+			http.Error(resp, msg, http.StatusConflict)
+			return
+		}
+		log.Printf("Failed to restore link %d: %v", id, err)
+		http.Error(resp, "", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Restored link %q", r.Name)
+	http.Redirect(resp, req, "/golink/"+url.PathEscape(r.Name), http.StatusSeeOther)
+}
+
+// cleanUp calls cleanUpOnce every Options.CleanupInterval until ctx is done.
+func (gl *GoLink) cleanUp(ctx context.Context) {
+	t := time.NewTicker(gl.opts.CleanupInterval)
+	defer t.Stop()
+	for {
+		gl.cleanUpOnce(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// cleanUpOnce archives the links that have expired by now, purges links that
+// have been in the trash for longer than Options.TrashRetention and prunes
+// changes older than Options.ChangeRetention. A mirror only prunes its
+// changes: its links follow Options.Upstream, which archives and purges them
+// itself.
+func (gl *GoLink) cleanUpOnce(ctx context.Context, now time.Time) {
+	if gl.opts.Upstream == nil {
+		n, err := link.ArchiveExpired(ctx, gl.db, now)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			log.Printf("Failed to archive expired links: %v", err)
+		case n > 0:
+			log.Printf("Archived %d expired links", n)
+			gl.resolved.Clear()
+			gl.changes.poke()
+		}
+		n, err = link.PurgeTrash(ctx, gl.db, now.Add(-gl.opts.TrashRetention))
+		switch {
+		case err != nil && ctx.Err() == nil:
+			log.Printf("Failed to purge the trash: %v", err)
+		case n > 0:
+			log.Printf("Purged %d deleted links", n)
+		}
+	}
+	if _, err := link.PruneChanges(ctx, gl.db, now.Add(-gl.opts.ChangeRetention)); err != nil && ctx.Err() == nil {
+		log.Printf("Failed to prune the log of changes: %v", err)
+	}
+}
@@ -2,59 +2,427 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	_ "embed"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3" // sql driver
+	"github.com/spwg/golink/internal/certreload"
+	"github.com/spwg/golink/internal/config"
 	"github.com/spwg/golink/internal/datastore"
+	"github.com/spwg/golink/internal/dnsserver"
+	"github.com/spwg/golink/internal/forwarded"
 	"github.com/spwg/golink/internal/service"
 )
 
 var (
-	hostName   string
-	dbPathFlag = flag.String("db_path", "/tmp/golink.db", "Path to a sqlite database.")
-	portFlag   = flag.Int("port", 10123, "The port to listen on. Override with the PORT env var.")
+	_                      = flag.String(config.FileFlag, "", "Path to an optional JSON config file keyed by flag name. Flags and GOLINK_<FLAG NAME> environment variables take precedence over it.")
+	dbPathFlag             = flag.String("db_path", "/tmp/golink.db", "Path to a sqlite database.")
+	portFlag               = flag.Int("port", 10123, "The port to listen on. Overridden by the PORT env var.")
+	baseURLFlag            = flag.String("base_url", "", "Public address of the service, like https://go.example.com. Defaults to http://localhost:<port>.")
+	shortHosts             = flag.String("short_hosts", "go", "Comma-separated host names, like go,go.corp, that users type instead of the host of -base_url.")
+	enforceHTTPS           = flag.Bool("enforce_https", false, "Redirect requests that reached the proxy in front of the service over plain http to -base_url, which must be https.")
+	permanentHostRedirects = flag.Bool("permanent_host_redirects", false, "Redirect to -base_url with 301 rather than 307, which browsers cache until their cache is cleared.")
+	trustedProxies         = flag.String("trusted_proxies", "", "Comma-separated networks, like 10.0.0.0/8, of proxies whose Forwarded and X-Forwarded-* headers are believed.")
+	logLevel               = flag.String("log_level", "info", "Minimum level of logs to write: debug, info, warn or error.")
+	logFormat              = flag.String("log_format", "text", "Format of logs: text or json.")
+	analyticsID            = flag.String("analytics_id", "", "Google Analytics measurement ID, like G-XXXXXXXXXX, to add to every page. Pages have no analytics if empty.")
+
+	dbJournalMode     = flag.String("db_journal_mode", "wal", "SQLite journal mode of the database: delete, truncate, persist, memory, wal or off.")
+	dbSynchronous     = flag.String("db_synchronous", "normal", "SQLite synchronous level of the database: off, normal, full or extra.")
+	dbBusyTimeout     = flag.Duration("db_busy_timeout", 5*time.Second, "How long a write waits for another one to finish before failing with \"database is locked\".")
+	dbForeignKeys     = flag.Bool("db_foreign_keys", true, "Enforce foreign key constraints in the database.")
+	dbMaxOpenConns    = flag.Int("db_max_open_conns", 0, "Most database connections open at once. Defaults to twice the number of CPUs.")
+	dbMaxIdleConns    = flag.Int("db_max_idle_conns", 0, "Most idle database connections kept open. Defaults to -db_max_open_conns.")
+	dbConnMaxLifetime = flag.Duration("db_conn_max_lifetime", 0, "How long a database connection is reused for. Zero means forever.")
+
+	readHeaderTimeout = flag.Duration("read_header_timeout", 10*time.Second, "Time allowed to read request headers.")
+	readTimeout       = flag.Duration("read_timeout", 30*time.Second, "Time allowed to read an entire request.")
+	writeTimeout      = flag.Duration("write_timeout", 30*time.Second, "Time allowed to write a response.")
+	idleTimeout       = flag.Duration("idle_timeout", 2*time.Minute, "How long to keep idle keep-alive connections open.")
+	maxHeaderBytes    = flag.Int("max_header_bytes", 64<<10, "Maximum size of request headers in bytes.")
+	shutdownTimeout   = flag.Duration("shutdown_timeout", 10*time.Second, "How long to wait for in-flight requests when shutting down.")
+	cleanupInterval   = flag.Duration("cleanup_interval", time.Hour, "How often to archive expired links and purge old links from the trash.")
+	trashRetention    = flag.Duration("trash_retention", 30*24*time.Hour, "How long deleted links can be restored before they're purged.")
+	expiryWarning     = flag.Duration("expiry_warning", 7*24*time.Hour, "How long before a link expires its manage page starts to warn about it.")
+	cacheSize         = flag.Int("cache_size", 10000, "Number of names whose links are cached for redirects.")
+	cacheTTL          = flag.Duration("cache_ttl", 30*time.Second, "How long resolved names are cached at most. Zero disables the cache.")
+	changePoll        = flag.Duration("change_poll_interval", time.Second, "How often to check the database for links that other replicas changed.")
+	changeRetention   = flag.Duration("change_retention", 7*24*time.Hour, "How long changes are kept for /api/v1/changes.")
+
+	tlsCert           = flag.String("tls_cert", "", "Path to a PEM certificate to serve https with. The service serves plain http if empty.")
+	tlsKey            = flag.String("tls_key", "", "Path to the PEM private key of -tls_cert.")
+	tlsReloadInterval = flag.Duration("tls_reload_interval", time.Minute, "How often to check -tls_cert and -tls_key for changes.")
+	httpRedirectAddr  = flag.String("http_redirect_addr", "", "Address, like :80, of a plain http listener that redirects to -base_url when serving https. Disabled if empty.")
+
+	upstream      = flag.String("upstream", "", "Address, like https://go.example.com, of a golink server to mirror. The mirror copies its links, serves them read-only and keeps serving them when the upstream is down. Disabled if empty.")
+	upstreamToken = flag.String("upstream_token", "", "The -mirror_token of -upstream. Without it only the links that anonymous users can list are mirrored.")
+	mirrorRetry   = flag.Duration("mirror_retry", 10*time.Second, "How long to wait before trying to reach -upstream again.")
+	mirrorToken   = flag.String("mirror_token", "", "Bearer token that lets mirrors of this server read every link, including unlisted and private ones.")
+
+	fallbacks       = flag.String("fallbacks", "", "Comma-separated addresses, like https://go.example.com, of golink servers that are asked in turn for names that don't exist here.")
+	fallbackTTL     = flag.Duration("fallback_ttl", time.Minute, "How long the answers of -fallbacks are cached. Zero disables the cache.")
+	fallbackTimeout = flag.Duration("fallback_timeout", 2*time.Second, "Time allowed for each of -fallbacks to answer.")
+
+	adminToken      = flag.String("admin_token", "", "Bearer token that lets requests download a backup of the database from /admin/backup. Disabled if empty.")
+	backupDir       = flag.String("backup_dir", "", "Directory to back the database up to every -backup_interval, like /data/backups. Disabled if empty.")
+	backupInterval  = flag.Duration("backup_interval", 6*time.Hour, "How often to back the database up to -backup_dir.")
+	backupRetention = flag.Duration("backup_retention", 7*24*time.Hour, "How long backups in -backup_dir are kept. The latest one is always kept.")
+
+	dnsAddr        = flag.String("dns_addr", "", "UDP address for the built-in DNS server, like :53. The DNS server is disabled if empty.")
+	dnsNames       = flag.String("dns_names", "", "Comma-separated host names that the DNS server resolves, like go,go.corp. Defaults to -short_hosts.")
+	dnsAnswers     = flag.String("dns_answers", "", "Comma-separated IP addresses of the service that the DNS server answers with.")
+	dnsUpstream    = flag.String("dns_upstream", "", "host:port of a resolver that the DNS server forwards other queries to. Other queries are refused if empty.")
+	dnsForwardFrom = flag.String("dns_forward_from", "", "Comma-separated networks, like 10.0.0.0/8, of the clients whose queries the DNS server forwards to -dns_upstream. Defaults to loopback and private addresses.")
+
+	userHeader        = flag.String("user_header", "", "Request header, like X-Forwarded-User, in which a trusted proxy names the signed-in user. Users are anonymous if empty.")
+	groupsHeader      = flag.String("groups_header", "", "Request header in which a trusted proxy lists the comma-separated groups of the signed-in user, for private links.")
+	redirectRate      = flag.Float64("redirect_rate", 20, "Links that each client and each user can resolve per second. Zero disables the limit.")
+	redirectBurst     = flag.Int("redirect_burst", 100, "Links that each client and each user can resolve in quick succession.")
+	writeRate         = flag.Float64("write_rate", 0.5, "Links that each client and each user can create, update or delete per second. Zero disables the limit.")
+	writeBurst        = flag.Int("write_burst", 10, "Links that each client and each user can create, update or delete in quick succession.")
+	maxTrackedClients = flag.Int("max_tracked_clients", 10000, "Number of clients and of users that the rate limits keep track of.")
+	maxLinksPerUser   = flag.Int("max_links_per_user", 1000, "Links that each user named by -user_header can create. Zero means no limit.")
 )
 
 //go:embed internal/schema/golink.sql
 var schema string
 
 func main() {
-	flag.Parse()
-	ctx := context.Background()
-	if err := run(ctx); err != nil {
+	if err := config.Load(flag.CommandLine, os.Args[1:], os.Getenv); err != nil {
+		log.Fatalln(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var err error
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+		err = run(ctx)
+	case "backup", "restore":
+		if flag.NArg() != 2 {
+			usage := "usage: golink [flags] " + cmd + " <path>"
+			if cmd == "restore" {
+				// Restoring swaps the files of the database.
+				usage += "\nStop the server first: restore replaces -db_path with the backup at <path>."
+			}
+			err = errors.New(usage)
+		} else if cmd == "backup" {
+			err = backup(ctx, flag.Arg(1))
+		} else {
+			err = restore(ctx, flag.Arg(1))
+		}
+	default:
+		err = fmt.Errorf("unknown command %q, want backup or restore", cmd)
+	}
+	if err != nil {
 		log.Fatalln(err)
 	}
 }
 
+// backup writes a consistent copy of the database at -db_path to path. It's
+// safe to run while the server is using the database.
+func backup(ctx context.Context, path string) error {
+	db, err := datastore.SQLite(ctx, *dbPathFlag, schema, dbOptions())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := datastore.Backup(ctx, db, path); err != nil {
+		return err
+	}
+	log.Printf("Backed up %s to %s", *dbPathFlag, path)
+	return nil
+}
+
+// restore replaces the database at -db_path with the backup at path. The
+// server must be stopped first.
+func restore(ctx context.Context, path string) error {
+	v, kept, err := datastore.Restore(ctx, path, *dbPathFlag, time.Now())
+	if err != nil {
+		return err
+	}
+	log.Printf("Restored %s from %s at schema version %d", *dbPathFlag, path, v)
+	if kept != "" {
+		log.Printf("The database it replaced is at %s", kept)
+	}
+	return nil
+}
+
 func run(ctx context.Context) error {
-	var hostName string
+	logger, err := newLogger(*logLevel, *logFormat)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
 	if os.Getenv("PORT") != "" {
 		p, err := strconv.Atoi(os.Getenv("PORT"))
 		if err != nil {
 			return err
 		}
 		portFlag = &p
-		*dbPathFlag = "/data/golink.db"
-		hostName = "golinkservice.com"
-	} else {
-		hostName = fmt.Sprintf("localhost:%v", *portFlag)
 	}
-	db, err := datastore.SQLite(ctx, *dbPathFlag, schema)
+	opts, err := serviceOptions()
 	if err != nil {
-		log.Fatalln(err)
+		return err
+	}
+	var certs *certreload.Reloader
+	if *tlsCert != "" || *tlsKey != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			return fmt.Errorf("-tls_cert and -tls_key must be set together")
+		}
+		if certs, err = certreload.New(*tlsCert, *tlsKey); err != nil {
+			return err
+		}
+		opts.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			NextProtos:     []string{"h2", "http/1.1"},
+			GetCertificate: certs.GetCertificate,
+		}
+	} else if *httpRedirectAddr != "" {
+		return fmt.Errorf("-http_redirect_addr requires -tls_cert and -tls_key")
 	}
-	gl := service.New(db, hostName)
+	var dns *dnsserver.Server
+	if *dnsAddr != "" {
+		names := *dnsNames
+		if names == "" {
+			names = *shortHosts
+		}
+		if dns, err = newDNSServer(names, *dnsAnswers, *dnsUpstream, *dnsForwardFrom); err != nil {
+			return err
+		}
+	}
+	db, err := datastore.SQLite(ctx, *dbPathFlag, schema, dbOptions())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			log.Printf("Failed to close the database: %v", err)
+		}
+	}()
+	gl := service.New(db, opts)
 	l, err := net.Listen("tcp", fmt.Sprintf(":%d", *portFlag))
 	if err != nil {
 		return err
 	}
-	return gl.Run(ctx, l)
+	var redirectListener net.Listener
+	if *httpRedirectAddr != "" {
+		if redirectListener, err = net.Listen("tcp", *httpRedirectAddr); err != nil {
+			return err
+		}
+	}
+	g := newGroup(ctx)
+	g.Go(func(ctx context.Context) error { return gl.Run(ctx, l) })
+	if dns != nil {
+		g.Go(func(ctx context.Context) error { return dns.ListenAndServe(ctx, *dnsAddr) })
+	}
+	if redirectListener != nil {
+		g.Go(func(ctx context.Context) error { return gl.RunHTTPRedirect(ctx, redirectListener) })
+	}
+	if certs != nil {
+		go certs.Watch(g.ctx, *tlsReloadInterval)
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	log.Printf("Shut down cleanly")
+	return nil
+}
+
+// group runs servers until the first of them returns and then stops the rest,
+// since the service is of little use to clients without any one of them.
+type group struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	errs   []error
+}
+
+func newGroup(ctx context.Context) *group {
+	ctx, cancel := context.WithCancel(ctx)
+	return &group{ctx: ctx, cancel: cancel}
+}
+
+// Go runs f in a new goroutine.
+func (g *group) Go(f func(ctx context.Context) error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		err := f(g.ctx)
+		g.cancel()
+		if err != nil {
+			g.mu.Lock()
+			g.errs = append(g.errs, err)
+			g.mu.Unlock()
+		}
+	}()
+}
+
+// Wait waits for every function to return and returns their errors.
+func (g *group) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return errors.Join(g.errs...)
+}
+
+// serviceOptions validates the flags of the service and returns its options.
+func serviceOptions() (service.Options, error) {
+	base := *baseURLFlag
+	if base == "" {
+		base = fmt.Sprintf("http://localhost:%d", *portFlag)
+	}
+	u, err := config.BaseURL(base)
+	if err != nil {
+		return service.Options{}, fmt.Errorf("invalid -base_url: %w", err)
+	}
+	hosts := config.List(*shortHosts)
+	if err := config.CheckShortHosts(hosts); err != nil {
+		return service.Options{}, fmt.Errorf("invalid -short_hosts: %w", err)
+	}
+	if *enforceHTTPS && u.Scheme != "https" {
+		return service.Options{}, fmt.Errorf("-enforce_https requires an https -base_url, got %q", base)
+	}
+	proxies, err := forwarded.ParsePrefixes(config.List(*trustedProxies))
+	if err != nil {
+		return service.Options{}, fmt.Errorf("invalid -trusted_proxies: %w", err)
+	}
+	var up *url.URL
+	if *upstream != "" {
+		if up, err = config.BaseURL(*upstream); err != nil {
+			return service.Options{}, fmt.Errorf("invalid -upstream: %w", err)
+		}
+	}
+	var fbs []*url.URL
+	for _, s := range config.List(*fallbacks) {
+		fb, err := config.BaseURL(s)
+		if err != nil {
+			return service.Options{}, fmt.Errorf("invalid -fallbacks: %w", err)
+		}
+		fbs = append(fbs, fb)
+	}
+	// The service disables its caches with a negative TTL.
+	ttl, fbTTL := *cacheTTL, *fallbackTTL
+	if ttl == 0 {
+		ttl = -1
+	}
+	if fbTTL == 0 {
+		fbTTL = -1
+	}
+	return service.Options{
+		BaseURL:                u,
+		ShortHosts:             hosts,
+		EnforceHTTPS:           *enforceHTTPS,
+		PermanentHostRedirects: *permanentHostRedirects,
+		TrustedProxies:         proxies,
+		ReadHeaderTimeout:      *readHeaderTimeout,
+		ReadTimeout:            *readTimeout,
+		WriteTimeout:           *writeTimeout,
+		IdleTimeout:            *idleTimeout,
+		MaxHeaderBytes:         *maxHeaderBytes,
+		ShutdownTimeout:        *shutdownTimeout,
+		UserHeader:             *userHeader,
+		GroupsHeader:           *groupsHeader,
+		RedirectLimit:          service.RateLimit{Rate: *redirectRate, Burst: *redirectBurst},
+		WriteLimit:             service.RateLimit{Rate: *writeRate, Burst: *writeBurst},
+		MaxTrackedClients:      *maxTrackedClients,
+		MaxLinksPerUser:        *maxLinksPerUser,
+		AnalyticsID:            *analyticsID,
+		CleanupInterval:        *cleanupInterval,
+		TrashRetention:         *trashRetention,
+		ExpiryWarning:          *expiryWarning,
+		CacheSize:              *cacheSize,
+		CacheTTL:               ttl,
+		ChangePollInterval:     *changePoll,
+		ChangeRetention:        *changeRetention,
+		Upstream:               up,
+		UpstreamToken:          *upstreamToken,
+		MirrorRetry:            *mirrorRetry,
+		MirrorToken:            *mirrorToken,
+		Fallbacks:              fbs,
+		FallbackTTL:            fbTTL,
+		FallbackTimeout:        *fallbackTimeout,
+		AdminToken:             *adminToken,
+		BackupDir:              *backupDir,
+		BackupInterval:         *backupInterval,
+		BackupRetention:        *backupRetention,
+	}, nil
+}
+
+// dbOptions returns the datastore.Options set by the db flags.
+func dbOptions() datastore.Options {
+	busyTimeout := *dbBusyTimeout
+	if busyTimeout == 0 {
+		// The datastore fails at once with a negative timeout.
+		busyTimeout = -1
+	}
+	return datastore.Options{
+		JournalMode:     *dbJournalMode,
+		Synchronous:     *dbSynchronous,
+		BusyTimeout:     busyTimeout,
+		NoForeignKeys:   !*dbForeignKeys,
+		MaxOpenConns:    *dbMaxOpenConns,
+		MaxIdleConns:    *dbMaxIdleConns,
+		ConnMaxLifetime: *dbConnMaxLifetime,
+	}
+}
+
+// newDNSServer creates a *dnsserver.Server from the comma-separated values
+// of the dns flags.
+func newDNSServer(names, answers, upstream, forwardFrom string) (*dnsserver.Server, error) {
+	s := &dnsserver.Server{Names: config.List(names), Upstream: upstream}
+	if len(s.Names) == 0 {
+		return nil, fmt.Errorf("-dns_names must not be empty when -dns_addr is set")
+	}
+	for _, a := range config.List(answers) {
+		addr, err := netip.ParseAddr(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -dns_answers address %q: %w", a, err)
+		}
+		s.Addrs = append(s.Addrs, addr)
+	}
+	if len(s.Addrs) == 0 {
+		return nil, fmt.Errorf("-dns_answers must not be empty when -dns_addr is set")
+	}
+	if upstream != "" {
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			return nil, fmt.Errorf("invalid -dns_upstream %q: %w", upstream, err)
+		}
+	}
+	var err error
+	if s.ForwardFrom, err = forwarded.ParsePrefixes(config.List(forwardFrom)); err != nil {
+		return nil, fmt.Errorf("invalid -dns_forward_from: %w", err)
+	}
+	return s, nil
+}
+
+// newLogger creates a *slog.Logger that writes to stderr in the given format.
+func newLogger(level, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid -log_level %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid -log_format %q: must be text or json", format)
 }
 
 func init() {